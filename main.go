@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"redis/pkg"
 
 	"github.com/panjf2000/gnet/v2"
@@ -12,31 +14,97 @@ import (
 )
 
 var (
-	netpkg = flag.String("netpkg", "net", "gnet or net")
-	netmap = map[string]func(){
-		"gnet": func() {
+	netpkg                   = flag.String("netpkg", "net", "gnet or net")
+	maxmemory                = flag.Int64("maxmemory", 0, "memory limit in bytes, 0 for no limit")
+	maxmemoryPolicy          = flag.String("maxmemory-policy", "noeviction", "eviction policy once maxmemory is reached")
+	appendonly               = flag.Bool("appendonly", false, "log every write to the append only file")
+	appenddirname            = flag.String("appenddirname", "appendonlydir", "directory of the append only file")
+	aofLoadTruncated         = flag.Bool("aof-load-truncated", true, "load an append only file whose last command was cut short by a crash")
+	aofTimestampEnabled      = flag.Bool("aof-timestamp-enabled", false, "annotate the append only file with a #TS:<unix> line every second")
+	aofTruncateToTimestamp   = flag.Int64("aof-truncate-to-timestamp", 0, "before loading, drop every command of the append only file after this unix time")
+	appendfsync              = flag.String("appendfsync", "everysec", "when to fsync the append only file: always, everysec or no")
+	autoAofRewritePercentage = flag.Int("auto-aof-rewrite-percentage", 100, "rewrite the append only file once it grew by this many percent, 0 to disable")
+	autoAofRewriteMinSize    = flag.Int64("auto-aof-rewrite-min-size", 64<<20, "size in bytes below which the append only file isn't rewritten automatically")
+	aofUseRdbPreamble        = flag.Bool("aof-use-rdb-preamble", true, "write the base file of a rewrite as an RDB snapshot")
+	dbfilename               = flag.String("dbfilename", "dump.rdb", "path of the RDB snapshot")
+	save                     = flag.String("save", "3600 1 300 100 60 10000", "snapshot after <seconds> <changes> pairs, empty to disable")
+	netmap                   = map[string]func(config *pkg.Config){
+		"gnet": func(config *pkg.Config) {
 			p := goroutine.Default()
 			defer p.Release()
-			srv := pkg.NewGServer("tcp", ":6379", true, p)
+			srv, err := pkg.NewGServer("tcp", ":6379", true, p, config)
+			if err != nil {
+				log.Fatal(err)
+			}
 			log.Fatal(gnet.Run(srv, srv.ProtoAddr(), gnet.WithMulticore(srv.Multicore())))
 		},
-		"net": func() {
+		"net": func(config *pkg.Config) {
 			log.Println("listening on :6379...")
-			server := pkg.NewServer(&pkg.Config{
-				EnableAof: false,
-			})
+			server, err := pkg.NewServer(config)
+			if err != nil {
+				log.Fatal(err)
+			}
 			log.Fatal(server.ListenAndServe(":6379"))
 		},
 	}
 )
 
+// checkAof implements the check-aof subcommand:
+//
+//	check-aof [--fix | --truncate-to-timestamp <unix>] <file.manifest | file.aof>
+func checkAof(args []string) {
+	fs := flag.NewFlagSet("check-aof", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "truncate the last file to its last valid command")
+	ts := fs.Int64("truncate-to-timestamp", 0, "drop every command after this unix time, the AOF must have been written with -aof-timestamp-enabled")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: check-aof [--fix | --truncate-to-timestamp <unix>] <file.manifest | file.aof>")
+		os.Exit(1)
+	}
+
+	var err error
+	if *ts > 0 {
+		err = pkg.TruncateAofToTimestamp(fs.Arg(0), *ts, os.Stdout)
+	} else {
+		err = pkg.CheckAof(fs.Arg(0), *fix, os.Stdout)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" {
+		checkAof(os.Args[2:])
+		return
+	}
+
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 	flag.Parse()
+	savePoints, err := pkg.ParseSavePoints(*save)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// both front ends share the configuration
+	config := &pkg.Config{
+		EnableAof:                *appendonly,
+		AofDir:                   *appenddirname,
+		AofLoadTruncated:         *aofLoadTruncated,
+		AofTimestampEnabled:      *aofTimestampEnabled,
+		AofTruncateToTimestamp:   *aofTruncateToTimestamp,
+		AppendFsync:              *appendfsync,
+		AutoAofRewritePercentage: *autoAofRewritePercentage,
+		AutoAofRewriteMinSize:    *autoAofRewriteMinSize,
+		AofUseRdbPreamble:        *aofUseRdbPreamble,
+		RdbFile:                  *dbfilename,
+		Save:                     savePoints,
+		MaxMemory:                *maxmemory,
+		MaxMemoryPolicy:          *maxmemoryPolicy,
+	}
 	if f, ok := netmap[*netpkg]; ok {
-		f()
+		f(config)
 	} else {
 		log.Fatal("invalid netpkg")
 	}
@@ -7,8 +7,11 @@ import (
 )
 
 func TestXxx(t *testing.T) {
-	server := pkg.NewServer(&pkg.Config{
+	server, err := pkg.NewServer(&pkg.Config{
 		EnableAof: false,
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 	log.Fatal(server.ListenAndServe(":6379"))
 }
@@ -1,104 +1,731 @@
 package pkg
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// fsyncPolicy is when appended commands are fsynced to disk.
+type fsyncPolicy uint8
+
+const (
+	// fsyncEverysec syncs once a second in the background.
+	fsyncEverysec fsyncPolicy = iota
+	// fsyncAlways syncs before Append returns.
+	fsyncAlways
+	// fsyncNo leaves syncing to the operating system.
+	fsyncNo
+)
+
+var fsyncPolicies = map[string]fsyncPolicy{
+	"everysec": fsyncEverysec,
+	"always":   fsyncAlways,
+	"no":       fsyncNo,
+}
+
+func parseFsyncPolicy(name string) (fsyncPolicy, error) {
+	if name == "" {
+		return fsyncEverysec, nil
+	}
+	p, ok := fsyncPolicies[strings.ToLower(name)]
+	if !ok {
+		return fsyncEverysec, fmt.Errorf("invalid appendfsync '%s'", name)
+	}
+	return p, nil
+}
+
+func (p fsyncPolicy) String() string {
+	for name, policy := range fsyncPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Aof is a multi part append only file: a directory holding a base file,
+// the incremental files appended to since and a manifest listing them.
+// Commands are appended to the last incremental file.
 type Aof struct {
-	file   *os.File
-	rd     *bufio.Reader
-	mu     sync.Mutex
-	closed bool
-	atEnd  bool
+	dir      string
+	name     string
+	manifest *aofManifest // guarded by mu
+	file     *os.File
+	mu       sync.Mutex
+	closed   bool
+
+	fsync fsyncPolicy
+	// timestamps enables the #TS annotations. lastTS is the second of
+	// the last one written and rewriteTS of the last one in rewriteBuf,
+	// both guarded by mu.
+	timestamps bool
+	lastTS     int64
+	rewriteTS  int64
+	// rdbPreamble makes rewrites write the base file as an RDB snapshot.
+	rdbPreamble bool
+	// syncMu serializes fsyncs. Writers hold mu only while writing, so
+	// commands don't wait for a running fsync unless appendfsync is
+	// always.
+	syncMu sync.Mutex
+	// written and synced count the appends written to the file and
+	// covered by an fsync. pendingSince is when the oldest append not
+	// yet synced was written, zero when everything is synced. All three
+	// are guarded by mu.
+	written      int64
+	synced       int64
+	pendingSince time.Time
+	syncErr      error // of the last fsync
+
+	// size is the size of all parts and baseSize the size of the base
+	// file, for auto-aof-rewrite-percentage. While rewriting, the
+	// writes the rewrite needs are copied to rewriteBuf. All guarded by
+	// mu.
+	size           int64
+	baseSize       int64
+	rewriting      bool
+	rewriteBuf     []byte
+	lastRewriteErr error
+	stop           chan struct{}
+	done           chan struct{}
 }
 
-func NewAof(file string) (*Aof, error) {
+// NewAof opens the AOF called file in dir, creating both if needed.
+// appendfsync is always, everysec (the default) or no.
+func NewAof(dir, file string, appendfsync string) (*Aof, error) {
+	policy, err := parseFsyncPolicy(appendfsync)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, name := aofLocation(dir, file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
 
-	if file == "" {
-		file = "pkg.aof"
+	m, err := loadAofManifest(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		if m, err = createAofManifest(dir, name, legacyAofPaths(dir, file)); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.incrs) == 0 {
+		m.nextIncr(name)
+		if err := m.persist(dir, name); err != nil {
+			return nil, err
+		}
+	}
+	// a rewrite may have stopped before deleting them
+	if err := m.deleteHistory(dir, name); err != nil {
+		return nil, err
 	}
 
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
+	incr := m.incrs[len(m.incrs)-1]
+	f, err := os.OpenFile(filepath.Join(dir, incr.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
-	}
-	// start a goroutine to flush the buffer to disk every second
-	go func() {
-		for {
-			aof.mu.Lock()
-			if aof.closed {
-				aof.mu.Unlock()
-				return
-			}
-			aof.file.Sync()
-			aof.mu.Unlock()
-			time.Sleep(time.Second)
+		dir:      dir,
+		name:     name,
+		manifest: m,
+		file:     f,
+		fsync:    policy,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, part := range m.parts() {
+		info, err := os.Stat(filepath.Join(dir, part.name))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		aof.size += info.Size()
+		if part.typ == aofBase {
+			aof.baseSize = info.Size()
 		}
-	}()
+	}
+
+	if policy == fsyncEverysec {
+		go aof.syncEverySecond()
+	} else {
+		close(aof.done)
+	}
 	return aof, nil
 }
 
-func (a *Aof) Close() error {
+// aofLocation returns the directory and the file name of the AOF for the
+// AofDir and AofFile settings. AofFile may still be a path, as it was
+// before the multi part layout: the name is then its base, and the
+// directory defaults to appendonlydir next to it.
+func aofLocation(dir, file string) (string, string) {
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(file), "appendonlydir")
+	}
+	if file == "" {
+		return dir, "appendonly.aof"
+	}
+	return dir, filepath.Base(file)
+}
+
+// legacyAofPaths lists where a single file AOF from before the multi part
+// layout may be, most likely first: at file when it is a path, next to
+// dir like Redis keeps it, and at pkg.aof, our old default.
+func legacyAofPaths(dir, file string) []string {
+	_, name := aofLocation(dir, file)
+	var paths []string
+	if file != name {
+		paths = append(paths, file)
+	}
+	paths = append(paths, filepath.Join(filepath.Dir(dir), name))
+	if file == "" {
+		paths = append(paths, "pkg.aof")
+	}
+	return paths
+}
+
+// createAofManifest starts the manifest of a new AOF. The first single
+// file AOF found at legacy, from before the multi part layout, becomes
+// its base file.
+func createAofManifest(dir, name string, legacy []string) (*aofManifest, error) {
+	m := &aofManifest{}
+	var old string
+	for _, path := range legacy {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			old = path
+			break
+		}
+	}
+	migrate := old != ""
+	base := m.nextBase(name, migrate && fileIsRdb(old))
+	path := filepath.Join(dir, base.name)
+
+	if migrate {
+		if err := os.Rename(old, path); err != nil {
+			return nil, err
+		}
+		log.Printf("AOF: moved %s to %s", old, path)
+	} else {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+
+	m.nextIncr(name)
+	if err := m.persist(dir, name); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// fileIsRdb reports whether the file at path starts with an RDB preamble.
+func fileIsRdb(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == "REDIS"
+}
+
+func (a *Aof) syncEverySecond() {
+	defer close(a.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.sync()
+		}
+	}
+}
+
+// sync fsyncs every append written so far. Callers that queue on syncMu
+// behind a running fsync find their appends covered by the next one, so
+// concurrent writers share a single fsync.
+func (a *Aof) sync() error {
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+
+	a.mu.Lock()
+	target := a.written
+	if a.synced >= target {
+		a.mu.Unlock()
+		return nil
+	}
+	a.mu.Unlock()
+
+	err := a.file.Sync()
+
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	a.closed = true
-	return a.file.Close()
+	a.syncErr = err
+	if err != nil {
+		return err
+	}
+	a.synced = target
+	if a.written == target {
+		a.pendingSince = time.Time{}
+	}
+	return nil
 }
 
-func (a *Aof) ReadValues(iterator func(Value) bool) error {
-	a.atEnd = false
-	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+// FsyncLag is how long the oldest append not yet fsynced has been waiting.
+func (a *Aof) FsyncLag() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pendingSince.IsZero() {
+		return 0
+	}
+	return time.Since(a.pendingSince)
+}
+
+// rewriteSwapSize is how much of the rewrite buffer may be left when the
+// new file is swapped in. The rest is copied without blocking writers.
+const rewriteSwapSize = 64 * 1024
+
+func (a *Aof) startRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = true
+	a.rewriteBuf = nil
+	a.rewriteTS = 0
+}
+
+// abortRewrite drops a failed rewrite and its temporary file, if any.
+func (a *Aof) abortRewrite(tmp *os.File, err error) {
+	if tmp != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = false
+	a.rewriteBuf = nil
+	a.lastRewriteErr = err
+}
+
+// finishRewrite appends the rewrite buffer to tmp, which holds the dumped
+// keyspace, and atomically replaces the AOF with it.
+func (a *Aof) finishRewrite(tmp *os.File) error {
+	for {
+		a.mu.Lock()
+		buf := a.rewriteBuf
+		if len(buf) <= rewriteSwapSize {
+			a.mu.Unlock()
+			break
+		}
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+
+		if _, err := tmp.Write(buf); err != nil {
+			a.abortRewrite(tmp, err)
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		a.abortRewrite(tmp, err)
+		return err
+	}
+
+	// block the writers and the fsyncs for the last few writes and the
+	// swap
+	a.syncMu.Lock()
+	a.mu.Lock()
+	err := a.swapRewrite(tmp)
+	a.mu.Unlock()
+	a.syncMu.Unlock()
+
+	if err != nil {
+		a.abortRewrite(tmp, err)
+	}
+	return err
+}
+
+// swapRewrite makes tmp the new base file, starts a new incremental file
+// and deletes the files they replace. The caller holds mu and syncMu.
+func (a *Aof) swapRewrite(tmp *os.File) error {
+	if a.closed {
+		return fmt.Errorf("aof is closed")
+	}
+	if _, err := tmp.Write(a.rewriteBuf); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+
+	m := a.manifest.clone()
+	base := m.nextBase(a.name, a.rdbPreamble)
+	m.historyIncrs()
+	incr := m.nextIncr(a.name)
+
+	if err := os.Rename(tmp.Name(), filepath.Join(a.dir, base.name)); err != nil {
+		return err
+	}
+	tmp.Close()
+	f, err := os.OpenFile(filepath.Join(a.dir, incr.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	// the new manifest is what commits the rewrite
+	if err := m.persist(a.dir, a.name); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return err
 	}
 
-	rd := NewReader(a.file)
+	a.file.Close()
+	a.file = f
+	a.manifest = m
+	a.size, a.baseSize = info.Size(), info.Size()
+	a.synced = a.written
+	a.pendingSince = time.Time{}
+	a.syncErr = nil
+	a.rewriting = false
+	a.rewriteBuf = nil
+	a.lastRewriteErr = nil
+	// annotate the first write to the new incremental file
+	a.lastTS = 0
+
+	if err := m.deleteHistory(a.dir, a.name); err != nil {
+		log.Println("failed to delete aof history files:", err)
+	}
+	return nil
+}
+
+// grown reports whether the AOF has grown by pct percent since the last
+// rewrite and is at least minSize bytes, and no rewrite is running.
+func (a *Aof) grown(pct int, minSize int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rewriting || a.closed || a.size < minSize {
+		return false
+	}
+	base := a.baseSize
+	if base == 0 {
+		base = 1
+	}
+	return (a.size-a.baseSize)*100/base >= int64(pct)
+}
+
+// lastSyncErr is the error of the last fsync, nil if it succeeded.
+func (a *Aof) lastSyncErr() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.syncErr
+}
+
+func (a *Aof) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	close(a.stop)
+	<-a.done
+	if a.fsync != fsyncNo {
+		a.sync()
+	}
+	return a.file.Close()
+}
+
+// errAofTruncated is returned by scanAof when the last command is cut
+// short by the end of the file, as left by a crash in the middle of a
+// write.
+var errAofTruncated = errors.New("unexpected end of file")
+
+// AofFormatError is a part of the AOF that can't be parsed.
+type AofFormatError struct {
+	File   string
+	Offset int64 // of the first byte that can't be parsed
+	Err    error
+}
+
+func (e *AofFormatError) Error() string {
+	return fmt.Sprintf("bad file format reading the append only file %s at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// scanAof calls onKey with every key of the RDB preamble r may start
+// with, then fn with every command in r and onTS with every #TS
+// annotation until either returns false, and returns the offset just past
+// the last command or annotation read whole; when onTS stops the scan,
+// the offset of that annotation. The error is errAofTruncated when the
+// input ends in the middle of a command and an *AofFormatError, with an
+// empty File, when it isn't a command or the preamble is not valid.
+func scanAof(r io.Reader, onKey func(k *rdbKey), fn func(Value) bool, onTS func(ts int64) bool) (int64, error) {
+	cr := &countingReader{r: r}
+	rd := NewReader(cr)
+	var valid int64
+	if b, err := rd.r.Peek(5); err == nil && string(b) == "REDIS" {
+		if _, err := readRdb(rd.r, onKey); err != nil {
+			// a short preamble can't be cut back to a valid file
+			return 0, &AofFormatError{Err: fmt.Errorf("RDB preamble: %w", err)}
+		}
+		valid = cr.n - int64(rd.r.Buffered())
+	}
 	for {
-		v, err := rd.resp.Read()
+		b, err := rd.r.Peek(1)
+		if err == io.EOF {
+			return valid, nil
+		}
 		if err != nil {
+			return valid, err
+		}
+		if b[0] == '#' {
+			line, err := rd.r.ReadSlice('\n')
 			if err == io.EOF {
-				break
+				return valid, errAofTruncated
+			}
+			if err != nil || len(line) < 2 || line[len(line)-2] != '\r' {
+				return valid, &AofFormatError{Offset: valid, Err: errors.New("invalid annotation")}
+			}
+			// annotations other than timestamps are skipped
+			if ts, ok := parseTimestampAnnotation(line[:len(line)-2]); ok && onTS != nil && !onTS(ts) {
+				return valid, nil
 			}
-			fmt.Println("read value failed: ", err)
+			valid = cr.n - int64(rd.r.Buffered())
+			continue
+		}
+		if b[0] != ARRAY {
+			return valid, &AofFormatError{Offset: valid, Err: fmt.Errorf("expected '*', got '%c'", b[0])}
+		}
+
+		v, err := rd.resp.ReadRequest()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return valid, errAofTruncated
+		}
+		if err != nil {
+			return valid, &AofFormatError{Offset: valid, Err: err}
+		}
+		valid = cr.n - int64(rd.r.Buffered())
+
+		if fn != nil && !fn(v) {
+			return valid, nil
+		}
+	}
+}
+
+// timestampAnnotation is the #TS annotation written before the first
+// command of each second when timestamps are enabled.
+func timestampAnnotation(buf []byte, ts int64) []byte {
+	buf = append(buf, "#TS:"...)
+	buf = strconv.AppendInt(buf, ts, 10)
+	return append(buf, '\r', '\n')
+}
+
+func parseTimestampAnnotation(line []byte) (int64, bool) {
+	if !bytes.HasPrefix(line, []byte("#TS:")) {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(string(line[4:]), 10, 64)
+	return ts, err == nil
+}
+
+// ReadValues calls iterator with every command of every part, in order,
+// until it returns false. Any part that doesn't parse to the end is an
+// error. The keys of an RDB preamble are skipped.
+func (a *Aof) ReadValues(iterator func(Value) bool) error {
+	return a.load(nil, iterator, false)
+}
+
+// load is ReadValues, except that with loadTruncated a last command cut
+// short at the end of the last part is dropped and the part truncated,
+// like aof-load-truncated.
+func (a *Aof) load(onKey func(k *rdbKey), iterator func(Value) bool, loadTruncated bool) error {
+	a.mu.Lock()
+	parts := a.manifest.parts()
+	a.mu.Unlock()
+
+	for i, part := range parts {
+		path := filepath.Join(a.dir, part.name)
+		f, err := os.Open(path)
+		if err != nil {
 			return err
 		}
+		stopped := false
+		valid, err := scanAof(f, onKey, func(v Value) bool {
+			stopped = iterator != nil && !iterator(v)
+			return !stopped
+		}, nil)
+		f.Close()
 
-		if iterator != nil && !iterator(v) {
+		switch {
+		case err == errAofTruncated && loadTruncated && i == len(parts)-1:
+			log.Printf("!!! Warning: short read while loading the append only file %s !!!", path)
+			log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled, truncated to %d bytes", path, valid)
+			if err := a.truncate(path, valid); err != nil {
+				return err
+			}
+		case err == errAofTruncated:
+			return fmt.Errorf("unexpected end of file reading the append only file %s at offset %d, run check-aof --fix or enable aof-load-truncated", path, valid)
+		case err != nil:
+			if ferr, ok := err.(*AofFormatError); ok {
+				ferr.File = path
+			}
+			return err
+		}
+		if stopped {
 			return nil
 		}
 	}
+	return nil
+}
+
+// truncateAofToTimestamp cuts the AOF of name in dir at the first #TS
+// annotation later than ts and drops the parts after it, for point in
+// time recovery. It returns the part that was cut and its new size, or an
+// empty path when nothing is later than ts.
+func truncateAofToTimestamp(dir, name string, ts int64) (string, int64, error) {
+	m, err := loadAofManifest(dir, name)
+	if err != nil || m == nil {
+		return "", 0, err
+	}
+
+	parts := m.parts()
+	for i, part := range parts {
+		path := filepath.Join(dir, part.name)
+		f, err := os.Open(path)
+		if err != nil {
+			return "", 0, err
+		}
+		found := false
+		offset, err := scanAof(f, nil, nil, func(at int64) bool {
+			found = at > ts
+			return !found
+		})
+		f.Close()
+		if ferr, ok := err.(*AofFormatError); ok {
+			ferr.File = path
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		if !found {
+			continue
+		}
+		if part.typ == aofBase && offset == 0 {
+			return "", 0, fmt.Errorf("can't truncate the append only file to %d, the last rewrite is later", ts)
+		}
+
+		// drop the later parts from the manifest before cutting, so a
+		// crash in between can't bring them back
+		keep := make(map[*aofInfo]bool)
+		for _, p := range parts[:i+1] {
+			keep[p] = true
+		}
+		var incrs []*aofInfo
+		for _, incr := range m.incrs {
+			if keep[incr] {
+				incrs = append(incrs, incr)
+				continue
+			}
+			incr.typ = aofHistory
+			m.history = append(m.history, incr)
+		}
+		m.incrs = incrs
+		if err := m.persist(dir, name); err != nil {
+			return "", 0, err
+		}
+		if err := os.Truncate(path, offset); err != nil {
+			return "", 0, err
+		}
+		return path, offset, m.deleteHistory(dir, name)
+	}
+	return "", 0, nil
+}
 
-	_, err := a.file.Seek(0, io.SeekEnd)
+// truncate cuts the part at path to size bytes.
+func (a *Aof) truncate(path string, size int64) error {
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-
-	a.atEnd = true
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.size -= info.Size() - size
+	a.mu.Unlock()
 	return nil
 }
 
 func (a *Aof) Write(b []byte) (int, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.closed {
-		return 0, fmt.Errorf("aof is closed")
+	if err := a.write(b, b); err != nil {
+		return 0, err
 	}
-	return a.file.Write(b)
+	return len(b), nil
 }
 
 func (a *Aof) Append(v Value) error {
 	return a.AppendMany([]Value{v})
 }
 
+// appendCommands appends vs in one write, and copies rewrite, the part of
+// vs a running rewrite needs, to the rewrite buffer.
+func (a *Aof) appendCommands(vs, rewrite []Value) error {
+	buf, err := marshalCommands(vs)
+	if err != nil {
+		return err
+	}
+	rbuf, err := marshalCommands(rewrite)
+	if err != nil {
+		return err
+	}
+	return a.write(buf, rbuf)
+}
+
+func marshalCommands(vs []Value) ([]byte, error) {
+	var buf []byte
+	for _, v := range vs {
+		b, err := v.MarshalResp()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+// AppendMany appends vs. During a rewrite they are also copied to the
+// rewrite buffer, since there is no telling whether the rewrite saw them.
 func (a *Aof) AppendMany(vs []Value) error {
 	var buf []byte
 	for _, v := range vs {
@@ -110,21 +737,48 @@ func (a *Aof) AppendMany(vs []Value) error {
 		buf = append(buf, b...)
 
 	}
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	return a.write(buf, buf)
+}
 
+// write appends b to the file and, with appendfsync always, waits for it
+// to be fsynced. rewrite is what of b a running rewrite needs, if any.
+func (a *Aof) write(b, rewrite []byte) error {
+	a.mu.Lock()
 	if a.closed {
+		a.mu.Unlock()
 		return fmt.Errorf("aof is closed")
 	}
 
-	if !a.atEnd {
-		a.ReadValues(nil)
-		if !a.atEnd {
-			return fmt.Errorf("aof is not at end")
+	if a.timestamps {
+		if now := time.Now().Unix(); now > a.lastTS {
+			a.lastTS = now
+			b = append(timestampAnnotation(nil, now), b...)
 		}
 	}
 
-	_, err := a.file.Write(buf)
+	if _, err := a.file.Write(b); err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	a.written++
+	a.size += int64(len(b))
+	if a.rewriting && len(rewrite) > 0 {
+		// the buffer goes to the new base file and needs annotations of
+		// its own
+		if a.timestamps && a.lastTS > a.rewriteTS {
+			a.rewriteTS = a.lastTS
+			a.rewriteBuf = timestampAnnotation(a.rewriteBuf, a.lastTS)
+		}
+		a.rewriteBuf = append(a.rewriteBuf, rewrite...)
+	}
+	if a.pendingSince.IsZero() {
+		a.pendingSince = time.Now()
+	}
+	a.mu.Unlock()
 
-	return err
+	if a.fsync == fsyncAlways {
+		// the fsync also covers whatever other writers appended meanwhile
+		return a.sync()
+	}
+	return nil
 }
@@ -0,0 +1,774 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for name, want := range map[string]fsyncPolicy{"": fsyncEverysec, "always": fsyncAlways, "EVERYSEC": fsyncEverysec, "no": fsyncNo} {
+		p, err := parseFsyncPolicy(name)
+		if err != nil || p != want {
+			t.Fatalf("%q: expected %v, got %v %v", name, want, p, err)
+		}
+	}
+	if _, err := parseFsyncPolicy("sometimes"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestAofFsyncAlways(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "", "always")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := aof.Append(ArrayValue(BulkString("SET"), BulkString("k"), BulkString("v"))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	aof.mu.Lock()
+	written, synced := aof.written, aof.synced
+	aof.mu.Unlock()
+	if written != 50 || synced != 50 {
+		t.Fatalf("expected 50 appends written and synced, got %d and %d", written, synced)
+	}
+	if lag := aof.FsyncLag(); lag != 0 {
+		t.Fatalf("expected no fsync lag, got %v", lag)
+	}
+}
+
+func TestAofFsyncEverysec(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "", "everysec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	aof.Append(ArrayValue(BulkString("SET"), BulkString("k"), BulkString("v")))
+	time.Sleep(10 * time.Millisecond)
+	if lag := aof.FsyncLag(); lag <= 0 {
+		t.Fatalf("expected the append to wait for the background fsync, lag %v", lag)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for aof.FsyncLag() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the background fsync never ran")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAofCloseFlushes(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "", "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Append(ArrayValue(BulkString("SET"), BulkString("k"), BulkString("v")))
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Append(ArrayValue(BulkString("PING"))); err == nil {
+		t.Fatal("expected an error appending to a closed AOF")
+	}
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+}
+
+func TestInfoPersistence(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir, AppendFsync: "always"})
+	defer d.Aof.Close()
+
+	buf := &bytes.Buffer{}
+	client := d.newClient(NewWriter(buf))
+	d.exec(client, []Value{BulkString("SET"), BulkString("info:k"), BulkString("v")})
+	buf.Reset()
+	d.exec(client, []Value{BulkString("INFO"), BulkString("persistence")})
+
+	info := buf.String()
+	for _, want := range []string{"# Persistence\r\n", "aof_enabled:1\r\n", "aof_fsync:always\r\n", "aof_last_write_status:ok\r\n", "aof_fsync_lag_ms:0\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("expected %q in %q", want, info)
+		}
+	}
+	if strings.Contains(info, "# Stats") {
+		t.Fatalf("expected only the persistence section, got %q", info)
+	}
+}
+
+func TestAofPropagatesDeterministicCommands(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+
+	keys := []string{"prop:set", "prop:k", "prop:gone", "prop:restored", "prop:src", "prop:dst"}
+	defer func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}()
+
+	runCommand(t, d, 2, "SADD", "prop:set", "a", "b", "c")
+	popped := runCommand(t, d, 2, "SPOP", "prop:set")
+	runCommand(t, d, 2, "SET", "prop:k", "v")
+	runCommand(t, d, 2, "EXPIRE", "prop:k", "100")
+	runCommand(t, d, 2, "SET", "prop:gone", "v")
+	runCommand(t, d, 2, "EXPIRE", "prop:gone", "-1")
+	dumped := runCommand(t, d, 2, "DUMP", "prop:k")
+	payload := dumped[strings.Index(dumped, "\r\n")+2 : len(dumped)-2]
+	runCommand(t, d, 2, "RESTORE", "prop:restored", "100000", payload)
+	runCommand(t, d, 2, "RPUSH", "prop:src", "3", "1", "2")
+	runCommand(t, d, 2, "SORT", "prop:src", "STORE", "prop:dst")
+	d.Aof.Close()
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof := string(data)
+	for _, want := range []string{
+		"*3\r\n$4\r\nSREM\r\n$8\r\nprop:set\r\n" + popped,
+		"$9\r\nPEXPIREAT\r\n$6\r\nprop:k\r\n",
+		"*2\r\n$3\r\nDEL\r\n$9\r\nprop:gone\r\n",
+		"$6\r\nABSTTL\r\n",
+		"*2\r\n$3\r\nDEL\r\n$8\r\nprop:dst\r\n*5\r\n$5\r\nRPUSH\r\n$8\r\nprop:dst\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n",
+	} {
+		if !strings.Contains(aof, want) {
+			t.Fatalf("expected %q in %q", want, aof)
+		}
+	}
+	for _, unwanted := range []string{"SPOP", "SORT", "$6\r\nEXPIRE\r\n", "$6\r\n100000\r\n"} {
+		if strings.Contains(aof, unwanted) {
+			t.Fatalf("expected no %q in %q", unwanted, aof)
+		}
+	}
+}
+
+func TestRewriteBuffersDelOfDumpedKeys(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	// k1 in a shard the rewrite dumped already, k2 in one it didn't
+	k1, k2 := "rwdel:1", "rwdel:2"
+	for i := 3; shardIndex(k2) == shardIndex(k1); i++ {
+		k2 = "rwdel:" + strconv.Itoa(i)
+	}
+	runCommand(t, d, 2, "SET", k1, "v")
+	runCommand(t, d, 2, "SET", k2, "v")
+	rw := &aofRewrite{done: make(chan struct{})}
+	rw.dumped[shardIndex(k1)] = true
+	d.gate.Lock()
+	d.rewrite = rw
+	d.Aof.startRewrite()
+	d.gate.Unlock()
+	defer func() {
+		d.gate.Lock()
+		d.rewrite = nil
+		d.gate.Unlock()
+		d.Aof.abortRewrite(nil, nil)
+	}()
+
+	runCommand(t, d, 2, "DEL", k1, k2)
+	runCommand(t, d, 2, "SET", k2, "v")
+	defer runCommand(t, d, 2, "DEL", k2)
+
+	// the dump brings k2 into the new file, so replaying the buffer must
+	// not delete it
+	d.Aof.mu.Lock()
+	buf := string(d.Aof.rewriteBuf)
+	d.Aof.mu.Unlock()
+	if want := "*2\r\n$3\r\nDEL\r\n$7\r\n" + k1 + "\r\n"; buf != want {
+		t.Fatalf("expected the rewrite buffer %q, got %q", want, buf)
+	}
+}
+
+func TestAofPropagateCustomHandler(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	d.HandlerFunc("ROLL", CommandHandler{arity: 2, flags: cmdWrite, keys: keySpec{1, 1, 1},
+		Handler: func(w IWriter, args []Value) Result {
+			c := w.(*Client)
+			c.Propagate(BulkString("SET"), args[0], BulkString("4"))
+			c.MarkDirty(1)
+			w.WriteInteger(4)
+			return ResultOK
+		}})
+	runCommand(t, d, 2, "ROLL", "prop:dice")
+	d.Aof.Close()
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*3\r\n$3\r\nSET\r\n$9\r\nprop:dice\r\n$1\r\n4\r\n"; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+}
+
+func TestAofSkipsWritesWithoutChanges(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+
+	keys := []string{"noop:l", "noop:z"}
+	defer func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}()
+
+	for _, args := range [][]string{
+		{"DEL", "noop:missing"},
+		{"HDEL", "noop:missing", "f"},
+		{"SREM", "noop:missing", "m"},
+		{"EXPIRE", "noop:missing", "10"},
+		{"LPOP", "noop:missing"},
+		{"ZADD", "noop:z", "x", "m"},
+	} {
+		runCommand(t, d, 2, args...)
+	}
+	if data, err := readAof(dir); err != nil || len(data) != 0 {
+		t.Fatalf("expected an empty AOF, got %q, %v", data, err)
+	}
+
+	runCommand(t, d, 2, "RPUSH", "noop:l", "a", "b", "c")
+	runCommand(t, d, 2, "ZADD", "noop:z", "1", "m")
+	runCommand(t, d, 2, "ZADD", "noop:z", "1", "m")
+	runCommand(t, d, 2, "LTRIM", "noop:l", "0", "-1")
+	d.Aof.Close()
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "*"); n != 2 {
+		t.Fatalf("expected the 2 writes that changed something, got %q", data)
+	}
+	if got := runCommand(t, d, 2, "INFO", "persistence"); !strings.Contains(got, "rdb_changes_since_last_save:4\r\n") {
+		t.Fatalf("expected 4 changes, got %q", got)
+	}
+}
+
+func TestBgRewriteAof(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	run := func(args ...string) {
+		req := make([]Value, 0, len(args))
+		for _, arg := range args {
+			req = append(req, BulkString(arg))
+		}
+		if err := d.exec(client, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		run("SET", "rewrite:s", strconv.Itoa(i))
+	}
+	run("HSET", "rewrite:h", "f", "v")
+	run("RPUSH", "rewrite:l", "a", "b", "c")
+	run("SADD", "rewrite:set", "x", "y")
+	run("ZADD", "rewrite:z", "1.5", "m", "-inf", "n")
+	run("PEXPIRE", "rewrite:s", "100000")
+
+	rw, err := d.bgRewriteAof()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes during the rewrite end up in the new file exactly once
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			run("LPUSH", "rewrite:live", strconv.Itoa(i))
+		}
+	}()
+	<-rw.done
+	<-done
+	if rw.err != nil {
+		t.Fatal(rw.err)
+	}
+	d.Aof.Close()
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 100 SETs were compacted into one SET and its PEXPIREAT
+	if n := strings.Count(string(data), "$9\r\nrewrite:s\r\n"); n != 2 {
+		t.Fatalf("expected rewrite:s twice in the rewritten AOF, got %d times", n)
+	}
+
+	keys := []string{"rewrite:s", "rewrite:h", "rewrite:l", "rewrite:set", "rewrite:z", "rewrite:live"}
+	removeKeys := func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}
+	removeKeys()
+	// don't leave a volatile key behind for the eviction tests
+	defer removeKeys()
+
+	d = mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+	buf := &bytes.Buffer{}
+	client = d.newClient(NewWriter(buf))
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "rewrite:s"}, "$2\r\n99\r\n"},
+		{[]string{"HGET", "rewrite:h", "f"}, "$1\r\nv\r\n"},
+		{[]string{"LRANGE", "rewrite:l", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"SCARD", "rewrite:set"}, ":2\r\n"},
+		{[]string{"ZSCORE", "rewrite:z", "n"}, "$4\r\n-inf\r\n"},
+		{[]string{"LLEN", "rewrite:live"}, ":500\r\n"},
+	} {
+		buf.Reset()
+		run(c.args...)
+		if buf.String() != c.want {
+			t.Fatalf("%v: expected %q, got %q", c.args, c.want, buf.String())
+		}
+	}
+	buf.Reset()
+	run("TTL", "rewrite:s")
+	if buf.String() == ":-1\r\n" {
+		t.Fatal("expected the expiry to survive the rewrite")
+	}
+}
+
+func TestBgRewriteAofRdbPreamble(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{EnableAof: true, AofDir: dir, AofUseRdbPreamble: true}
+	d := mustDispatcher(t, config)
+
+	keys := []string{"preamble:s", "preamble:h", "preamble:live"}
+	removeKeys := func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}
+	defer removeKeys()
+
+	runCommand(t, d, 2, "SET", "preamble:s", "v")
+	runCommand(t, d, 2, "HSET", "preamble:h", "f", "v")
+	rw, err := d.bgRewriteAof()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes during the rewrite end up in the new incremental file
+	// exactly once
+	for i := 0; i < 500; i++ {
+		runCommand(t, d, 2, "LPUSH", "preamble:live", strconv.Itoa(i))
+	}
+	<-rw.done
+	if rw.err != nil {
+		t.Fatal(rw.err)
+	}
+	d.Aof.Close()
+
+	m, err := loadAofManifest(dir, "appendonly.aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "appendonly.aof.2.base.rdb"; m.base.name != want {
+		t.Fatalf("expected the base file %s, got %s", want, m.base.name)
+	}
+	if !fileIsRdb(filepath.Join(dir, m.base.name)) {
+		t.Fatal("expected the base file to be an RDB snapshot")
+	}
+	if err := CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	removeKeys()
+	d = mustDispatcher(t, config)
+	defer d.Aof.Close()
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "preamble:s"}, "$1\r\nv\r\n"},
+		{[]string{"HGET", "preamble:h", "f"}, "$1\r\nv\r\n"},
+		{[]string{"LLEN", "preamble:live"}, ":500\r\n"},
+	} {
+		if got := runCommand(t, d, 2, c.args...); got != c.want {
+			t.Fatalf("%v: expected %q, got %q", c.args, c.want, got)
+		}
+	}
+}
+
+func TestAofLegacyRdbPreamble(t *testing.T) {
+	// a single file AOF written by Redis 4 to 6 with aof-use-rdb-preamble
+	root := t.TempDir()
+	enc := &rdbEncoder{}
+	enc.buf = append(enc.buf, "REDIS0009"...)
+	enc.writeByte(rdbOpcodeSelectDB)
+	enc.writeLength(0)
+	enc.writeByte(rdbTypeString)
+	enc.writeString("legacypreamble:k")
+	enc.writeString("rdb")
+	enc.writeByte(rdbOpcodeEOF)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, crc64Update(0, enc.buf))
+	enc.buf = append(enc.buf, "*3\r\n$3\r\nSET\r\n$17\r\nlegacypreamble:k2\r\n$3\r\naof\r\n"...)
+	if err := os.WriteFile(filepath.Join(root, "appendonly.aof"), enc.buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		unlock := db.lockKeys("legacypreamble:k", "legacypreamble:k2")
+		db.shard("legacypreamble:k").remove("legacypreamble:k")
+		db.shard("legacypreamble:k2").remove("legacypreamble:k2")
+		unlock()
+	}()
+
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: filepath.Join(root, "appendonlydir")})
+	defer d.Aof.Close()
+	if got := runCommand(t, d, 2, "GET", "legacypreamble:k"); got != "$3\r\nrdb\r\n" {
+		t.Fatalf("expected the key of the preamble, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "GET", "legacypreamble:k2"); got != "$3\r\naof\r\n" {
+		t.Fatalf("expected the command after the preamble, got %q", got)
+	}
+	if want := "appendonly.aof.1.base.rdb"; d.Aof.manifest.base.name != want {
+		t.Fatalf("expected the base file %s, got %s", want, d.Aof.manifest.base.name)
+	}
+}
+
+func TestAofMigratesLegacyPaths(t *testing.T) {
+	defer func() {
+		unlock := db.lockKeys("legacypath:a", "legacypath:b")
+		db.shard("legacypath:a").remove("legacypath:a")
+		db.shard("legacypath:b").remove("legacypath:b")
+		unlock()
+	}()
+
+	// AofFile as the path it used to be
+	root := t.TempDir()
+	old := filepath.Join(root, "data", "my.aof")
+	if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(old, []byte("*3\r\n$3\r\nSET\r\n$12\r\nlegacypath:a\r\n$1\r\n1\r\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	d := mustDispatcher(t, &Config{EnableAof: true, AofFile: old})
+	if got := runCommand(t, d, 2, "GET", "legacypath:a"); got != "$1\r\n1\r\n" {
+		t.Fatalf("expected the key of the old AOF, got %q", got)
+	}
+	d.Aof.Close()
+	if _, err := os.Stat(filepath.Join(root, "data", "appendonlydir", "my.aof.1.base.aof")); err != nil {
+		t.Fatal(err)
+	}
+
+	// pkg.aof, the old default
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.WriteFile("pkg.aof", []byte("*3\r\n$3\r\nSET\r\n$12\r\nlegacypath:b\r\n$1\r\n2\r\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	d = mustDispatcher(t, &Config{EnableAof: true})
+	defer d.Aof.Close()
+	if got := runCommand(t, d, 2, "GET", "legacypath:b"); got != "$1\r\n2\r\n" {
+		t.Fatalf("expected the key of pkg.aof, got %q", got)
+	}
+	if _, err := os.Stat("pkg.aof"); !os.IsNotExist(err) {
+		t.Fatalf("expected pkg.aof to be moved, got %v", err)
+	}
+}
+
+func TestBgRewriteAofInProgress(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	d.gate.Lock()
+	d.rewrite = &aofRewrite{}
+	d.gate.Unlock()
+
+	buf := &bytes.Buffer{}
+	d.exec(d.newClient(NewWriter(buf)), []Value{BulkString("BGREWRITEAOF")})
+	if want := "-" + errRewriteInProgress.Error() + "\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestAutoAofRewrite(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir, AutoAofRewritePercentage: 100, AutoAofRewriteMinSize: 4096})
+	defer d.Aof.Close()
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	for i := 0; i < 200; i++ {
+		d.exec(client, []Value{BulkString("SET"), BulkString("auto:k"), BulkString(strconv.Itoa(i))})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.Aof.mu.Lock()
+		base := d.Aof.baseSize
+		d.Aof.mu.Unlock()
+		if base > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the AOF to be rewritten once it reached the minimum size")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readAof returns the parts of the AOF in dir, concatenated in order.
+func readAof(dir string) ([]byte, error) {
+	m, err := loadAofManifest(dir, "appendonly.aof")
+	if err != nil || m == nil {
+		return nil, err
+	}
+	var data []byte
+	for _, part := range m.parts() {
+		b, err := os.ReadFile(filepath.Join(dir, part.name))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+func TestScanAofTruncated(t *testing.T) {
+	first, _ := ArrayValue(BulkString("SET"), BulkString("k"), BulkString("v")).MarshalResp()
+	second, _ := ArrayValue(BulkString("DEL"), BulkString("k")).MarshalResp()
+	data := append(append([]byte{}, first...), second...)
+
+	for n := 0; n <= len(data); n++ {
+		valid, err := scanAof(bytes.NewReader(data[:n]), nil, nil, nil)
+		switch n {
+		case 0, len(first), len(data):
+			if err != nil || valid != int64(n) {
+				t.Fatalf("%d bytes: expected a valid AOF, got %d %v", n, valid, err)
+			}
+		default:
+			want := int64(0)
+			if n > len(first) {
+				want = int64(len(first))
+			}
+			if err != errAofTruncated || valid != want {
+				t.Fatalf("%d bytes: expected truncated at %d, got %d %v", n, want, valid, err)
+			}
+		}
+	}
+}
+
+func TestScanAofFormatError(t *testing.T) {
+	data := "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n*2\r\n$x\r\n"
+	valid, err := scanAof(strings.NewReader(data), nil, nil, nil)
+	var ferr *AofFormatError
+	if !errors.As(err, &ferr) || ferr.Offset != 20 || valid != 20 {
+		t.Fatalf("expected a format error at offset 20, got %d %v", valid, err)
+	}
+
+	_, err = scanAof(strings.NewReader("garbage\r\n"), nil, nil, nil)
+	if !errors.As(err, &ferr) || ferr.Offset != 0 {
+		t.Fatalf("expected a format error at offset 0, got %v", err)
+	}
+}
+
+// writeTruncatedAof makes an AOF in dir whose last command is cut short.
+func writeTruncatedAof(t *testing.T, dir, tail string) string {
+	aof, err := NewAof(dir, "", "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.Append(ArrayValue(BulkString("SET"), BulkString("truncated:k"), BulkString("v")))
+	aof.Write([]byte(tail))
+	aof.Close()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	return filepath.Join(dir, aof.manifest.incrs[0].name)
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	dir := t.TempDir()
+	incr := writeTruncatedAof(t, dir, "*3\r\n$3\r\nSET\r\n$11\r\ntrunc")
+	defer DelHandler(NewWriter(io.Discard), []Value{BulkString("truncated:k")})
+
+	if _, err := newDispatcher(&Config{EnableAof: true, AofDir: dir}); err == nil || !strings.Contains(err.Error(), "check-aof --fix") {
+		t.Fatalf("expected a truncated AOF to be refused without aof-load-truncated, got %v", err)
+	}
+
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir, AofLoadTruncated: true})
+	buf := &bytes.Buffer{}
+	client := d.newClient(NewWriter(buf))
+	d.exec(client, []Value{BulkString("GET"), BulkString("truncated:k")})
+	if want := "$1\r\nv\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	// appends continue after the last whole command
+	d.exec(client, []Value{BulkString("DEL"), BulkString("truncated:k")})
+	d.Aof.Close()
+	data, err := os.ReadFile(incr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanAof(bytes.NewReader(data), nil, nil, nil); err != nil {
+		t.Fatalf("expected a valid AOF after loading, got %v in %q", err, data)
+	}
+}
+
+func TestAofLoadCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	writeTruncatedAof(t, dir, "$3\r\nbad\r\n*1\r\n$4\r\nPING\r\n")
+	defer DelHandler(NewWriter(io.Discard), []Value{BulkString("truncated:k")})
+
+	_, err := newDispatcher(&Config{EnableAof: true, AofDir: dir, AofLoadTruncated: true})
+	var ferr *AofFormatError
+	if !errors.As(err, &ferr) {
+		t.Fatalf("expected a format error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "check-aof --fix "+ferr.File) {
+		t.Fatalf("expected the error to point at check-aof, got %v", err)
+	}
+}
+
+func TestAofTimestampAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "", "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.timestamps = true
+
+	ping := ArrayValue(BulkString("PING"))
+	aof.Append(ping)
+	aof.Append(ping)
+	aof.mu.Lock()
+	ts := aof.lastTS
+	aof.lastTS-- // the next append is in a new second
+	aof.mu.Unlock()
+	aof.Append(ping)
+	aof.Close()
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := "*1\r\n$4\r\nPING\r\n"
+	annotation := "#TS:" + strconv.FormatInt(ts, 10) + "\r\n"
+	if want := annotation + cmd + cmd + annotation + cmd; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+
+	var n int
+	var stamps []int64
+	if _, err := scanAof(bytes.NewReader(data), nil, func(Value) bool { n++; return true }, func(ts int64) bool {
+		stamps = append(stamps, ts)
+		return true
+	}); err != nil || n != 3 || len(stamps) != 2 {
+		t.Fatalf("expected 3 commands and 2 annotations, got %d %v %v", n, stamps, err)
+	}
+}
+
+func TestAofTruncateToTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	set := func(v string) string {
+		b, _ := ArrayValue(BulkString("SET"), BulkString("pitr:k"), BulkString(v)).MarshalResp()
+		return string(b)
+	}
+	files := map[string]string{
+		"appendonly.aof.1.base.aof": set("base"),
+		"appendonly.aof.1.incr.aof": "#TS:100\r\n" + set("a") + "#TS:200\r\n" + set("b"),
+		"appendonly.aof.2.incr.aof": "#TS:300\r\n" + set("c"),
+		"appendonly.aof.manifest": "file appendonly.aof.1.base.aof seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer DelHandler(NewWriter(io.Discard), []Value{BulkString("pitr:k")})
+
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir, AofTruncateToTimestamp: 150})
+	defer d.Aof.Close()
+
+	buf := &bytes.Buffer{}
+	d.exec(d.newClient(NewWriter(buf)), []Value{BulkString("GET"), BulkString("pitr:k")})
+	if want := "$1\r\na\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "appendonly.aof.2.incr.aof")); !os.IsNotExist(err) {
+		t.Fatal("expected the part after the timestamp to be deleted")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "appendonly.aof.1.incr.aof"))
+	if want := "#TS:100\r\n" + set("a"); string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+}
+
+func TestAofTruncateBeforeRewrite(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"appendonly.aof.1.base.aof": "#TS:100\r\n*1\r\n$4\r\nPING\r\n",
+		"appendonly.aof.manifest":   "file appendonly.aof.1.base.aof seq 1 type b\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := TruncateAofToTimestamp(filepath.Join(dir, "appendonly.aof.manifest"), 50, out); err == nil {
+		t.Fatalf("expected truncating to before the base file to fail, got %q", out)
+	}
+	out.Reset()
+	if err := TruncateAofToTimestamp(filepath.Join(dir, "appendonly.aof.manifest"), 150, out); err != nil || !strings.Contains(out.String(), "no commands later") {
+		t.Fatalf("expected nothing to truncate, got %v %q", err, out)
+	}
+}
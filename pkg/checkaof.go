@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckAof checks the AOF at path, a manifest or a single part, and
+// writes a report to out like redis-check-aof. With fix, a last part that
+// is truncated or corrupted is cut back to its last valid command. The
+// error is non-nil when the AOF is still not valid.
+func CheckAof(path string, fix bool, out io.Writer) error {
+	if !strings.HasSuffix(path, ".manifest") {
+		return checkAofPart(path, true, fix, out)
+	}
+
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	m, err := loadAofManifest(dir, strings.TrimSuffix(file, ".manifest"))
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("no manifest at %s", path)
+	}
+
+	parts := m.parts()
+	for i, part := range parts {
+		if err := checkAofPart(filepath.Join(dir, part.name), i == len(parts)-1, fix, out); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(out, "All AOF files and manifest are valid")
+	return nil
+}
+
+// checkAofPart checks one part. Only the last part can be fixed, cutting
+// any other one would drop the commands of the parts after it.
+func checkAofPart(path string, last, fix bool, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	valid, scanErr := scanAof(f, nil, nil, nil)
+	f.Close()
+
+	size := info.Size()
+	fmt.Fprintf(out, "AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", path, size, valid, size-valid)
+	if scanErr == nil {
+		fmt.Fprintf(out, "AOF %s is valid\n", path)
+		return nil
+	}
+
+	var ferr *AofFormatError
+	if errors.As(scanErr, &ferr) {
+		ferr.File = path
+		fmt.Fprintf(out, "AOF %s format error at offset %d: %v\n", path, ferr.Offset, ferr.Err)
+	} else {
+		fmt.Fprintf(out, "AOF %s is truncated at offset %d\n", path, valid)
+	}
+
+	switch {
+	case !fix:
+		fmt.Fprintf(out, "AOF %s is not valid. Use the --fix option to try fixing it.\n", path)
+		return scanErr
+	case !last:
+		fmt.Fprintf(out, "AOF %s is not the last file and can't be fixed automatically.\n", path)
+		return scanErr
+	}
+
+	fmt.Fprintf(out, "This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n", path, size, size-valid, valid)
+	if err := os.Truncate(path, valid); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Successfully truncated AOF %s\n", path)
+	return nil
+}
+
+// TruncateAofToTimestamp cuts the AOF whose manifest is at path at the
+// first #TS annotation later than ts, dropping every command after it,
+// and writes a report to out.
+func TruncateAofToTimestamp(path string, ts int64, out io.Writer) error {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if !strings.HasSuffix(file, ".manifest") {
+		return fmt.Errorf("%s is not an AOF manifest", path)
+	}
+
+	part, size, err := truncateAofToTimestamp(dir, strings.TrimSuffix(file, ".manifest"), ts)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to truncate AOF to timestamp %d: %v\n", ts, err)
+		return err
+	}
+	if part == "" {
+		fmt.Fprintf(out, "AOF has no commands later than timestamp %d\n", ts)
+		return nil
+	}
+	fmt.Fprintf(out, "Successfully truncated AOF %s to %d bytes, timestamp %d\n", part, size, ts)
+	return nil
+}
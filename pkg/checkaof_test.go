@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckAof(t *testing.T) {
+	dir := t.TempDir()
+	incr := writeTruncatedAof(t, dir, "*2\r\n$3\r\nDEL")
+	defer DelHandler(NewWriter(io.Discard), []Value{BulkString("truncated:k")})
+	manifest := filepath.Join(dir, manifestFileName("appendonly.aof"))
+
+	out := &bytes.Buffer{}
+	if err := CheckAof(manifest, false, out); err == nil {
+		t.Fatalf("expected a truncated AOF to be reported, got %q", out)
+	}
+	info, _ := os.Stat(incr)
+	want := "ok_up_to=" + strconv.FormatInt(info.Size()-int64(len("*2\r\n$3\r\nDEL")), 10)
+	if !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %q in %q", want, out)
+	}
+
+	out.Reset()
+	if err := CheckAof(manifest, true, out); err != nil {
+		t.Fatalf("expected --fix to repair the AOF, got %v: %q", err, out)
+	}
+	out.Reset()
+	if err := CheckAof(incr, false, out); err != nil || !strings.Contains(out.String(), "is valid") {
+		t.Fatalf("expected the fixed AOF to be valid, got %v: %q", err, out)
+	}
+}
+
+func TestCheckAofOnlyFixesLastPart(t *testing.T) {
+	dir := t.TempDir()
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	files := map[string]string{
+		"appendonly.aof.1.base.aof": set + "*3\r\n$3\r\nSE",
+		"appendonly.aof.1.incr.aof": set,
+		"appendonly.aof.manifest": "file appendonly.aof.1.base.aof seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := CheckAof(filepath.Join(dir, "appendonly.aof.manifest"), true, out); err == nil {
+		t.Fatalf("expected the base file not to be fixed, got %q", out)
+	}
+	if !strings.Contains(out.String(), "can't be fixed automatically") {
+		t.Fatalf("unexpected report %q", out)
+	}
+}
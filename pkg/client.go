@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// redisVersion is the Redis version whose behaviour we follow, as reported
+// to clients by HELLO.
+const redisVersion = "7.0.0"
+
+var nextClientID atomic.Int64
+
+// Client is the state of one connection. It wraps the connection's
+// IWriter and is what handlers receive, so connection commands such as
+// HELLO can reach it with a type assertion.
+type Client struct {
+	IWriter
+	id          int64
+	name        string
+	authed      bool
+	requirepass string
+	// srv is the dispatcher running the client's commands, nil for
+	// clients made outside of a server
+	srv *dispatcher
+	// propagated are the commands the running write logs in its place,
+	// see Propagate
+	propagated []Value
+	// dirty counts the changes the running write made to the dataset,
+	// see MarkDirty
+	dirty int
+}
+
+func NewClient(w IWriter, requirepass string) *Client {
+	return &Client{
+		IWriter:     w,
+		id:          nextClientID.Add(1),
+		requirepass: requirepass,
+	}
+}
+
+// Propagate makes the running write command log argv to the AOF instead
+// of itself, for handlers whose effect depends on chance or the clock and
+// would replay differently. Each call adds a command, logged in order.
+func (c *Client) Propagate(argv ...Value) {
+	c.propagated = append(c.propagated, ArrayValue(argv...))
+}
+
+// MarkDirty records that the running write command made n changes to the
+// dataset, such as keys set or elements removed. Only writes that made
+// changes are logged to the AOF, and the changes count towards the save
+// points.
+func (c *Client) MarkDirty(n int) {
+	c.dirty += n
+}
+
+// markDirty is MarkDirty for the built-in handlers.
+func markDirty(w IWriter, n int) {
+	if c, ok := w.(*Client); ok {
+		c.MarkDirty(n)
+	}
+}
+
+// propagate is Propagate for the built-in handlers, which also run
+// without a client while the AOF is loaded.
+func propagate(w IWriter, argv ...string) {
+	c, ok := w.(*Client)
+	if !ok {
+		return
+	}
+	values := make([]Value, len(argv))
+	for i, arg := range argv {
+		values[i] = BulkString(arg)
+	}
+	c.Propagate(values...)
+}
+
+// authenticated reports whether the client may run commands other than
+// AUTH and HELLO.
+func (c *Client) authenticated() bool {
+	return c.requirepass == "" || c.authed
+}
+
+// authenticate checks a default user password against requirepass.
+func (c *Client) authenticate(user, pass string) bool {
+	if user != "default" || c.requirepass == "" || pass != c.requirepass {
+		return false
+	}
+	c.authed = true
+	return true
+}
+
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// HelloHandler implements HELLO [protover [AUTH username password]
+// [SETNAME clientname]].
+func HelloHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok {
+		w.WriteError("ERR HELLO is not supported on this connection")
+		return ResultError
+	}
+
+	proto := c.Proto()
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0].String())
+		if err != nil {
+			w.WriteError("ERR Protocol version is not an integer or out of range")
+			return ResultError
+		}
+		if v != 2 && v != 3 {
+			w.WriteError("NOPROTO unsupported protocol version")
+			return ResultError
+		}
+		proto = v
+	}
+
+	var user, pass, name string
+	var setname bool
+	for i := 1; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i].String()); {
+		case opt == "AUTH" && left >= 2:
+			user, pass = args[i+1].String(), args[i+2].String()
+			i += 2
+		case opt == "SETNAME" && left >= 1:
+			name, setname = args[i+1].String(), true
+			i++
+		default:
+			w.WriteError("ERR Syntax error in HELLO option '" + args[i].String() + "'")
+			return ResultError
+		}
+	}
+
+	if user != "" && !c.authenticate(user, pass) {
+		w.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return ResultError
+	}
+	if !c.authenticated() {
+		w.WriteError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return ResultError
+	}
+	if setname {
+		if !validClientName(name) {
+			w.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return ResultError
+		}
+		c.name = name
+	}
+
+	c.SetProto(proto)
+	c.WriteMap(Value{typ: MAP, array: []Value{
+		BulkString("server"), BulkString("redis"),
+		BulkString("version"), BulkString(redisVersion),
+		BulkString("proto"), {typ: INTEGER, integer: proto},
+		BulkString("id"), {typ: INTEGER, integer: int(c.id)},
+		BulkString("mode"), BulkString("standalone"),
+		BulkString("role"), BulkString("master"),
+		BulkString("modules"), ArrayValue(),
+	}})
+	return ResultOK
+}
+
+// AuthHandler implements AUTH [username] password.
+func AuthHandler(w IWriter, args []Value) Result {
+	if len(args) < 1 || len(args) > 2 {
+		w.WriteError("ERR wrong number of arguments for 'auth' command")
+		return ResultError
+	}
+
+	c, ok := w.(*Client)
+	if !ok || c.requirepass == "" {
+		w.WriteError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return ResultError
+	}
+
+	user, pass := "default", args[0].String()
+	if len(args) == 2 {
+		user, pass = args[0].String(), args[1].String()
+	}
+
+	if !c.authenticate(user, pass) {
+		w.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return ResultError
+	}
+
+	w.WriteSimpleString("OK")
+	return ResultOK
+}
+
+// ClientHandler implements CLIENT ID, CLIENT GETNAME and CLIENT SETNAME.
+func ClientHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok {
+		w.WriteError("ERR CLIENT is not supported on this connection")
+		return ResultError
+	}
+
+	switch sub := strings.ToUpper(args[0].String()); {
+	case sub == "ID" && len(args) == 1:
+		w.WriteInteger(int(c.id))
+	case sub == "GETNAME" && len(args) == 1:
+		if c.name == "" {
+			w.WriteNull()
+		} else {
+			w.WriteBulkString(c.name)
+		}
+	case sub == "SETNAME" && len(args) == 2:
+		name := args[1].String()
+		if !validClientName(name) {
+			w.WriteError("ERR Client names cannot contain spaces, newlines or special characters.")
+			return ResultError
+		}
+		c.name = name
+		w.WriteSimpleString("OK")
+	default:
+		w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + args[0].String() + "'. Try CLIENT HELP.")
+		return ResultError
+	}
+	return ResultOK
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHelloNegotiatesResp3(t *testing.T) {
+	w := NewWriter(io.Discard)
+	HSetHandler(w, []Value{BulkString("hello:hash"), BulkString("f"), BulkString("v")})
+	ZAddHandler(w, []Value{BulkString("hello:zset"), BulkString("1.5"), BulkString("m")})
+
+	buf := &bytes.Buffer{}
+	c := NewClient(NewWriter(buf), "")
+
+	HGetAllHandler(c, []Value{BulkString("hello:hash")})
+	ZScoreHandler(c, []Value{BulkString("hello:zset"), BulkString("m")})
+	if want := "*2\r\n$1\r\nf\r\n$1\r\nv\r\n$3\r\n1.5\r\n"; buf.String() != want {
+		t.Fatalf("expected RESP2 replies %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	HelloHandler(c, []Value{BulkString("3")})
+	if !strings.HasPrefix(buf.String(), "%7\r\n$6\r\nserver\r\n") {
+		t.Fatalf("unexpected HELLO reply %q", buf.String())
+	}
+
+	buf.Reset()
+	HGetAllHandler(c, []Value{BulkString("hello:hash")})
+	ZScoreHandler(c, []Value{BulkString("hello:zset"), BulkString("m")})
+	GetHandler(c, []Value{BulkString("hello:missing")})
+	if want := "%1\r\n$1\r\nf\r\n$1\r\nv\r\n,1.5\r\n_\r\n"; buf.String() != want {
+		t.Fatalf("expected RESP3 replies %q, got %q", want, buf.String())
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := NewClient(NewWriter(buf), "secret")
+
+	HelloHandler(c, []Value{BulkString("3")})
+	if !strings.HasPrefix(buf.String(), "-NOAUTH") {
+		t.Fatalf("expected NOAUTH, got %q", buf.String())
+	}
+
+	buf.Reset()
+	HelloHandler(c, []Value{BulkString("3"), BulkString("AUTH"), BulkString("default"), BulkString("secret"), BulkString("SETNAME"), BulkString("app")})
+	if !c.authenticated() || c.name != "app" || c.Proto() != 3 {
+		t.Fatalf("expected an authenticated RESP3 client named app, got %q", buf.String())
+	}
+}
+
+func TestZRangeWithScoresResp3(t *testing.T) {
+	w := NewWriter(io.Discard)
+	ZAddHandler(w, []Value{BulkString("hello:zrange"), BulkString("1"), BulkString("a"), BulkString("2"), BulkString("b")})
+
+	args := []Value{BulkString("hello:zrange"), BulkString("0"), BulkString("-1"), BulkString("WITHSCORES")}
+	buf := &bytes.Buffer{}
+	c := NewClient(NewWriter(buf), "")
+	ZRangeHandler(c, args)
+	if want := "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	c.SetProto(3)
+	ZRangeHandler(c, args)
+	if want := "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
@@ -0,0 +1,273 @@
+package pkg
+
+import (
+	"path"
+	"strings"
+)
+
+// aclCategories lists the ACL categories in the order Redis reports them.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast",
+	"slow", "blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// categories returns the ACL categories of the command, without the '@'.
+// They follow from its flags and from the group of commands it belongs to.
+func (h *CommandHandler) categories() []string {
+	has := make(map[string]bool)
+	switch h.group {
+	case "generic":
+		has["keyspace"] = true
+	case "sorted-set":
+		has["sortedset"] = true
+	case "string", "hash", "list", "set", "connection":
+		has[h.group] = true
+	}
+	has["write"] = h.flags&cmdWrite != 0
+	has["read"] = h.flags&cmdReadonly != 0
+	has["pubsub"] = h.flags&cmdPubsub != 0
+	has["admin"] = h.flags&cmdAdmin != 0
+	has["dangerous"] = h.flags&cmdAdmin != 0
+	has["blocking"] = h.flags&cmdBlocking != 0
+	has["fast"] = h.flags&cmdFast != 0
+	has["slow"] = h.flags&cmdFast == 0
+
+	var cats []string
+	for _, cat := range aclCategories {
+		if has[cat] {
+			cats = append(cats, cat)
+		}
+	}
+	return cats
+}
+
+// commandInfo is the COMMAND INFO reply for one command.
+func commandInfo(name string, h *CommandHandler) Value {
+	flags := []Value{}
+	for _, f := range cmdFlagNames {
+		if h.flags&f.flag != 0 {
+			flags = append(flags, SimpleString(f.name))
+		}
+	}
+	if h.getkeys != nil {
+		flags = append(flags, SimpleString("movablekeys"))
+	}
+
+	cats := []Value{}
+	for _, cat := range h.categories() {
+		cats = append(cats, SimpleString("@"+cat))
+	}
+
+	return ArrayValue(
+		BulkString(strings.ToLower(name)),
+		IntegerValue(h.arity),
+		ArrayValue(flags...),
+		IntegerValue(h.keys.first),
+		IntegerValue(h.keys.last),
+		IntegerValue(h.keys.step),
+		ArrayValue(cats...),
+		ArrayValue(), // tips
+		keySpecs(h),
+		ArrayValue(), // subcommands
+	)
+}
+
+// keySpecs describes the key positions of h the way Redis 7 key specs do.
+func keySpecs(h *CommandHandler) Value {
+	if h.keys.first == 0 {
+		return ArrayValue()
+	}
+
+	access := "RO"
+	if h.flags&cmdWrite != 0 {
+		access = "RW"
+	}
+	// lastkey is relative to the first key unless it counts from the end
+	lastkey := h.keys.last
+	if lastkey >= 0 {
+		lastkey -= h.keys.first
+	}
+
+	return ArrayValue(MapValue(
+		BulkString("flags"), ArrayValue(SimpleString(access)),
+		BulkString("begin_search"), MapValue(
+			BulkString("type"), BulkString("index"),
+			BulkString("spec"), MapValue(BulkString("index"), IntegerValue(h.keys.first)),
+		),
+		BulkString("find_keys"), MapValue(
+			BulkString("type"), BulkString("range"),
+			BulkString("spec"), MapValue(
+				BulkString("lastkey"), IntegerValue(lastkey),
+				BulkString("keystep"), IntegerValue(h.keys.step),
+				BulkString("limit"), IntegerValue(0),
+			),
+		),
+	))
+}
+
+// commandDocs is the COMMAND DOCS reply for one command.
+func commandDocs(h *CommandHandler) Value {
+	return MapValue(
+		BulkString("summary"), BulkString(h.summary),
+		BulkString("since"), BulkString(h.since),
+		BulkString("group"), BulkString(h.group),
+	)
+}
+
+var commandHelp = []string{
+	"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"(no subcommand)",
+	"    Return details about all Redis commands.",
+	"COUNT",
+	"    Return the total number of commands in this Redis server.",
+	"INFO [<command-name> ...]",
+	"    Return details about multiple Redis commands.",
+	"    If no command names are given, documentation details for all",
+	"    commands are returned.",
+	"DOCS [<command-name> ...]",
+	"    Return documentation details about multiple Redis commands.",
+	"    If no command names are given, documentation details for all",
+	"    commands are returned.",
+	"GETKEYS <full-command>",
+	"    Return the keys from a full Redis command.",
+	"LIST [FILTERBY (MODULE <module-name>|ACLCAT <category>|PATTERN <pattern>)]",
+	"    Return a list of all commands in this Redis server.",
+	"HELP",
+	"    Print this help.",
+}
+
+// commandHandler implements COMMAND, COMMAND COUNT, COMMAND INFO,
+// COMMAND DOCS, COMMAND LIST and COMMAND GETKEYS.
+func commandHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR COMMAND is not supported on this connection")
+		return ResultError
+	}
+	d := c.srv
+
+	if len(args) == 0 {
+		names := d.commandNames()
+		infos := make([]Value, 0, len(names))
+		for _, name := range names {
+			h, _ := d.lookupCommand(name)
+			infos = append(infos, commandInfo(name, &h))
+		}
+		w.WriteArray(ArrayValue(infos...))
+		return ResultOK
+	}
+
+	switch sub := strings.ToUpper(args[0].String()); {
+	case sub == "HELP" && len(args) == 1:
+		return writeHelp(w, commandHelp)
+	case sub == "COUNT" && len(args) == 1:
+		w.WriteInteger(len(d.commandNames()))
+	case sub == "INFO":
+		names := args[1:]
+		if len(names) == 0 {
+			for _, name := range d.commandNames() {
+				names = append(names, BulkString(name))
+			}
+		}
+		infos := make([]Value, 0, len(names))
+		for _, name := range names {
+			h, ok := d.lookupCommand(name.String())
+			if !ok {
+				infos = append(infos, NullBulk())
+				continue
+			}
+			infos = append(infos, commandInfo(name.String(), &h))
+		}
+		w.WriteArray(ArrayValue(infos...))
+	case sub == "DOCS":
+		names := args[1:]
+		if len(names) == 0 {
+			for _, name := range d.commandNames() {
+				names = append(names, BulkString(name))
+			}
+		}
+		docs := make([]Value, 0, len(names)*2)
+		for _, name := range names {
+			h, ok := d.lookupCommand(name.String())
+			if !ok {
+				continue
+			}
+			docs = append(docs, BulkString(strings.ToLower(name.String())), commandDocs(&h))
+		}
+		w.WriteMap(MapValue(docs...))
+	case sub == "LIST":
+		return commandList(w, d, args[1:])
+	case sub == "GETKEYS" && len(args) >= 2:
+		argv := args[1:]
+		h, ok := d.lookupCommand(argv[0].String())
+		if !ok {
+			w.WriteError("ERR Invalid command specified")
+			return ResultError
+		}
+		if !h.arityOK(len(argv)) {
+			w.WriteError("ERR Invalid number of arguments specified for command")
+			return ResultError
+		}
+		pos := h.keyPositions(argv)
+		if len(pos) == 0 {
+			w.WriteError("ERR The command has no key arguments")
+			return ResultError
+		}
+		keys := make([]Value, 0, len(pos))
+		for _, i := range pos {
+			keys = append(keys, argv[i])
+		}
+		w.WriteArray(ArrayValue(keys...))
+	default:
+		w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + args[0].String() + "'. Try COMMAND HELP.")
+		return ResultError
+	}
+	return ResultOK
+}
+
+// commandList implements COMMAND LIST [FILTERBY (MODULE name | ACLCAT
+// category | PATTERN pattern)].
+func commandList(w IWriter, d *dispatcher, args []Value) Result {
+	match := func(string, *CommandHandler) bool { return true }
+	switch {
+	case len(args) == 0:
+	case len(args) == 3 && strings.ToUpper(args[0].String()) == "FILTERBY":
+		filter := args[2].String()
+		switch strings.ToUpper(args[1].String()) {
+		case "MODULE":
+			// there are no modules
+			match = func(string, *CommandHandler) bool { return false }
+		case "ACLCAT":
+			match = func(_ string, h *CommandHandler) bool {
+				for _, cat := range h.categories() {
+					if strings.EqualFold(cat, filter) {
+						return true
+					}
+				}
+				return false
+			}
+		case "PATTERN":
+			match = func(name string, _ *CommandHandler) bool {
+				ok, _ := path.Match(strings.ToLower(filter), strings.ToLower(name))
+				return ok
+			}
+		default:
+			w.WriteError("ERR syntax error")
+			return ResultError
+		}
+	default:
+		w.WriteError("ERR syntax error")
+		return ResultError
+	}
+
+	names := []Value{}
+	for _, name := range d.commandNames() {
+		h, _ := d.lookupCommand(name)
+		if match(name, &h) {
+			names = append(names, BulkString(strings.ToLower(name)))
+		}
+	}
+	w.WriteArray(ArrayValue(names...))
+	return ResultOK
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// mustDispatcher is newDispatcher for tests, failing them on an error.
+func mustDispatcher(t testing.TB, config *Config) *dispatcher {
+	t.Helper()
+	d, err := newDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func runCommand(t *testing.T, d *dispatcher, proto int, args ...string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	c := d.newClient(NewWriter(buf))
+	c.SetProto(proto)
+	req := make([]Value, 0, len(args))
+	for _, arg := range args {
+		req = append(req, BulkString(arg))
+	}
+	if err := d.exec(c, req); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCommandInfo(t *testing.T) {
+	d := mustDispatcher(t, nil)
+
+	got := runCommand(t, d, 2, "COMMAND", "INFO", "get", "nosuchcommand")
+	want := "*2\r\n" +
+		"*10\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n" +
+		"*3\r\n+@read\r\n+@string\r\n+@fast\r\n*0\r\n"
+	if !strings.HasPrefix(got, want) {
+		t.Fatalf("expected prefix %q, got %q", want, got)
+	}
+	if !strings.HasSuffix(got, "*0\r\n$-1\r\n") {
+		t.Fatalf("expected a null reply for an unknown command, got %q", got)
+	}
+
+	got = runCommand(t, d, 3, "COMMAND", "INFO", "del")
+	if !strings.Contains(got, "$7\r\nlastkey\r\n:-1\r\n") || !strings.Contains(got, "+@write\r\n+@slow\r\n") {
+		t.Fatalf("unexpected DEL info %q", got)
+	}
+}
+
+func TestCommandCountAndList(t *testing.T) {
+	d := mustDispatcher(t, nil)
+
+	if got, want := runCommand(t, d, 2, "COMMAND", "COUNT"), ":"; !strings.HasPrefix(got, want) {
+		t.Fatalf("expected an integer, got %q", got)
+	}
+
+	got := runCommand(t, d, 2, "COMMAND", "LIST", "FILTERBY", "PATTERN", "h*")
+	if want := "*8\r\n$4\r\nhdel\r\n$5\r\nhello\r\n$4\r\nhget\r\n$7\r\nhgetall\r\n$5\r\nhkeys\r\n$4\r\nhlen\r\n$4\r\nhset\r\n$5\r\nhvals\r\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	got = runCommand(t, d, 2, "COMMAND", "LIST", "FILTERBY", "ACLCAT", "sortedset")
+	if want := "*4\r\n$4\r\nzadd\r\n$5\r\nzcard\r\n$6\r\nzrange\r\n$6\r\nzscore\r\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	d := mustDispatcher(t, nil)
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"COMMAND", "GETKEYS", "DEL", "a", "b"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{[]string{"COMMAND", "GETKEYS", "SORT", "l", "LIMIT", "0", "1", "STORE", "dst"}, "*2\r\n$1\r\nl\r\n$3\r\ndst\r\n"},
+		{[]string{"COMMAND", "GETKEYS", "PING"}, "-ERR The command has no key arguments\r\n"},
+		{[]string{"COMMAND", "GETKEYS", "GET"}, "-ERR Invalid number of arguments specified for command\r\n"},
+	}
+	for _, c := range cases {
+		if got := runCommand(t, d, 2, c.args...); got != c.want {
+			t.Fatalf("%v: expected %q, got %q", c.args, c.want, got)
+		}
+	}
+}
+
+func TestCommandDocs(t *testing.T) {
+	d := mustDispatcher(t, nil)
+
+	got := runCommand(t, d, 3, "COMMAND", "DOCS", "zcard")
+	want := "%1\r\n$5\r\nzcard\r\n%3\r\n$7\r\nsummary\r\n$46\r\nReturns the number of members in a sorted set.\r\n" +
+		"$5\r\nsince\r\n$5\r\n1.2.0\r\n$5\r\ngroup\r\n$10\r\nsorted-set\r\n"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -1,12 +1,68 @@
 package pkg
 
-import "sync"
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
 
 type entry struct {
 	typ entryType
 	// key   string
 	value interface{}
 	sync.RWMutex
+
+	// size is the approximate memory used by value, see sizeOf.
+	size atomic.Int64
+	// expireAt is the absolute expiry in unix milliseconds, 0 if the key
+	// is persistent.
+	expireAt atomic.Int64
+	// lru is the unix second of the last access.
+	lru atomic.Int64
+	// lfu packs the minute of the last decrement in the upper bits and
+	// the logarithmic access counter in the low 8 bits.
+	lfu atomic.Uint32
+
+	// version is the keyspace epoch when e was added, or when a snapshot
+	// preserved or dumped it, and frozen is its value as the running
+	// snapshot must see it; see snapshot.go. frozen is guarded by e's lock.
+	version atomic.Uint64
+	frozen  *frozenValue
+}
+
+func newEntry(typ entryType, value interface{}) *entry {
+	e := &entry{typ: typ, value: value}
+	e.size.Store(sizeOf(typ, value))
+	e.lru.Store(lruClock())
+	e.lfu.Store(lfuTimeInMinutes()<<8 | lfuInitVal)
+	return e
+}
+
+// touch records an access for the eviction policies.
+func (e *entry) touch() {
+	e.lru.Store(lruClock())
+	counter := lfuDecrAndReturn(e.lfu.Load())
+	counter = lfuLogIncr(counter)
+	e.lfu.Store(lfuTimeInMinutes()<<8 | uint32(counter))
+}
+
+// grow adjusts the accounted size of e by delta bytes after its value was
+// mutated in place.
+func (e *entry) grow(delta int64) {
+	e.size.Add(delta)
+	usedMemory.Add(delta)
+}
+
+// memory returns the accounted size of e stored at key, including the key
+// and the keyspace overhead.
+func (e *entry) memory(key string) int64 {
+	return keyOverhead(key) + e.size.Load()
+}
+
+func (e *entry) expired(now int64) bool {
+	at := e.expireAt.Load()
+	return at > 0 && at <= now
 }
 
 type entryType uint8
@@ -19,7 +75,213 @@ const (
 	_ZSet
 )
 
-var (
-	dbMu sync.RWMutex
-	db   = make(map[string]*entry)
-)
+// shardCount is the number of lock stripes the keyspace is split into.
+// It must be a power of two.
+const shardCount = 256
+
+// shard owns the keys whose hash falls into its stripe. Its lock guards the
+// maps themselves; the value of an entry is guarded by the entry's own lock.
+type shard struct {
+	sync.RWMutex
+	m map[string]*entry
+	// volatile holds the subset of m with an expiry, so the volatile
+	// eviction policies can sample them directly.
+	volatile map[string]*entry
+	// ghosts holds the entries removed or replaced since the running
+	// snapshot started, until it dumps the shard; nil otherwise.
+	ghosts map[string]*entry
+}
+
+// keyspace is a lock-striped map of keys to entries. Single-key commands only
+// lock the shard owning their key, so writers on different shards proceed in
+// parallel.
+type keyspace struct {
+	shards [shardCount]*shard
+
+	// snapMu serializes snapshots. epoch is bumped by each snapshot and
+	// cowEpoch is the epoch of the running one, 0 when there is none.
+	snapMu   sync.Mutex
+	epoch    atomic.Uint64
+	cowEpoch atomic.Uint64
+}
+
+func newKeyspace() *keyspace {
+	ks := &keyspace{}
+	for i := range ks.shards {
+		ks.shards[i] = &shard{
+			m:        make(map[string]*entry),
+			volatile: make(map[string]*entry),
+		}
+	}
+	// 0 is left for entries not added yet
+	ks.epoch.Store(1)
+	return ks
+}
+
+var db = newKeyspace()
+
+// lookup returns the live entry stored at key and records the access. The
+// caller must hold sh's read or write lock.
+func (sh *shard) lookup(key string) (*entry, bool) {
+	e, ok := sh.m[key]
+	if !ok || e.expired(nowMs()) {
+		return nil, false
+	}
+	e.touch()
+	return e, true
+}
+
+// peek is lookup without recording the access, for introspection
+// commands that must not disturb the eviction clocks.
+func (sh *shard) peek(key string) (*entry, bool) {
+	e, ok := sh.m[key]
+	if !ok || e.expired(nowMs()) {
+		return nil, false
+	}
+	return e, true
+}
+
+// lookupWrite is lookup for callers holding sh's write lock. An expired
+// entry found on the way is removed.
+func (sh *shard) lookupWrite(key string) (*entry, bool) {
+	e, ok := sh.m[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(nowMs()) {
+		sh.remove(key)
+		return nil, false
+	}
+	e.touch()
+	return e, true
+}
+
+// add stores e at key, replacing any previous entry. The caller must hold
+// sh's write lock.
+func (sh *shard) add(key string, e *entry) {
+	if old, ok := sh.m[key]; ok {
+		usedMemory.Add(-old.memory(key))
+		delete(sh.volatile, key)
+		sh.keepGhost(key, old)
+	}
+	if e.version.Load() == 0 {
+		e.version.Store(db.epoch.Load())
+	}
+	sh.m[key] = e
+	usedMemory.Add(e.memory(key))
+}
+
+// remove deletes key and reports whether it was present. The caller must
+// hold sh's write lock.
+func (sh *shard) remove(key string) bool {
+	e, ok := sh.m[key]
+	if !ok {
+		return false
+	}
+	delete(sh.m, key)
+	delete(sh.volatile, key)
+	usedMemory.Add(-e.memory(key))
+	sh.keepGhost(key, e)
+	return true
+}
+
+// setExpire sets the absolute expiry of the entry stored at key, 0 making
+// it persistent again. The caller must hold sh's write lock.
+func (sh *shard) setExpire(key string, e *entry, at int64) {
+	e.Lock()
+	e.cow()
+	e.Unlock()
+	e.expireAt.Store(at)
+	if at > 0 {
+		sh.volatile[key] = e
+	} else {
+		delete(sh.volatile, key)
+	}
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() & (shardCount - 1))
+}
+
+// shard returns the shard owning key.
+func (ks *keyspace) shard(key string) *shard {
+	return ks.shards[shardIndex(key)]
+}
+
+// shardsFor returns the distinct shards owning keys in ascending index
+// order. Every multi-key lock goes through this order, so two commands
+// touching overlapping shards can never deadlock.
+func (ks *keyspace) shardsFor(keys []string) []*shard {
+	idx := make([]int, 0, len(keys))
+	seen := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		i := shardIndex(key)
+		if _, ok := seen[i]; ok {
+			continue
+		}
+		seen[i] = struct{}{}
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	shards := make([]*shard, len(idx))
+	for i, j := range idx {
+		shards[i] = ks.shards[j]
+	}
+	return shards
+}
+
+// lockKeys write-locks every shard owning keys and returns the function
+// releasing them.
+func (ks *keyspace) lockKeys(keys ...string) func() {
+	shards := ks.shardsFor(keys)
+	for _, s := range shards {
+		s.Lock()
+	}
+	return func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].Unlock()
+		}
+	}
+}
+
+// lockAll write-locks every shard, for commands whose keys are only
+// known once they run, and returns the function releasing them.
+func (ks *keyspace) lockAll() func() {
+	for _, s := range ks.shards {
+		s.Lock()
+	}
+	return func() {
+		for i := len(ks.shards) - 1; i >= 0; i-- {
+			ks.shards[i].Unlock()
+		}
+	}
+}
+
+// rlockKeys read-locks every shard owning keys and returns the function
+// releasing them.
+func (ks *keyspace) rlockKeys(keys ...string) func() {
+	shards := ks.shardsFor(keys)
+	for _, s := range shards {
+		s.RLock()
+	}
+	return func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			shards[i].RUnlock()
+		}
+	}
+}
+
+// size returns the number of keys across all shards, including expired
+// keys that were not reclaimed yet.
+func (ks *keyspace) size() int {
+	n := 0
+	for _, sh := range ks.shards {
+		sh.RLock()
+		n += len(sh.m)
+		sh.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestLockKeysOverlapping(t *testing.T) {
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = "lock:" + strconv.Itoa(i)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				// every goroutine locks the same keys in a different order
+				a, b := keys[(g+i)%len(keys)], keys[(g*7+i)%len(keys)]
+				unlock := db.lockKeys(b, a, b)
+				unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestDelMultipleKeys(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SetHandler(w, []Value{BulkString("del:a"), BulkString("1")})
+	SetHandler(w, []Value{BulkString("del:b"), BulkString("2")})
+
+	unlock := db.rlockKeys("del:a", "del:b")
+	_, okA := db.shard("del:a").m["del:a"]
+	_, okB := db.shard("del:b").m["del:b"]
+	unlock()
+	if !okA || !okB {
+		t.Fatal("expected keys to be set")
+	}
+
+	DelHandler(w, []Value{BulkString("del:a"), BulkString("del:b"), BulkString("del:c")})
+
+	unlock = db.rlockKeys("del:a", "del:b")
+	_, okA = db.shard("del:a").m["del:a"]
+	_, okB = db.shard("del:b").m["del:b"]
+	unlock()
+	if okA || okB {
+		t.Fatal("expected keys to be deleted")
+	}
+}
+
+func TestSetOverwritesAnyType(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	runCommand(t, d, 2, "RPUSH", "setany:k", "a")
+	defer runCommand(t, d, 2, "DEL", "setany:k")
+
+	if got := runCommand(t, d, 2, "SET", "setany:k", "v"); got != "+OK\r\n" {
+		t.Fatalf("expected SET over a list to succeed, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "GET", "setany:k"); got != "$1\r\nv\r\n" {
+		t.Fatalf("expected the string value, got %q", got)
+	}
+}
+
+func BenchmarkSetParallel(b *testing.B) {
+	keys := make([]Value, 10000)
+	for i := range keys {
+		keys[i] = BulkString("key:" + strconv.Itoa(i))
+	}
+	value := BulkString("xxx")
+
+	b.RunParallel(func(pb *testing.PB) {
+		w := NewWriter(io.Discard)
+		i := 0
+		for pb.Next() {
+			SetHandler(w, []Value{keys[i%len(keys)], value})
+			i++
+		}
+	})
+}
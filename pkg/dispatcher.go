@@ -0,0 +1,367 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCloseConn is returned by exec when the handler returned ResultClose.
+var errCloseConn = errors.New("connection closed by handler")
+
+// commandStats are the counters behind INFO commandstats.
+type commandStats struct {
+	calls atomic.Int64
+	usec  atomic.Int64
+}
+
+// dispatcher runs commands for both the net and the gnet front ends. It
+// owns the command table, the accept hook, the AOF, the evictor and the
+// stats, so a front end only has to decode requests and write replies.
+type dispatcher struct {
+	sync.RWMutex
+	handlers     map[string]CommandHandler
+	accpet       func(conn net.Conn) bool
+	interceptors []Interceptor
+	config       *Config
+	Aof          *Aof
+	evictor      *evictor
+
+	// gate is held for reading by writes from the handler until they are
+	// in the AOF, so a rewrite can dump a shard between two writes.
+	gate    sync.RWMutex
+	rewrite *aofRewrite // guarded by gate
+
+	// dirty counts the changes since the last successful save, which
+	// happened at lastSave, in unix seconds. saving is closed when the
+	// running SAVE or BGSAVE is done, nil when there is none; it is
+	// guarded by saveMu like the outcome of the last BGSAVE.
+	dirty         atomic.Int64
+	lastSave      atomic.Int64
+	saveMu        sync.Mutex
+	saving        chan struct{}
+	bgsaving      bool
+	lastBgsaveErr error
+	lastBgsaveTry time.Time
+	stopCron      chan struct{}
+
+	connections atomic.Int64
+	commands    atomic.Int64
+	cmdstats    sync.Map // command name -> *commandStats
+}
+
+// newDispatcher sets up the command table and loads the AOF or the RDB
+// file config asks for, returning an error when they can't be loaded.
+func newDispatcher(config *Config) (*dispatcher, error) {
+	handlers := make(map[string]CommandHandler)
+
+	for cmd, handler := range defaultHandlers {
+		handlers[cmd] = handler
+	}
+
+	d := &dispatcher{
+		handlers: handlers,
+		config:   config,
+	}
+	d.lastSave.Store(time.Now().Unix())
+
+	if d.config != nil {
+		ev, err := newEvictor(d.config)
+		if err != nil {
+			return nil, err
+		}
+		d.evictor = ev
+	}
+
+	// the AOF is more complete than the snapshot when both are there
+	if d.config != nil && d.config.EnableAof {
+		if err := bootstrapAof(d); err != nil {
+			return nil, err
+		}
+	} else if d.config != nil {
+		if err := loadRdbFile(d.rdbPath()); err != nil {
+			return nil, fmt.Errorf("loading the RDB file %s: %w", d.rdbPath(), err)
+		}
+	}
+
+	if d.config != nil && len(d.config.Save) > 0 {
+		d.stopCron = make(chan struct{})
+		go d.saveCron(d.stopCron)
+	}
+
+	return d, nil
+}
+
+// Close stops the save points, waits for a running save and closes the
+// AOF.
+func (d *dispatcher) Close() error {
+	if d.stopCron != nil {
+		close(d.stopCron)
+		d.stopCron = nil
+	}
+	d.saveMu.Lock()
+	saving := d.saving
+	d.saveMu.Unlock()
+	if saving != nil {
+		<-saving
+	}
+	if d.Aof != nil {
+		return d.Aof.Close()
+	}
+	return nil
+}
+
+func (d *dispatcher) HandlerFunc(cmd string, handler CommandHandler) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers[strings.ToUpper(cmd)] = handler
+}
+
+func (d *dispatcher) AccpetFunc(f func(conn net.Conn) bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.accpet = f
+}
+
+// accept runs the accept hook and counts the connection, returning false
+// when the hook rejects it.
+func (d *dispatcher) accept(conn net.Conn) bool {
+	d.RLock()
+	accpet := d.accpet
+	d.RUnlock()
+	if accpet != nil && !accpet(conn) {
+		return false
+	}
+	d.connections.Add(1)
+	return true
+}
+
+func (d *dispatcher) requirePass() string {
+	if d.config == nil {
+		return ""
+	}
+	return d.config.RequirePass
+}
+
+func (d *dispatcher) newClient(w IWriter) *Client {
+	c := NewClient(w, d.requirePass())
+	c.srv = d
+	return c
+}
+
+func (d *dispatcher) lookupCommand(name string) (CommandHandler, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	h, ok := d.handlers[strings.ToUpper(name)]
+	return h, ok
+}
+
+// commandNames returns the names of every command, sorted.
+func (d *dispatcher) commandNames() []string {
+	d.RLock()
+	names := make([]string, 0, len(d.handlers))
+	for name := range d.handlers {
+		names = append(names, name)
+	}
+	d.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// exec runs the command in req for client. Errors about the request are
+// replied to the client; the returned error means the connection must be
+// closed, errCloseConn when the handler asked for it.
+func (d *dispatcher) exec(client *Client, req []Value) error {
+	cmd := strings.ToUpper(req[0].String())
+
+	client.propagated, client.dirty = nil, 0
+	ctx := &CommandContext{Client: client, Name: cmd, Args: req[1:]}
+	var err error
+	res := d.run(ctx, func() Result {
+		var res Result
+		res, err = d.call(ctx, req[0])
+		return res
+	})
+	if ctx.ran {
+		d.record(cmd, ctx.Latency)
+	}
+	if res == ResultClose {
+		err = errCloseConn
+	}
+	return err
+}
+
+// call checks the command in ctx and runs it, innermost in the interceptor
+// chain so interceptors see the commands rejected here too. name is the
+// command name as the client sent it.
+func (d *dispatcher) call(ctx *CommandContext, name Value) (Result, error) {
+	client := ctx.Client
+	cmd := ctx.Name
+
+	d.RLock()
+	handler, ok := d.handlers[cmd]
+	d.RUnlock()
+
+	if !ok {
+		return ResultError, client.WriteError("ERR unknown command '" + cmd + "'")
+	}
+
+	if !client.authenticated() && handler.flags&cmdNoAuth == 0 {
+		return ResultError, client.WriteError("NOAUTH Authentication required.")
+	}
+
+	if !handler.arityOK(len(ctx.Args) + 1) {
+		return ResultError, client.WriteError("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+	}
+
+	if handler.deny_oom() && !d.freeMemory() {
+		return ResultError, client.WriteError("OOM command not allowed when used memory > 'maxmemory'.")
+	}
+
+	persist := d.Aof != nil && handler.should_persist()
+	if persist {
+		d.gate.RLock()
+	}
+
+	res := ctx.call(&handler)
+
+	var err error
+	if client.dirty > 0 {
+		d.dirty.Add(int64(client.dirty))
+		if persist {
+			err = d.propagate(client, &handler, append([]Value{name}, ctx.Args...))
+		}
+	}
+
+	if persist {
+		d.gate.RUnlock()
+		d.autoRewriteAof()
+	}
+	return res, err
+}
+
+// propagate appends the write that just ran to the AOF: the commands the
+// handler propagated in its place or else argv, the command with the
+// arguments it ran with. The caller holds the gate.
+func (d *dispatcher) propagate(client *Client, handler *CommandHandler, argv []Value) error {
+	cmds := client.propagated
+	client.propagated = nil
+	if cmds == nil {
+		cmds = []Value{{typ: ARRAY, array: argv}}
+	}
+	return d.appendAof(handler, cmds)
+}
+
+// appendAof appends cmds to the AOF, and to the rewrite buffer what of
+// them touches a shard the running rewrite dumped already. handler stands
+// for commands missing from the table. The caller holds the gate.
+func (d *dispatcher) appendAof(handler *CommandHandler, cmds []Value) error {
+	var rewrite []Value
+	for _, cmd := range cmds {
+		if d.rewrite == nil {
+			break
+		}
+		h := handler
+		if ph, ok := d.lookupCommand(cmd.array[0].String()); ok {
+			h = &ph
+		}
+		if h == nil {
+			rewrite = append(rewrite, cmd)
+		} else if argv := d.rewrite.buffered(h, cmd.array); argv != nil {
+			rewrite = append(rewrite, Value{typ: ARRAY, array: argv})
+		}
+	}
+	return d.Aof.appendCommands(cmds, rewrite)
+}
+
+// freeMemory runs the evictor, logging a DEL of each evicted key to the
+// AOF like Redis propagates evictions, so a restart doesn't bring them
+// back.
+func (d *dispatcher) freeMemory() bool {
+	if d.Aof == nil || d.evictor == nil || d.evictor.maxMemory <= 0 {
+		return d.evictor.freeMemoryIfNeeded(nil)
+	}
+	d.gate.RLock()
+	defer d.gate.RUnlock()
+	return d.evictor.freeMemoryIfNeeded(func(key string) {
+		del := ArrayValue(BulkString("DEL"), BulkString(key))
+		if err := d.appendAof(nil, []Value{del}); err != nil {
+			log.Printf("AOF: failed to log the eviction of %q: %v", key, err)
+		}
+	})
+}
+
+func (d *dispatcher) record(cmd string, elapsed time.Duration) {
+	d.commands.Add(1)
+	v, ok := d.cmdstats.Load(cmd)
+	if !ok {
+		v, _ = d.cmdstats.LoadOrStore(cmd, &commandStats{})
+	}
+	stats := v.(*commandStats)
+	stats.calls.Add(1)
+	stats.usec.Add(elapsed.Microseconds())
+}
+
+// bootstrapAof opens the AOF and replays it into the keyspace.
+func bootstrapAof(d *dispatcher) error {
+	if ts := d.config.AofTruncateToTimestamp; ts > 0 {
+		dir, name := aofLocation(d.config.AofDir, d.config.AofFile)
+		path, size, err := truncateAofToTimestamp(dir, name, ts)
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			log.Printf("AOF truncated to timestamp %d: %s cut to %d bytes", ts, path, size)
+		}
+	}
+
+	aof, err := NewAof(d.config.AofDir, d.config.AofFile, d.config.AppendFsync)
+	if err != nil {
+		return fmt.Errorf("opening the append only file: %w", err)
+	}
+	aof.timestamps = d.config.AofTimestampEnabled
+	aof.rdbPreamble = d.config.AofUseRdbPreamble
+
+	d.Aof = aof
+
+	// the keys of an RDB preamble go straight into the keyspace
+	err = aof.load(addRdbKey, func(value Value) bool {
+		cmds := value.Array()
+		if len(cmds) == 0 {
+			return true
+		}
+
+		cmd := strings.ToUpper(cmds[0].String())
+
+		d.RLock()
+		handler, ok := d.handlers[cmd]
+		d.RUnlock()
+
+		if !ok || !handler.arityOK(len(cmds)) {
+			return true
+		}
+
+		// create fake writer
+
+		handler.call(NewWriter(io.Discard), cmds[1:])
+
+		return true
+	}, d.config.AofLoadTruncated)
+	if err != nil {
+		aof.Close()
+		d.Aof = nil
+		var ferr *AofFormatError
+		if errors.As(err, &ferr) {
+			return fmt.Errorf("%w; back it up and run check-aof --fix %s", err, ferr.File)
+		}
+		return err
+	}
+	return nil
+}
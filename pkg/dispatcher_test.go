@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDispatcherArity(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	buf := &bytes.Buffer{}
+	client := d.newClient(NewWriter(buf))
+
+	if err := d.exec(client, []Value{BulkString("get")}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "-ERR wrong number of arguments for 'get' command\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestDispatcherAofAndStats(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	d.exec(client, []Value{BulkString("SET"), BulkString("dispatch:k"), BulkString("v")})
+	d.exec(client, []Value{BulkString("GET"), BulkString("dispatch:k")})
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "dispatch:k") || strings.Contains(string(data), "GET") {
+		t.Fatalf("expected only SET in the AOF, got %q", data)
+	}
+
+	if n := d.commands.Load(); n != 2 {
+		t.Fatalf("expected 2 commands, got %d", n)
+	}
+	v, ok := d.cmdstats.Load("SET")
+	if !ok || v.(*commandStats).calls.Load() != 1 {
+		t.Fatal("expected 1 SET call in the command stats")
+	}
+}
+
+func TestErrorReplyKeepsConnection(t *testing.T) {
+	server, client := net.Pipe()
+	srv, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.handleConn(server)
+	defer client.Close()
+
+	go client.Write([]byte("SET result:k v\r\nLPUSH result:k x\r\nGET result:k\r\nQUIT\r\n"))
+
+	rd := bufio.NewReader(client)
+	for _, want := range []string{
+		"+OK\r\n",
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		"$1\r\n", "v\r\n",
+		"+OK\r\n",
+	} {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Fatalf("expected %q, got %q", want, line)
+		}
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		t.Fatalf("expected QUIT to close the connection, got %v", err)
+	}
+}
+
+func TestNoPersistSkipsAof(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	d.exec(client, []Value{BulkString("DEL"), BulkString("nopersist:missing")})
+	d.exec(client, []Value{BulkString("LPUSH"), BulkString("nopersist:k"), BulkString("v")})
+	d.exec(client, []Value{BulkString("SREM"), BulkString("nopersist:k"), BulkString("v")})
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*3\r\n$5\r\nLPUSH\r\n$11\r\nnopersist:k\r\n$1\r\nv\r\n"; string(data) != want {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// dumpPayload serializes value the way Redis' DUMP does: the RDB encoding
+// of the object, followed by the RDB version and a CRC64 of everything
+// before it, both little endian.
+func dumpPayload(typ entryType, value interface{}) string {
+	enc := &rdbEncoder{}
+	enc.writeObject(typ, value)
+	enc.buf = binary.LittleEndian.AppendUint16(enc.buf, rdbVersion)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, crc64Update(0, enc.buf))
+	return string(enc.buf)
+}
+
+// loadDumpPayload verifies the footer of payload and decodes the value.
+func loadDumpPayload(payload []byte) (entryType, interface{}, error) {
+	if len(payload) < 10 {
+		return 0, nil, errDumpPayload
+	}
+
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxVersion {
+		return 0, nil, errDumpPayload
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != crc64Update(0, payload[:len(payload)-8]) {
+		return 0, nil, errDumpPayload
+	}
+
+	d := &rdbDecoder{bytes.NewReader(payload[:len(payload)-10])}
+	rdbType, err := d.readByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	typ, value, err := d.readObject(rdbType)
+	if err == nil && valueLen(typ, value) == 0 {
+		// Redis never creates empty aggregates
+		return 0, nil, errRdbBadFormat
+	}
+	return typ, value, err
+}
+
+func DumpHandler(w IWriter, args []Value) Result {
+	key := args[0].String()
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteNull()
+		return ResultOK
+	}
+
+	e.RLock()
+	payload := dumpPayload(e.typ, e.value)
+	e.RUnlock()
+
+	w.WriteBulkString(payload)
+	return ResultOK
+}
+
+// RestoreHandler implements RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency].
+func RestoreHandler(w IWriter, args []Value) Result {
+	key := args[0].String()
+	ttl, err := strconv.ParseInt(args[1].String(), 10, 64)
+	if err != nil {
+		w.WriteError("ERR value is not an integer or out of range")
+		return ResultError
+	}
+	if ttl < 0 {
+		w.WriteError("ERR Invalid TTL value, must be >= 0")
+		return ResultError
+	}
+
+	var (
+		replace, absttl bool
+		idletime        int64 = -1
+		freq            int64 = -1
+	)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i].String()); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absttl = true
+		case opt == "IDLETIME" && i+1 < len(args) && freq == -1:
+			i++
+			idletime, err = strconv.ParseInt(args[i].String(), 10, 64)
+			if err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return ResultError
+			}
+			if idletime < 0 {
+				w.WriteError("ERR Invalid IDLETIME value, must be >= 0")
+				return ResultError
+			}
+		case opt == "FREQ" && i+1 < len(args) && idletime == -1:
+			i++
+			freq, err = strconv.ParseInt(args[i].String(), 10, 64)
+			if err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return ResultError
+			}
+			if freq < 0 || freq > 255 {
+				w.WriteError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+				return ResultError
+			}
+		default:
+			w.WriteError("ERR syntax error")
+			return ResultError
+		}
+	}
+
+	typ, value, err := loadDumpPayload([]byte(args[2].String()))
+	if err == errDumpPayload {
+		w.WriteError(err.Error())
+		return ResultError
+	}
+	if err != nil {
+		w.WriteError("ERR Bad data format")
+		return ResultError
+	}
+
+	if ttl > 0 && !absttl {
+		ttl += nowMs()
+	}
+
+	sh := db.shard(key)
+	sh.Lock()
+	_, exists := sh.lookupWrite(key)
+	if exists && !replace {
+		sh.Unlock()
+		w.WriteError("BUSYKEY Target key name already exists.")
+		return ResultError
+	}
+
+	// a payload restored with a TTL in the past only deletes the key
+	if ttl > 0 && ttl <= nowMs() {
+		if exists {
+			sh.remove(key)
+			propagate(w, "DEL", key)
+			markDirty(w, 1)
+		}
+		sh.Unlock()
+		w.WriteSimpleString("OK")
+		return ResultOK
+	}
+
+	e := newEntry(typ, value)
+	if idletime >= 0 {
+		e.lru.Store(lruClock() - idletime)
+	}
+	if freq >= 0 {
+		e.lfu.Store(lfuTimeInMinutes()<<8 | uint32(freq))
+	}
+	sh.add(key, e)
+	if ttl > 0 {
+		sh.setExpire(key, e, ttl)
+	}
+	sh.Unlock()
+	markDirty(w, 1)
+
+	if ttl > 0 && !absttl {
+		// log the absolute expiry, the replay happens later
+		argv := []string{"RESTORE", key, strconv.FormatInt(ttl, 10), args[2].String()}
+		for _, arg := range args[3:] {
+			argv = append(argv, arg.String())
+		}
+		propagate(w, append(argv, "ABSTTL")...)
+	}
+	w.WriteSimpleString("OK")
+	return ResultOK
+}
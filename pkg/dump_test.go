@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	if crc := crc64Update(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("expected 0xe9c6d914c4b8d9ca, got %#x", crc)
+	}
+}
+
+func TestDumpMatchesRedis(t *testing.T) {
+	// DUMP of SET mykey 10 from the Redis documentation
+	want := "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"
+	if got := dumpPayload(_String, "10"); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	zs := NewZSet()
+	zs.add("a", 1)
+	zs.add("b", 2.5)
+
+	values := map[entryType]interface{}{
+		_String: "hello",
+		_List:   newQlistFrom([]string{"a", "b", "c"}),
+		_Set:    newSetFrom([]string{"x", "y"}),
+		_Hash:   hash{"f": "v", "g": "1234567"},
+		_ZSet:   zs,
+	}
+
+	for typ, value := range values {
+		payload := dumpPayload(typ, value)
+		gotTyp, got, err := loadDumpPayload([]byte(payload))
+		if err != nil {
+			t.Fatalf("type %d: %v", typ, err)
+		}
+		if gotTyp != typ {
+			t.Fatalf("expected type %d, got %d", typ, gotTyp)
+		}
+		if again := dumpPayload(gotTyp, got); typ != _Set && typ != _Hash && again != payload {
+			t.Fatalf("type %d: payload changed after a round trip", typ)
+		}
+	}
+}
+
+func TestRestoreRejectsBadChecksum(t *testing.T) {
+	payload := []byte(dumpPayload(_String, "hello"))
+	payload[1] ^= 0xff
+
+	buf := &bytes.Buffer{}
+	RestoreHandler(NewWriter(buf), []Value{BulkString("restore:bad"), BulkString("0"), BulkString(string(payload))})
+	if want := "-ERR DUMP payload version or checksum are wrong\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestRestoreRejectsEmptyAggregates(t *testing.T) {
+	values := map[entryType]interface{}{
+		_List: &qlist{},
+		_Set:  newSetFrom(nil),
+		_Hash: hash{},
+		_ZSet: NewZSet(),
+	}
+	for typ, value := range values {
+		payload := dumpPayload(typ, value)
+
+		buf := &bytes.Buffer{}
+		RestoreHandler(NewWriter(buf), []Value{BulkString("restore:empty"), BulkString("0"), BulkString(payload)})
+		if want := "-ERR Bad data format\r\n"; buf.String() != want {
+			t.Fatalf("type %d: expected %q, got %q", typ, want, buf.String())
+		}
+	}
+}
+
+func TestRestoreRejectsOversizedLengths(t *testing.T) {
+	payloads := map[string][]byte{
+		// an LZF string claiming to inflate 1 byte to 2^62 bytes
+		"lzf": {rdbTypeString, rdbEncVal<<6 | rdbEncLZF, 1, rdb64BitLen, 0x40, 0, 0, 0, 0, 0, 0, 0, 'a'},
+		// a raw string longer than the payload
+		"raw": {rdbTypeString, rdb32BitLen, 0x10, 0, 0, 0, 'a'},
+	}
+	for name, payload := range payloads {
+		payload = binary.LittleEndian.AppendUint16(payload, rdbVersion)
+		payload = binary.LittleEndian.AppendUint64(payload, crc64Update(0, payload))
+
+		buf := &bytes.Buffer{}
+		RestoreHandler(NewWriter(buf), []Value{BulkString("restore:oversized"), BulkString("0"), BulkString(string(payload))})
+		if want := "-ERR Bad data format\r\n"; buf.String() != want {
+			t.Fatalf("%s: expected %q, got %q", name, want, buf.String())
+		}
+	}
+}
+
+func TestRestoreListpackHash(t *testing.T) {
+	// a hash {a: 1} the way Redis 7 dumps it
+	lp := []byte{12, 0, 0, 0, 2, 0, 0x81, 'a', 0x02, 0x01, 0x01, 0xFF}
+	enc := &rdbEncoder{}
+	enc.writeByte(rdbTypeHashListpack)
+	enc.writeLength(uint64(len(lp)))
+	enc.buf = append(enc.buf, lp...)
+	enc.buf = binary.LittleEndian.AppendUint16(enc.buf, 10)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, crc64Update(0, enc.buf))
+
+	w := NewWriter(io.Discard)
+	if RestoreHandler(w, []Value{BulkString("restore:lp"), BulkString("0"), BulkString(string(enc.buf)), BulkString("REPLACE")}) != ResultOK {
+		t.Fatal("restore failed")
+	}
+
+	buf := &bytes.Buffer{}
+	HGetHandler(NewWriter(buf), []Value{BulkString("restore:lp"), BulkString("a")})
+	if want := "$1\r\n1\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestRestoreBusyKey(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SetHandler(w, []Value{BulkString("restore:busy"), BulkString("v")})
+
+	payload := dumpPayload(_String, "other")
+	buf := &bytes.Buffer{}
+	RestoreHandler(NewWriter(buf), []Value{BulkString("restore:busy"), BulkString("0"), BulkString(payload)})
+	if want := "-BUSYKEY Target key name already exists.\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
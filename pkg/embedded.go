@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Embedded runs commands in-process, without a connection. Commands go
+// through the same dispatcher as network clients, so they see the same
+// interceptors, stats and AOF. Embedded clients are trusted and skip
+// requirepass.
+type Embedded struct {
+	d     *dispatcher
+	owned bool // d was made by NewEmbedded, so Close shuts it down
+}
+
+// NewEmbedded returns an Embedded over a dispatcher of its own, for
+// programs that use the store without serving it.
+func NewEmbedded(config *Config) (*Embedded, error) {
+	d, err := newDispatcher(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Embedded{d: d, owned: true}, nil
+}
+
+// Embedded returns an Embedded sharing the server's dispatcher.
+func (d *dispatcher) Embedded() *Embedded {
+	return &Embedded{d: d}
+}
+
+// Close stops the save points of an Embedded made by NewEmbedded, waits
+// for a running save and closes its AOF. Closing an Embedded sharing a
+// server's dispatcher does nothing; the server owns its persistence.
+func (e *Embedded) Close() error {
+	if !e.owned {
+		return nil
+	}
+	return e.d.Close()
+}
+
+// Do runs cmd with args and returns its reply. An error reply is returned
+// as an error along with the reply itself.
+func (e *Embedded) Do(cmd string, args ...string) (Value, error) {
+	req := make([]Value, 0, len(args)+1)
+	req = append(req, BulkString(cmd))
+	for _, arg := range args {
+		req = append(req, BulkString(arg))
+	}
+
+	// the recorder keeps the reply; its encoding goes nowhere
+	w := &replyRecorder{IWriter: NewWriter(io.Discard)}
+	client := NewClient(w, "")
+	client.srv = e.d
+	if err := e.d.exec(client, req); err != nil && err != errCloseConn {
+		return w.reply, err
+	}
+	if w.reply.typ == ERROR {
+		return w.reply, errors.New(w.reply.str)
+	}
+	return w.reply, nil
+}
+
+// Get returns the string at key and whether it exists.
+func (e *Embedded) Get(key string) (string, bool, error) {
+	v, err := e.Do("GET", key)
+	if err != nil {
+		return "", false, err
+	}
+	return v.String(), !v.IsNull(), nil
+}
+
+func (e *Embedded) Set(key, value string) error {
+	_, err := e.Do("SET", key, value)
+	return err
+}
+
+// Del removes keys and returns how many existed.
+func (e *Embedded) Del(keys ...string) (int, error) {
+	v, err := e.Do("DEL", keys...)
+	return v.Integer(), err
+}
+
+// HSet sets field of the hash at key and returns 1 if the field is new.
+func (e *Embedded) HSet(key, field, value string) (int, error) {
+	v, err := e.Do("HSET", key, field, value)
+	return v.Integer(), err
+}
+
+// HGet returns field of the hash at key and whether it exists.
+func (e *Embedded) HGet(key, field string) (string, bool, error) {
+	v, err := e.Do("HGET", key, field)
+	if err != nil {
+		return "", false, err
+	}
+	return v.String(), !v.IsNull(), nil
+}
+
+// LPush prepends values to the list at key and returns its new length.
+func (e *Embedded) LPush(key string, values ...string) (int, error) {
+	v, err := e.Do("LPUSH", append([]string{key}, values...)...)
+	return v.Integer(), err
+}
+
+// LRange returns the elements of the list at key from start to stop.
+func (e *Embedded) LRange(key string, start, stop int) ([]string, error) {
+	v, err := e.Do("LRANGE", key, strconv.Itoa(start), strconv.Itoa(stop))
+	if err != nil {
+		return nil, err
+	}
+	elems := make([]string, 0, len(v.array))
+	for _, elem := range v.array {
+		elems = append(elems, elem.String())
+	}
+	return elems, nil
+}
+
+// ZAdd sets the score of member in the sorted set at key and returns 1 if
+// the member is new.
+func (e *Embedded) ZAdd(key string, score float64, member string) (int, error) {
+	v, err := e.Do("ZADD", key, strconv.FormatFloat(score, 'g', -1, 64), member)
+	return v.Integer(), err
+}
+
+// ZScore returns the score of member and whether it exists.
+func (e *Embedded) ZScore(key, member string) (float64, bool, error) {
+	v, err := e.Do("ZSCORE", key, member)
+	if err != nil {
+		return 0, false, err
+	}
+	return v.Double(), !v.IsNull(), nil
+}
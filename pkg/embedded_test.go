@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedTypedAPI(t *testing.T) {
+	e, err := NewEmbedded(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Set("embed:s", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := e.Get("embed:s"); err != nil || !ok || v != "v" {
+		t.Fatalf("GET: %q %v %v", v, ok, err)
+	}
+	if _, ok, _ := e.Get("embed:missing"); ok {
+		t.Fatal("expected a missing key")
+	}
+
+	if n, err := e.HSet("embed:h", "f", "1"); err != nil || n != 1 {
+		t.Fatalf("HSET: %d %v", n, err)
+	}
+	if n, err := e.HSet("embed:h", "f", "1"); err != nil || n != 0 {
+		t.Fatalf("HSET of an existing field: %d %v", n, err)
+	}
+	if v, ok, _ := e.HGet("embed:h", "f"); !ok || v != "1" {
+		t.Fatalf("HGET: %q %v", v, ok)
+	}
+
+	if n, err := e.LPush("embed:l", "a", "b"); err != nil || n != 2 {
+		t.Fatalf("LPUSH: %d %v", n, err)
+	}
+	if n, err := e.LPush("embed:l", "c"); err != nil || n != 3 {
+		t.Fatalf("LPUSH: expected the new length 3, got %d %v", n, err)
+	}
+	if elems, _ := e.LRange("embed:l", 0, -1); !reflect.DeepEqual(elems, []string{"c", "b", "a"}) {
+		t.Fatalf("LRANGE: %v", elems)
+	}
+
+	if n, err := e.ZAdd("embed:z", 1.5, "m"); err != nil || n != 1 {
+		t.Fatalf("ZADD: %d %v", n, err)
+	}
+	if score, ok, _ := e.ZScore("embed:z", "m"); !ok || score != 1.5 {
+		t.Fatalf("ZSCORE: %v %v", score, ok)
+	}
+
+	if n, _ := e.Del("embed:s", "embed:h", "embed:l", "embed:z"); n != 4 {
+		t.Fatalf("DEL: %d", n)
+	}
+}
+
+func TestEmbeddedErrors(t *testing.T) {
+	e, err := NewEmbedded(&Config{RequirePass: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// embedded clients are trusted
+	if err := e.Set("embed:err", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.LPush("embed:err", "x"); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Fatalf("expected WRONGTYPE, got %v", err)
+	}
+	v, err := e.Do("NOSUCHCMD")
+	if err == nil || !v.IsError() {
+		t.Fatalf("expected an error reply, got %v %v", v, err)
+	}
+}
+
+func TestEmbeddedSharesServer(t *testing.T) {
+	dir := t.TempDir()
+	srv, err := NewServer(&Config{EnableAof: true, AofDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Aof.Close()
+
+	var names []string
+	srv.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+		names = append(names, ctx.Name)
+		return next()
+	})
+
+	e := srv.Embedded()
+	e.Set("embed:aof", "v")
+	e.Get("embed:aof")
+
+	if !reflect.DeepEqual(names, []string{"SET", "GET"}) {
+		t.Fatalf("expected the interceptor to see SET and GET, got %v", names)
+	}
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "embed:aof") {
+		t.Fatalf("expected SET in the AOF, got %q", data)
+	}
+}
+
+func TestEmbeddedClose(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{EnableAof: true, AofDir: dir}
+	e, err := NewEmbedded(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Set("embed:close", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// drop the key behind the AOF's back so only the replay brings it back
+	DelHandler(NewWriter(io.Discard), []Value{BulkString("embed:close")})
+	e, err = NewEmbedded(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	defer e.Del("embed:close")
+	if v, ok, err := e.Get("embed:close"); err != nil || !ok || v != "v" {
+		t.Fatalf("expected the key back from the AOF, got %q %v %v", v, ok, err)
+	}
+}
+
+func TestEmbeddedCloseShared(t *testing.T) {
+	dir := t.TempDir()
+	srv, err := NewServer(&Config{EnableAof: true, AofDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if err := srv.Embedded().Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Embedded().Set("embed:shared", "v"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "embed:shared") {
+		t.Fatalf("expected the server's AOF to stay open, got %q", data)
+	}
+}
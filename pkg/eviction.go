@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+type evictionPolicy uint8
+
+const (
+	noEviction evictionPolicy = iota
+	allKeysLRU
+	allKeysLFU
+	allKeysRandom
+	volatileLRU
+	volatileLFU
+	volatileRandom
+	volatileTTL
+)
+
+var evictionPolicies = map[string]evictionPolicy{
+	"noeviction":      noEviction,
+	"allkeys-lru":     allKeysLRU,
+	"allkeys-lfu":     allKeysLFU,
+	"allkeys-random":  allKeysRandom,
+	"volatile-lru":    volatileLRU,
+	"volatile-lfu":    volatileLFU,
+	"volatile-random": volatileRandom,
+	"volatile-ttl":    volatileTTL,
+}
+
+func parseEvictionPolicy(name string) (evictionPolicy, error) {
+	if name == "" {
+		return noEviction, nil
+	}
+	p, ok := evictionPolicies[strings.ToLower(name)]
+	if !ok {
+		return noEviction, fmt.Errorf("invalid maxmemory-policy '%s'", name)
+	}
+	return p, nil
+}
+
+func (p evictionPolicy) String() string {
+	for name, policy := range evictionPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+func (p evictionPolicy) volatile() bool {
+	return p >= volatileLRU
+}
+
+const defaultMaxMemorySamples = 5
+
+// evictedKeys counts the keys removed to honour maxmemory.
+var evictedKeys atomic.Int64
+
+// evictor frees memory with sampled approximations of the Redis policies:
+// each round samples a handful of keys and evicts the best candidate.
+type evictor struct {
+	maxMemory int64
+	policy    evictionPolicy
+	samples   int
+}
+
+func newEvictor(config *Config) (*evictor, error) {
+	policy, err := parseEvictionPolicy(config.MaxMemoryPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := config.MaxMemorySamples
+	if samples <= 0 {
+		samples = defaultMaxMemorySamples
+	}
+
+	return &evictor{
+		maxMemory: config.MaxMemory,
+		policy:    policy,
+		samples:   samples,
+	}, nil
+}
+
+type evictionCandidate struct {
+	key   string
+	score int64 // higher is a better victim
+}
+
+// freeMemoryIfNeeded evicts keys until used memory is back under the
+// limit, calling evicted, if set, with each key evicted. It returns false
+// if the limit is still exceeded, in which case commands that may grow the
+// dataset must be refused.
+func (ev *evictor) freeMemoryIfNeeded(evicted func(key string)) bool {
+	if ev == nil || ev.maxMemory <= 0 {
+		return true
+	}
+
+	for usedMemory.Load() > ev.maxMemory {
+		if ev.policy == noEviction {
+			return false
+		}
+
+		victim, ok := ev.sample()
+		if !ok {
+			return false
+		}
+
+		sh := db.shard(victim.key)
+		sh.Lock()
+		removed := sh.remove(victim.key)
+		sh.Unlock()
+		if removed {
+			evictedKeys.Add(1)
+			if evicted != nil {
+				evicted(victim.key)
+			}
+		}
+	}
+	return true
+}
+
+// sample picks up to ev.samples keys from random shards and returns the
+// best victim among them according to the policy.
+func (ev *evictor) sample() (evictionCandidate, bool) {
+	var best evictionCandidate
+	sampled := 0
+
+	now := nowMs()
+	clock := lruClock()
+
+	// walk the shards from a random one so that sparse keyspaces still
+	// yield candidates, taking at most one key per shard
+	start := rand.Intn(shardCount)
+	for i := 0; sampled < ev.samples && i < shardCount; i++ {
+		sh := db.shards[(start+i)%shardCount]
+		sh.RLock()
+		keys := sh.m
+		if ev.policy.volatile() {
+			keys = sh.volatile
+		}
+		// map iteration starts at a random position
+		for key, e := range keys {
+			var score int64
+			switch ev.policy {
+			case allKeysLRU, volatileLRU:
+				score = clock - e.lru.Load()
+			case allKeysLFU, volatileLFU:
+				score = 255 - int64(lfuDecrAndReturn(e.lfu.Load()))
+			case volatileTTL:
+				score = now - e.expireAt.Load()
+			}
+
+			if sampled == 0 || score > best.score {
+				best = evictionCandidate{key: key, score: score}
+			}
+			sampled++
+			break
+		}
+		sh.RUnlock()
+
+		if sampled > 0 && (ev.policy == allKeysRandom || ev.policy == volatileRandom) {
+			break
+		}
+	}
+
+	return best, sampled > 0
+}
@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEvictionNoEviction(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SetHandler(w, []Value{BulkString("evict:noeviction"), BulkString("value")})
+
+	ev, err := newEvictor(&Config{MaxMemory: 1, MaxMemoryPolicy: "noeviction"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.freeMemoryIfNeeded(nil) {
+		t.Fatal("expected noeviction to refuse freeing memory")
+	}
+
+	DelHandler(w, []Value{BulkString("evict:noeviction")})
+}
+
+func TestEvictionAllKeysLRU(t *testing.T) {
+	w := NewWriter(io.Discard)
+	for i := 0; i < 100; i++ {
+		SetHandler(w, []Value{BulkString("evict:lru:" + strconv.Itoa(i)), BulkString("value")})
+	}
+
+	limit := usedMemory.Load() - 50*keyOverhead("evict:lru:00")
+	ev, err := newEvictor(&Config{MaxMemory: limit, MaxMemoryPolicy: "allkeys-lru"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.freeMemoryIfNeeded(nil) {
+		t.Fatal("expected allkeys-lru to free memory")
+	}
+	if used := usedMemory.Load(); used > limit {
+		t.Fatalf("used memory %d still over limit %d", used, limit)
+	}
+	if evictedKeys.Load() == 0 {
+		t.Fatal("expected evicted keys to be counted")
+	}
+}
+
+func TestEvictionVolatileOnlyTouchesKeysWithTTL(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SetHandler(w, []Value{BulkString("evict:volatile:persistent"), BulkString("value")})
+	SetHandler(w, []Value{BulkString("evict:volatile:expiring"), BulkString("value")})
+	ExpireHandler(w, []Value{BulkString("evict:volatile:expiring"), BulkString("100")})
+
+	limit := usedMemory.Load() - 1
+	ev, err := newEvictor(&Config{MaxMemory: limit, MaxMemoryPolicy: "volatile-ttl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.freeMemoryIfNeeded(nil)
+
+	sh := db.shard("evict:volatile:persistent")
+	sh.RLock()
+	_, ok := sh.lookup("evict:volatile:persistent")
+	sh.RUnlock()
+	if !ok {
+		t.Fatal("volatile-ttl evicted a key without a TTL")
+	}
+
+	sh = db.shard("evict:volatile:expiring")
+	sh.RLock()
+	_, ok = sh.lookup("evict:volatile:expiring")
+	sh.RUnlock()
+	if ok {
+		t.Fatal("expected the key with a TTL to be evicted")
+	}
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	if _, err := parseEvictionPolicy("allkeys-foo"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+	if p, err := parseEvictionPolicy("VOLATILE-LFU"); err != nil || p != volatileLFU {
+		t.Fatalf("expected volatile-lfu, got %v %v", p, err)
+	}
+}
+
+func TestEvictionPropagatesDel(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+	defer runCommand(t, d, 2, "DEL", "evictaof:k", "evictaof:other")
+
+	runCommand(t, d, 2, "SET", "evictaof:k", "v")
+	runCommand(t, d, 2, "EXPIRE", "evictaof:k", "1000")
+	ev, err := newEvictor(&Config{MaxMemory: usedMemory.Load() - 1, MaxMemoryPolicy: "volatile-ttl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.evictor = ev
+	runCommand(t, d, 2, "SET", "evictaof:other", "v")
+	d.evictor = nil
+
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*2\r\n$3\r\nDEL\r\n$10\r\nevictaof:k\r\n"; !strings.Contains(string(data), want) {
+		t.Fatalf("expected %q in %q", want, data)
+	}
+}
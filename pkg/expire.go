@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"strconv"
+)
+
+// expireGeneric sets the expiry of args[0]. args[1] counts units of unit
+// milliseconds and is relative to now unless absolute is set.
+func expireGeneric(w IWriter, args []Value, unit int64, absolute bool) Result {
+	key := args[0].String()
+	when, err := strconv.ParseInt(args[1].String(), 10, 64)
+	if err != nil {
+		w.WriteError("ERR value is not an integer or out of range")
+		return ResultError
+	}
+	when *= unit
+	if !absolute {
+		when += nowMs()
+	}
+
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
+	if !ok {
+		sh.Unlock()
+		w.WriteInteger(0)
+		return ResultOK
+	}
+
+	// log an absolute expiry, the replay happens later
+	if when <= nowMs() {
+		sh.remove(key)
+		propagate(w, "DEL", key)
+	} else {
+		sh.setExpire(key, e, when)
+		if !absolute || unit != 1 {
+			propagate(w, "PEXPIREAT", key, strconv.FormatInt(when, 10))
+		}
+	}
+	sh.Unlock()
+	markDirty(w, 1)
+
+	w.WriteInteger(1)
+	return ResultOK
+}
+
+func ExpireHandler(w IWriter, args []Value) Result {
+	return expireGeneric(w, args, 1000, false)
+}
+
+func PExpireHandler(w IWriter, args []Value) Result {
+	return expireGeneric(w, args, 1, false)
+}
+
+func ExpireAtHandler(w IWriter, args []Value) Result {
+	return expireGeneric(w, args, 1000, true)
+}
+
+func PExpireAtHandler(w IWriter, args []Value) Result {
+	return expireGeneric(w, args, 1, true)
+}
+
+func ttlGeneric(w IWriter, args []Value, unit int64) Result {
+	key := args[0].String()
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteInteger(-2)
+		return ResultOK
+	}
+
+	at := e.expireAt.Load()
+	if at == 0 {
+		w.WriteInteger(-1)
+		return ResultOK
+	}
+
+	ttl := at - nowMs()
+	if ttl < 0 {
+		ttl = 0
+	}
+	// round to the nearest unit like Redis does
+	w.WriteInteger(int((ttl + unit/2) / unit))
+	return ResultOK
+}
+
+func TTLHandler(w IWriter, args []Value) Result {
+	return ttlGeneric(w, args, 1000)
+}
+
+func PTTLHandler(w IWriter, args []Value) Result {
+	return ttlGeneric(w, args, 1)
+}
+
+func PersistHandler(w IWriter, args []Value) Result {
+	key := args[0].String()
+
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
+	removed := ok && e.expireAt.Load() != 0
+	if removed {
+		sh.setExpire(key, e, 0)
+	}
+	sh.Unlock()
+	markDirty(w, bool2int(removed))
+
+	w.WriteInteger(bool2int(removed))
+	return ResultOK
+}
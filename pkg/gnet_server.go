@@ -1,9 +1,11 @@
 package pkg
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
@@ -12,28 +14,26 @@ import (
 
 type GServer struct {
 	gnet.BuiltinEventEngine
+	*dispatcher
 	eng       gnet.Engine
 	net       string
 	addr      string
 	multicore bool
-	handlers  map[string]CommandHandler
 	pool      *goroutine.Pool
 }
 
-func NewGServer(net, addr string, multicore bool, p *goroutine.Pool) *GServer {
-	handlers := make(map[string]CommandHandler)
-
-	for cmd, handler := range defaultHandlers {
-		handlers[cmd] = handler
+func NewGServer(net, addr string, multicore bool, p *goroutine.Pool, config *Config) (*GServer, error) {
+	d, err := newDispatcher(config)
+	if err != nil {
+		return nil, err
 	}
-
 	return &GServer{
-		net:       net,
-		addr:      addr,
-		multicore: multicore,
-		handlers:  handlers,
-		pool:      p,
-	}
+		dispatcher: d,
+		net:        net,
+		addr:       addr,
+		multicore:  multicore,
+		pool:       p,
+	}, nil
 }
 
 func (s *GServer) ProtoAddr() string {
@@ -50,112 +50,259 @@ func (s *GServer) OnBoot(eng gnet.Engine) gnet.Action {
 	return gnet.None
 }
 
+func (s *GServer) OnOpen(conn gnet.Conn) ([]byte, gnet.Action) {
+	// the writer and client outlive a single traffic event, so the
+	// protocol negotiated with HELLO sticks to the connection
+	conn.SetContext(s.newGConn(conn))
+	if !s.accept(conn) {
+		return nil, gnet.Close
+	}
+	return nil, gnet.None
+}
+
+func (s *GServer) OnClose(conn gnet.Conn, err error) gnet.Action {
+	c := conn.Context().(*gConn)
+	c.mu.Lock()
+	c.closing = true
+	c.pending = nil
+	c.mu.Unlock()
+	return gnet.None
+}
+
+// OnTraffic decodes every complete command in the inbound buffer. A
+// trailing partial frame is left in the buffer, gnet keeps it for the
+// next event.
 func (s *GServer) OnTraffic(conn gnet.Conn) gnet.Action {
-	c := NewGConn(conn)
+	c := conn.Context().(*gConn)
 
-	value, err := c.Reader.resp.Read()
+	data, _ := conn.Peek(-1)
+	reqs, n, err := c.decode(data)
 	if err != nil {
-		return gnet.Close
+		reqs = append(reqs, gRequest{err: err})
+		n = len(data)
 	}
+	conn.Discard(n)
 
-	if value.typ == 0 {
-		return gnet.None
+	if len(reqs) > 0 {
+		s.enqueue(c, reqs)
 	}
+	return gnet.None
+}
 
-	if !value.IsArray() {
-		return gnet.None
+// enqueue queues reqs behind the connection's pending commands and starts
+// a pool task to run them unless one is already running, so the commands
+// of a connection run one at a time and in order.
+func (s *GServer) enqueue(c *gConn, reqs []gRequest) {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return
 	}
+	c.pending = append(c.pending, reqs...)
+	if c.running {
+		c.mu.Unlock()
+		return
+	}
+	c.running = true
+	c.mu.Unlock()
 
-	req := value.Array()
-
-	cmd := strings.ToUpper(req[0].String())
-
-	handler, ok := s.handlers[cmd]
+	if err := s.pool.Submit(func() { s.drain(c) }); err != nil {
+		go s.drain(c)
+	}
+}
 
-	if !ok {
-		if err := c.Writer.WriteError("ERR unknown command '" + cmd + "'"); err != nil {
-			return gnet.Close
+func (s *GServer) drain(c *gConn) {
+	for {
+		c.mu.Lock()
+		reqs := c.pending
+		c.pending = nil
+		if len(reqs) == 0 || c.closing {
+			c.running = false
+			c.mu.Unlock()
+			return
 		}
-
-		return gnet.None
+		c.mu.Unlock()
+
+		for _, req := range reqs {
+			if !s.exec(c, req) {
+				c.mu.Lock()
+				c.closing = true
+				c.mu.Unlock()
+				c.Writer.Flush()
+				c.Close()
+				return
+			}
+		}
+		// replies of a batch leave in a single write
+		c.Writer.Flush()
 	}
+}
 
-	_ = s.pool.Submit(func() {
-		handler.call(c.Writer, req[1:])
-	})
+// exec runs one request, returning false when the connection must be
+// closed.
+func (s *GServer) exec(c *gConn, req gRequest) bool {
+	if req.err != nil {
+		if perr, ok := req.err.(*ProtocolError); ok {
+			c.Writer.WriteError("ERR " + perr.Error())
+		}
+		return false
+	}
+	return s.dispatcher.exec(c.Client, req.args) == nil
+}
 
-	return gnet.None
+// gRequest is a decoded command, or the error that ended decoding.
+type gRequest struct {
+	args []Value
+	err  error
 }
 
 type gConn struct {
 	gnet.Conn
-	Writer     *gWriter
-	Reader     *Reader
+	Writer     *Writer
+	Client     *Client
 	remoteAddr string
+
+	// decoding state, only touched by the event loop
+	src  *bytes.Reader
+	resp *Resp
+	rd   *bufio.Reader
+	scan reqScan
+
+	mu      sync.Mutex
+	pending []gRequest
+	running bool
+	closing bool
 }
 
-func NewGConn(conn gnet.Conn) *gConn {
+func (s *GServer) newGConn(conn gnet.Conn) *gConn {
+	w := NewBufferedWriter(asyncWriter{conn})
+	src := bytes.NewReader(nil)
+	rd := bufio.NewReaderSize(src, readBufferSize)
 	return &gConn{
 		Conn:       conn,
-		Writer:     NewGWriter(conn),
-		Reader:     NewReader(conn),
+		Writer:     w,
+		Client:     s.newClient(w),
 		remoteAddr: conn.RemoteAddr().String(),
+		src:        src,
+		rd:         rd,
+		resp:       NewResp(rd),
 	}
 }
 
-type gWriter struct {
-	gnet.Writer
-}
-
-var nilCallback gnet.AsyncCallback
+// maxQueryBufferSize caps the bytes of a connection waiting for the end of
+// a request, as Redis's client-query-buffer-limit.
+const maxQueryBufferSize = 1 << 30
 
-func NewGWriter(w gnet.Writer) *gWriter {
-	return &gWriter{w}
-}
+var errQueryBufferLimit = errors.New("query buffer limit reached")
 
-func (w *gWriter) WriteSimpleString(str string) error {
-	err := w.AsyncWrite([]byte("+"+str+"\r\n"), nilCallback)
-	return err
+// reqScan is how far scanRequest got through the partial request at the
+// start of the inbound buffer, so the next event picks up from there.
+type reqScan struct {
+	pos int
+	// multibulk is set once the header of a multibulk was scanned, with
+	// left bulks still to come
+	multibulk bool
+	left      int
 }
 
-func (w *gWriter) WriteError(str string) error {
-	err := w.AsyncWrite([]byte("-"+str+"\r\n"), nilCallback)
-	return err
-}
+// scanRequest returns the length of the request at the start of data, or
+// 0 while it is incomplete. It only walks the lines of the request and
+// jumps over bulk payloads, so a large bulk arriving in many events isn't
+// parsed again each time. Anything malformed is handed to the parser as
+// soon as its line is in, for it to report.
+func (c *gConn) scanRequest(data []byte) int {
+	s := &c.scan
+	if !s.multibulk {
+		nl := bytes.IndexByte(data[s.pos:], '\n')
+		if nl < 0 {
+			s.pos = len(data)
+			if len(data) > maxInlineSize {
+				return c.scanned(len(data))
+			}
+			return 0
+		}
+		// anything but a multibulk is an inline command
+		line := data[:s.pos+nl+1]
+		if data[0] != ARRAY {
+			return c.scanned(len(line))
+		}
+		n, ok := parseInt(bytes.TrimSuffix(line[1:len(line)-1], []byte{'\r'}))
+		if !ok || n > maxArrayLength || n <= 0 {
+			return c.scanned(len(line))
+		}
+		*s = reqScan{pos: len(line), multibulk: true, left: int(n)}
+	}
 
-func (w *gWriter) WriteInteger(i int) error {
-	err := w.AsyncWrite([]byte(":"+strconv.Itoa(i)+"\r\n"), nilCallback)
-	return err
+	for s.left > 0 {
+		nl := bytes.IndexByte(data[s.pos:], '\n')
+		if nl < 0 {
+			return 0
+		}
+		line := data[s.pos : s.pos+nl+1]
+		if line[0] != BULK {
+			return c.scanned(s.pos + len(line))
+		}
+		n, ok := parseInt(bytes.TrimSuffix(line[1:len(line)-1], []byte{'\r'}))
+		if !ok || n < -1 || n > maxBulkLength {
+			return c.scanned(s.pos + len(line))
+		}
+		end := s.pos + len(line)
+		if n >= 0 {
+			end += int(n) + 2
+		}
+		if end > len(data) {
+			return 0
+		}
+		s.pos = end
+		s.left--
+	}
+	return c.scanned(s.pos)
 }
 
-func (w *gWriter) WriteBulkString(str string) error {
-	err := w.AsyncWrite([]byte("$"+strconv.Itoa(len(str))+"\r\n"+str+"\r\n"), nilCallback)
-	return err
+// scanned resets the scan for the next request and returns n.
+func (c *gConn) scanned(n int) int {
+	c.scan = reqScan{}
+	return n
 }
 
-func (w *gWriter) WriteNull() error {
-	err := w.AsyncWrite([]byte("$-1\r\n"), nilCallback)
-	return err
-}
+// decode parses the complete commands at the start of data and returns
+// them along with the number of bytes they took.
+func (c *gConn) decode(data []byte) ([]gRequest, int, error) {
+	var reqs []gRequest
+	consumed := 0
+	for {
+		n := c.scanRequest(data[consumed:])
+		if n == 0 {
+			if len(data)-consumed > maxQueryBufferSize {
+				return reqs, consumed, errQueryBufferLimit
+			}
+			return reqs, consumed, nil
+		}
 
-func (w *gWriter) WriteArray(value Value) error {
-	err := w.AsyncWrite([]byte("*"+strconv.Itoa(len(value.array))+"\r\n"), nilCallback)
+		c.src.Reset(data[consumed : consumed+n])
+		c.rd.Reset(c.src)
+		value, err := c.resp.ReadRequest()
+		if err != nil {
+			return reqs, consumed, err
+		}
+		consumed += n
 
-	if err != nil {
-		return err
+		if !value.IsArray() || value.IsNull() || len(value.Array()) == 0 {
+			continue
+		}
+		reqs = append(reqs, gRequest{args: value.Array()})
 	}
+}
 
-	for _, v := range value.array {
-		switch v.typ {
-		case STRING:
-			err = w.WriteSimpleString(v.str)
-		case ERROR:
-			err = w.WriteError(v.str)
-		case INTEGER:
-			err = w.WriteInteger(v.integer)
-		case BULK:
-			err = w.WriteBulkString(v.str)
-		}
+// asyncWriter hands each flushed batch of replies to the event loop.
+type asyncWriter struct {
+	conn gnet.Conn
+}
+
+func (w asyncWriter) Write(p []byte) (int, error) {
+	// the Writer reuses p as soon as Write returns
+	if err := w.conn.AsyncWrite(bytes.Clone(p), nil); err != nil {
+		return 0, err
 	}
-	return err
+	return len(p), nil
 }
@@ -1,7 +1,14 @@
 package pkg
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/pool/goroutine"
@@ -10,7 +17,180 @@ import (
 func TestGnetServer(t *testing.T) {
 	p := goroutine.Default()
 	defer p.Release()
-	srv := NewGServer("tcp", ":6379", true, p)
+	srv, err := NewGServer("tcp", ":6379", true, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	t.Fatal(gnet.Run(srv, srv.net+"://"+srv.addr, gnet.WithMulticore(srv.multicore)))
 }
+
+// startGServer runs a gnet server on a free port and returns a
+// connection to it.
+func startGServer(t *testing.T, config *Config) (*GServer, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := goroutine.Default()
+	srv, err := NewGServer("tcp", addr, true, p, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gnet.Run(srv, srv.ProtoAddr(), gnet.WithMulticore(srv.multicore))
+	t.Cleanup(func() {
+		gnet.Stop(context.Background(), srv.ProtoAddr())
+		p.Release()
+	})
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return srv, conn
+}
+
+func TestGnetPipelining(t *testing.T) {
+	_, conn := startGServer(t, nil)
+
+	const n = 5000
+	var req bytes.Buffer
+	for i := 0; i < n; i++ {
+		v := strconv.Itoa(i)
+		if i%2 == 0 {
+			fmt.Fprintf(&req, "*3\r\n$3\r\nSET\r\n$%d\r\npipe:%s\r\n$%d\r\n%s\r\n", len(v)+5, v, len(v), v)
+		} else {
+			fmt.Fprintf(&req, "PING %s\r\n", v)
+		}
+	}
+
+	// write in odd sized chunks so frames are split across events
+	go func() {
+		data := req.Bytes()
+		for len(data) > 0 {
+			chunk := min(len(data), 1021)
+			conn.Write(data[:chunk])
+			data = data[chunk:]
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	rd := bufio.NewReader(conn)
+	for i := 0; i < n; i++ {
+		want := "+OK\r\n"
+		if i%2 == 1 {
+			want = "+" + strconv.Itoa(i) + "\r\n"
+		}
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if line != want {
+			t.Fatalf("reply %d: expected %q, got %q", i, want, line)
+		}
+	}
+}
+
+func TestGnetSharesDispatcher(t *testing.T) {
+	srv, conn := startGServer(t, &Config{RequirePass: "secret"})
+	srv.HandlerFunc("echo", CommandHandler{Handler: func(w IWriter, args []Value) Result {
+		w.WriteBulkString(args[0].String())
+		return ResultOK
+	}, arity: 2})
+
+	conn.Write([]byte("GET k\r\nAUTH secret\r\nGET\r\nECHO hi\r\n"))
+
+	rd := bufio.NewReader(conn)
+	for _, want := range []string{
+		"-NOAUTH Authentication required.\r\n",
+		"+OK\r\n",
+		"-ERR wrong number of arguments for 'get' command\r\n",
+		"$2\r\n",
+		"hi\r\n",
+	} {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Fatalf("expected %q, got %q", want, line)
+		}
+	}
+}
+
+func TestGnetInterceptor(t *testing.T) {
+	srv, conn := startGServer(t, nil)
+	srv.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+		if ctx.Name == "DEL" {
+			return ctx.Reject("ERR DEL is disabled")
+		}
+		return next()
+	})
+
+	conn.Write([]byte("DEL k\r\nPING\r\n"))
+
+	rd := bufio.NewReader(conn)
+	for _, want := range []string{"-ERR DEL is disabled\r\n", "+PONG\r\n"} {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Fatalf("expected %q, got %q", want, line)
+		}
+	}
+}
+
+func TestGConnDecodeChunks(t *testing.T) {
+	src := bytes.NewReader(nil)
+	rd := bufio.NewReaderSize(src, readBufferSize)
+	c := &gConn{src: src, rd: rd, resp: NewResp(rd)}
+
+	big := bytes.Repeat([]byte{'x'}, 1<<20)
+	stream := []byte("*1\r\n$4\r\nPING\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(big)) + "\r\n")
+	stream = append(stream, big...)
+	stream = append(stream, "\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"...)
+
+	// feed the stream the way gnet buffers it, keeping what decode left
+	var buf []byte
+	var reqs []gRequest
+	for len(stream) > 0 {
+		n := min(1000, len(stream))
+		buf = append(buf, stream[:n]...)
+		stream = stream[n:]
+
+		got, consumed, err := c.decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, got...)
+		buf = buf[consumed:]
+	}
+	if len(buf) != 0 {
+		t.Fatalf("expected the whole stream decoded, %d bytes left", len(buf))
+	}
+	if len(reqs) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(reqs))
+	}
+	if v := reqs[2].args[2].String(); len(v) != len(big) {
+		t.Fatalf("expected the %d byte value, got %d bytes", len(big), len(v))
+	}
+	if cmd := reqs[3].args[0].String(); cmd != "GET" {
+		t.Fatalf("expected GET last, got %s", cmd)
+	}
+
+	if _, _, err := c.decode([]byte("*1\r\n$x\r\n")); err == nil || err.Error() != "Protocol error: invalid bulk length" {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
@@ -1,62 +1,253 @@
 package pkg
 
+// cmdFlag describes how a command behaves, COMMAND INFO reports the flags
+// by name.
+type cmdFlag uint16
+
+const (
+	cmdWrite cmdFlag = 1 << iota
+	cmdReadonly
+	// cmdDenyOOM commands may grow the dataset and are refused while used
+	// memory is over maxmemory.
+	cmdDenyOOM
+	cmdFast
+	cmdBlocking
+	cmdPubsub
+	cmdAdmin
+	// cmdNoAuth commands run before the client authenticated.
+	cmdNoAuth
+)
+
+var cmdFlagNames = []struct {
+	flag cmdFlag
+	name string
+}{
+	{cmdWrite, "write"},
+	{cmdReadonly, "readonly"},
+	{cmdDenyOOM, "denyoom"},
+	{cmdAdmin, "admin"},
+	{cmdPubsub, "pubsub"},
+	{cmdBlocking, "blocking"},
+	{cmdFast, "fast"},
+	{cmdNoAuth, "no_auth"},
+}
+
+// keySpec gives the positions of the key arguments, counting the command
+// name as 0: keys run from first to last every step, a negative last
+// counts from the end. A zero first means the command takes no keys.
+type keySpec struct {
+	first, last, step int
+}
+
+// Result is what a handler reports to the dispatcher once it has written
+// its reply.
+type Result uint8
+
+const (
+	// ResultOK means the command ran. Write commands are persisted if
+	// they marked changes, see Client.MarkDirty.
+	ResultOK Result = iota
+	// ResultError means the handler replied with an error. The connection
+	// stays open.
+	ResultError
+	// ResultClose closes the connection once the reply is written.
+	ResultClose
+)
+
 type CommandHandler struct {
-	Handler func(IWriter, []Value) bool
-	persist bool
+	Handler func(IWriter, []Value) Result
+	// arity counts the command name like Redis does: N means exactly N
+	// arguments, -N at least N. 0 leaves the check to the handler.
+	arity int
+	flags cmdFlag
+	keys  keySpec
+	// getkeys finds the keys of commands whose keys can't be told by
+	// position alone, such as SORT ... STORE.
+	getkeys func(argv []Value) []int
+
+	// group, since and summary are reported by COMMAND DOCS. The group
+	// also gives the ACL category of the command.
+	group   string
+	since   string
+	summary string
 }
 
 func (h *CommandHandler) should_persist() bool {
-	return h.persist
+	return h.flags&cmdWrite != 0
+}
+
+func (h *CommandHandler) deny_oom() bool {
+	return h.flags&cmdDenyOOM != 0
 }
 
-func (h *CommandHandler) call(w IWriter, args []Value) bool {
+// arityOK reports whether a request of argc words, the command name
+// included, has the number of arguments the command expects.
+func (h *CommandHandler) arityOK(argc int) bool {
+	if h.arity >= 0 {
+		return h.arity == 0 || argc == h.arity
+	}
+	return argc >= -h.arity
+}
+
+// keyPositions returns the indexes in argv, the command name included, of
+// the key arguments.
+func (h *CommandHandler) keyPositions(argv []Value) []int {
+	if h.getkeys != nil {
+		return h.getkeys(argv)
+	}
+	if h.keys.first == 0 {
+		return nil
+	}
+	last := h.keys.last
+	if last < 0 {
+		last += len(argv)
+	}
+	var pos []int
+	for i := h.keys.first; i <= last && i < len(argv); i += h.keys.step {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+func (h *CommandHandler) call(w IWriter, args []Value) Result {
 	return h.Handler(w, args)
 }
 
 var defaultHandlers = map[string]CommandHandler{
 	// Connection
-	"PING": {Handler: pingHandler, persist: false},
+	"PING": {Handler: pingHandler, arity: -1, flags: cmdFast,
+		group: "connection", since: "1.0.0", summary: "Returns the server's liveliness response."},
+	"HELLO": {Handler: HelloHandler, arity: -1, flags: cmdFast | cmdNoAuth,
+		group: "connection", since: "6.0.0", summary: "Handshakes with the Redis server."},
+	"AUTH": {Handler: AuthHandler, arity: -2, flags: cmdFast | cmdNoAuth,
+		group: "connection", since: "1.0.0", summary: "Authenticates the connection."},
+	"QUIT": {Handler: quitHandler, arity: -1, flags: cmdFast | cmdNoAuth,
+		group: "connection", since: "1.0.0", summary: "Closes the connection."},
+	"CLIENT": {Handler: ClientHandler, arity: -2,
+		group: "connection", since: "2.4.0", summary: "A container for client connection commands."},
+
+	// Server
+	"BGREWRITEAOF": {Handler: BgRewriteAofHandler, arity: 1, flags: cmdAdmin,
+		group: "server", since: "1.0.0", summary: "Asynchronously rewrites the append-only file to disk."},
+	"BGSAVE": {Handler: BgSaveHandler, arity: -1, flags: cmdAdmin,
+		group: "server", since: "1.0.0", summary: "Asynchronously saves the database(s) to disk."},
+	"COMMAND": {Handler: commandHandler, arity: -1,
+		group: "server", since: "2.8.13", summary: "Returns detailed information about all commands."},
+	"INFO": {Handler: InfoHandler, arity: -1,
+		group: "server", since: "1.0.0", summary: "Returns information and statistics about the server."},
+	"LASTSAVE": {Handler: LastSaveHandler, arity: 1, flags: cmdFast,
+		group: "server", since: "1.0.0", summary: "Returns the Unix timestamp of the last successful save to disk."},
+	"SAVE": {Handler: SaveHandler, arity: 1, flags: cmdAdmin,
+		group: "server", since: "1.0.0", summary: "Synchronously saves the database(s) to disk."},
+	"OBJECT": {Handler: ObjectHandler, arity: -2, flags: cmdReadonly, keys: keySpec{2, 2, 1},
+		group: "generic", since: "2.2.3", summary: "A container for object introspection commands."},
+	"MEMORY": {Handler: MemoryHandler, arity: -2, flags: cmdReadonly, keys: keySpec{2, 2, 1},
+		group: "server", since: "4.0.0", summary: "A container for memory diagnostics commands."},
 
 	// String
-	"SET":    {Handler: SetHandler, persist: true},
-	"GET":    {Handler: GetHandler, persist: false},
-	"DEL":    {Handler: DelHandler, persist: true},
-	"EXISTS": {Handler: ExistsHandler, persist: false},
+	"SET": {Handler: SetHandler, arity: 3, flags: cmdWrite | cmdDenyOOM, keys: keySpec{1, 1, 1},
+		group: "string", since: "1.0.0", summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist."},
+	"GET": {Handler: GetHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "string", since: "1.0.0", summary: "Returns the string value of a key."},
+	"DEL": {Handler: DelHandler, arity: -2, flags: cmdWrite, keys: keySpec{1, -1, 1},
+		group: "generic", since: "1.0.0", summary: "Deletes one or more keys."},
+	"EXISTS": {Handler: ExistsHandler, arity: -2, flags: cmdReadonly | cmdFast, keys: keySpec{1, -1, 1},
+		group: "generic", since: "1.0.0", summary: "Determines whether one or more keys exist."},
+
+	// Keyspace
+	"EXPIRE": {Handler: ExpireHandler, arity: 3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "1.0.0", summary: "Sets the expiration time of a key in seconds."},
+	"PEXPIRE": {Handler: PExpireHandler, arity: 3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.6.0", summary: "Sets the expiration time of a key in milliseconds."},
+	"EXPIREAT": {Handler: ExpireAtHandler, arity: 3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "1.2.0", summary: "Sets the expiration time of a key to a Unix timestamp."},
+	"PEXPIREAT": {Handler: PExpireAtHandler, arity: 3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.6.0", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	"TTL": {Handler: TTLHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "1.0.0", summary: "Returns the expiration time in seconds of a key."},
+	"PTTL": {Handler: PTTLHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.6.0", summary: "Returns the expiration time in milliseconds of a key."},
+	"PERSIST": {Handler: PersistHandler, arity: 2, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.2.0", summary: "Removes the expiration time of a key."},
+	"DUMP": {Handler: DumpHandler, arity: 2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.6.0", summary: "Returns a serialized representation of the value stored at a key."},
+	"RESTORE": {Handler: RestoreHandler, arity: -4, flags: cmdWrite | cmdDenyOOM, keys: keySpec{1, 1, 1},
+		group: "generic", since: "2.6.0", summary: "Creates a key from the serialized representation of a value."},
+	"SORT": {Handler: SortHandler, arity: -2, flags: cmdWrite | cmdDenyOOM, keys: keySpec{1, 1, 1}, getkeys: sortGetKeys,
+		group: "generic", since: "1.0.0", summary: "Sorts the elements in a list, a set, or a sorted set, optionally storing the result."},
+	"SORT_RO": {Handler: SortROHandler, arity: -2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "generic", since: "7.0.0", summary: "Returns the sorted elements of a list, a set, or a sorted set."},
 
 	// Hash
-	"HSET":    {Handler: HSetHandler, persist: true},
-	"HGET":    {Handler: HGetHandler, persist: false},
-	"HGETALL": {Handler: HGetAllHandler, persist: false},
-	"HDEL":    {Handler: HDelHandler, persist: true},
-	"HLEN":    {Handler: HLenHandler, persist: false},
-	"HKEYS":   {Handler: HKeysHandler, persist: false},
-	"HVALS":   {Handler: HValsHandler, persist: false},
+	"HSET": {Handler: HSetHandler, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdFast, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Creates or modifies the value of a field in a hash."},
+	"HGET": {Handler: HGetHandler, arity: 3, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Returns the value of a field in a hash."},
+	"HGETALL": {Handler: HGetAllHandler, arity: 2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Returns all fields and values in a hash."},
+	"HDEL": {Handler: HDelHandler, arity: -3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain."},
+	"HLEN": {Handler: HLenHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Returns the number of fields in a hash."},
+	"HKEYS": {Handler: HKeysHandler, arity: 2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Returns all fields in a hash."},
+	"HVALS": {Handler: HValsHandler, arity: 2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "hash", since: "2.0.0", summary: "Returns all values in a hash."},
 
 	// List
-	"LPUSH":  {Handler: LPushHandler, persist: true},
-	"RPUSH":  {Handler: RPushHandler, persist: true},
-	"LPOP":   {Handler: LPopHandler, persist: true},
-	"RPOP":   {Handler: RPopHandler, persist: true},
-	"LRANGE": {Handler: LRangeHandler, persist: false},
-	"LLEN":   {Handler: LLenHandler, persist: false},
-	"LTRIM":  {Handler: LTrimHandler, persist: true},
+	"LPUSH": {Handler: LPushHandler, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist."},
+	"RPUSH": {Handler: RPushHandler, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Appends one or more elements to a list. Creates the key if it doesn't exist."},
+	"LPOP": {Handler: LPopHandler, arity: 2, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Returns the first element in a list after removing it. Deletes the list if the last element was popped."},
+	"RPOP": {Handler: RPopHandler, arity: 2, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Returns and removes the last element of the list. Deletes the list if the last element was popped."},
+	"LRANGE": {Handler: LRangeHandler, arity: 4, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Returns a range of elements from a list."},
+	"LLEN": {Handler: LLenHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Returns the length of a list."},
+	"LTRIM": {Handler: LTrimHandler, arity: 4, flags: cmdWrite, keys: keySpec{1, 1, 1},
+		group: "list", since: "1.0.0", summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed."},
 
 	// Set
-	"SADD":        {Handler: SAddHandler, persist: true},
-	"SCARD":       {Handler: SCardHandler, persist: false},
-	"SMEMBERS":    {Handler: SMembersHandler, persist: false},
-	"SREM":        {Handler: SRemHandler, persist: true},
-	"SPOP":        {Handler: SPopHandler, persist: true},
-	"SISMEMBER":   {Handler: SIsMemberHandler, persist: false},
-	"SRANDMEMBER": {Handler: SRandMemberHandler, persist: false},
+	"SADD": {Handler: SAddHandler, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Adds one or more members to a set. Creates the key if it doesn't exist."},
+	"SCARD": {Handler: SCardHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Returns the number of members in a set."},
+	"SMEMBERS": {Handler: SMembersHandler, arity: 2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Returns all members of a set."},
+	"SREM": {Handler: SRemHandler, arity: -3, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Removes one or more members from a set. Deletes the set if the last member was removed."},
+	"SPOP": {Handler: SPopHandler, arity: 2, flags: cmdWrite | cmdFast, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Returns a random member from a set after removing it. Deletes the set if the last member was popped."},
+	"SISMEMBER": {Handler: SIsMemberHandler, arity: 3, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Determines whether a member belongs to a set."},
+	"SRANDMEMBER": {Handler: SRandMemberHandler, arity: -2, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "set", since: "1.0.0", summary: "Get one or multiple random members from a set."},
+
+	// Sorted Set
+	"ZADD": {Handler: ZAddHandler, arity: -4, flags: cmdWrite | cmdDenyOOM | cmdFast, keys: keySpec{1, 1, 1},
+		group: "sorted-set", since: "1.2.0", summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist."},
+	"ZRANGE": {Handler: ZRangeHandler, arity: -4, flags: cmdReadonly, keys: keySpec{1, 1, 1},
+		group: "sorted-set", since: "1.2.0", summary: "Returns members in a sorted set within a range of indexes."},
+	"ZSCORE": {Handler: ZScoreHandler, arity: 3, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "sorted-set", since: "1.2.0", summary: "Returns the score of a member in a sorted set."},
+	"ZCARD": {Handler: ZCardHandler, arity: 2, flags: cmdReadonly | cmdFast, keys: keySpec{1, 1, 1},
+		group: "sorted-set", since: "1.2.0", summary: "Returns the number of members in a sorted set."},
 }
 
-func pingHandler(w IWriter, args []Value) bool {
+func pingHandler(w IWriter, args []Value) Result {
 	resp := "PONG"
 	if len(args) > 0 {
 		resp = args[0].String()
 	}
 
 	w.WriteSimpleString(resp)
-	return true
+	return ResultOK
+}
+
+func quitHandler(w IWriter, args []Value) Result {
+	w.WriteSimpleString("OK")
+	return ResultClose
 }
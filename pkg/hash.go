@@ -2,94 +2,91 @@ package pkg
 
 import (
 	"fmt"
-	"sync"
 )
 
 type hash map[string]string
 
-func HSetHandler(w IWriter, args []Value) bool {
-	if len(args) != 3 {
-		w.WriteError("ERR wrong number of arguments for 'hset' command")
-		return false
-	}
-
+func HSetHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	field := args[1].String()
 	value := args[2].String()
 
-	dbMu.Lock()
-	if _, ok := db[key]; ok {
-		if db[key].typ != _Hash {
+	added := 1
+	sh := db.shard(key)
+	sh.Lock()
+	if e, ok := sh.lookupWrite(key); ok {
+		if e.typ != _Hash {
 			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
+			sh.Unlock()
+			return ResultError
+		}
+		e.Lock()
+		e.cow()
+		h := e.value.(hash)
+		if old, ok := h[field]; ok {
+			e.grow(int64(len(value) - len(old)))
+			added = 0
+		} else {
+			e.grow(hashFieldSize(field, value))
 		}
-		db[key].Lock()
-		db[key].value.(hash)[field] = value
-		db[key].Unlock()
+		h[field] = value
+		e.Unlock()
 	} else {
-		db[key] = &entry{_Hash, hash{field: value}, sync.RWMutex{}}
+		sh.add(key, newEntry(_Hash, hash{field: value}))
 	}
-	dbMu.Unlock()
-	w.WriteInteger(1)
-	return true
+	sh.Unlock()
+	markDirty(w, 1)
+	w.WriteInteger(added)
+	return ResultOK
 }
 
-func HGetHandler(w IWriter, args []Value) bool {
-	if len(args) != 2 {
-		w.WriteError("ERR wrong number of arguments for 'hget' command")
-		return false
-	}
-
+func HGetHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	field := args[1].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteNull()
-		return true
+		return ResultOK
 	}
 	e.RLock()
 	if e.typ != _Hash {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		e.RUnlock()
-		return false
+		return ResultError
 	}
 
 	value, ok := e.value.(hash)[field]
 	e.RUnlock()
 	if !ok {
 		w.WriteNull()
-		return true
+		return ResultOK
 	}
 
 	w.WriteBulkString(value)
-	return true
+	return ResultOK
 }
 
-func HGetAllHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'hgetall' command")
-		return false
-	}
-
+func HGetAllHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	hashEntry, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	hashEntry, ok := sh.lookup(key)
+	sh.RUnlock()
 	if !ok {
-		w.WriteNull()
-		return true
+		w.WriteMap(Value{typ: MAP, array: []Value{}})
+		return ResultOK
 	}
 	hashEntry.RLock()
 	if hashEntry.typ != _Hash {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		hashEntry.RUnlock()
-		return false
+		return ResultError
 	}
 	hashV := hashEntry.value.(hash)
 	values := make([]Value, 0, len(hashV)*2)
@@ -97,88 +94,99 @@ func HGetAllHandler(w IWriter, args []Value) bool {
 		values = append(values, BulkString(field), BulkString(value))
 	}
 
-	err := w.WriteArray(Value{typ: ARRAY, array: values})
+	hashEntry.RUnlock()
+
+	err := w.WriteMap(Value{typ: MAP, array: values})
 	if err != nil {
-		fmt.Printf("write array failed: %v\n", err)
+		fmt.Printf("write map failed: %v\n", err)
 	}
-	return true
+	return ResultOK
 }
 
-func HDelHandler(w IWriter, args []Value) bool {
-	if len(args) < 2 {
-		w.WriteError("ERR wrong number of arguments for 'hdel' command")
-		return false
-	}
-
+func HDelHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	fields := make([]string, 0, len(args)-1)
 	for _, arg := range args[1:] {
 		fields = append(fields, arg.String())
 	}
 
-	dbMu.RLock()
-	hashEntry, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	hashEntry, ok := sh.lookupWrite(key)
 	if !ok {
-		dbMu.RUnlock()
+		sh.Unlock()
 		w.WriteInteger(0)
-		return true
+		return ResultOK
+	}
+	if hashEntry.typ != _Hash {
+		sh.Unlock()
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
 	}
-	dbMu.RUnlock()
 	var count int
 	hashEntry.Lock()
+	hashEntry.cow()
 	hashV := hashEntry.value.(hash)
 	for _, field := range fields {
-		if _, ok := hashV[field]; ok {
+		if value, ok := hashV[field]; ok {
 			delete(hashV, field)
+			hashEntry.grow(-hashFieldSize(field, value))
 			count++
 		}
 	}
+	if len(hashV) == 0 {
+		sh.remove(key)
+	}
 	hashEntry.Unlock()
+	sh.Unlock()
+	markDirty(w, count)
 	w.WriteInteger(count)
-	return true
+	return ResultOK
 }
 
-func HLenHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'hlen' command")
-		return false
-	}
-
+func HLenHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	hashEntry, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	hashEntry, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteInteger(0)
-		return true
+		return ResultOK
 	}
 
 	hashEntry.RLock()
+	if hashEntry.typ != _Hash {
+		hashEntry.RUnlock()
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
 	w.WriteInteger(len(hashEntry.value.(hash)))
 	hashEntry.RUnlock()
-	return true
+	return ResultOK
 }
 
-func HKeysHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'hkeys' command")
-		return false
-	}
-
+func HKeysHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	hashEntry, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	hashEntry, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteNull()
-		return true
+		return ResultOK
 	}
 
 	hashEntry.RLock()
+	if hashEntry.typ != _Hash {
+		hashEntry.RUnlock()
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
 	hashV := hashEntry.value.(hash)
 	values := make([]Value, 0, len(hashV))
 	for field := range hashV {
@@ -189,27 +197,28 @@ func HKeysHandler(w IWriter, args []Value) bool {
 	if err != nil {
 		fmt.Printf("write array failed: %v\n", err)
 	}
-	return true
+	return ResultOK
 }
 
-func HValsHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'hvals' command")
-		return false
-	}
-
+func HValsHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	hashEntry, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	hashEntry, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteNull()
-		return true
+		return ResultOK
 	}
 
 	hashEntry.RLock()
+	if hashEntry.typ != _Hash {
+		hashEntry.RUnlock()
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
 	hashV := hashEntry.value.(hash)
 	values := make([]Value, 0, len(hashV))
 	for _, value := range hashV {
@@ -221,5 +230,5 @@ func HValsHandler(w IWriter, args []Value) bool {
 	if err != nil {
 		fmt.Printf("write array failed: %v\n", err)
 	}
-	return true
+	return ResultOK
 }
@@ -3,5 +3,34 @@ package pkg
 import "testing"
 
 func TestHDel(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	runCommand(t, d, 2, "HSET", "hdel:h", "a", "1")
+	runCommand(t, d, 2, "HSET", "hdel:h", "b", "2")
 
+	if got := runCommand(t, d, 2, "HDEL", "hdel:h", "a", "x"); got != ":1\r\n" {
+		t.Fatalf("expected 1 field removed, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "HDEL", "hdel:h", "b"); got != ":1\r\n" {
+		t.Fatalf("expected 1 field removed, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "EXISTS", "hdel:h"); got != ":0\r\n" {
+		t.Fatalf("expected the emptied hash to be removed, got %q", got)
+	}
+}
+
+func TestHashWrongType(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	runCommand(t, d, 2, "SET", "hwrong:s", "v")
+	defer runCommand(t, d, 2, "DEL", "hwrong:s")
+
+	for _, args := range [][]string{
+		{"HDEL", "hwrong:s", "f"},
+		{"HLEN", "hwrong:s"},
+		{"HKEYS", "hwrong:s"},
+		{"HVALS", "hwrong:s"},
+	} {
+		if got := runCommand(t, d, 2, args...); got != "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" {
+			t.Fatalf("%v: expected WRONGTYPE, got %q", args, got)
+		}
+	}
 }
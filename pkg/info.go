@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// infoSections are the INFO sections in the order they are reported.
+var infoSections = []struct {
+	name string
+	fn   func(d *dispatcher, b *strings.Builder)
+}{
+	{"server", infoServer},
+	{"memory", infoMemory},
+	{"persistence", infoPersistence},
+	{"stats", infoStats},
+	{"commandstats", infoCommandStats},
+}
+
+func infoServer(d *dispatcher, b *strings.Builder) {
+	fmt.Fprintf(b, "redis_version:%s\r\n", redisVersion)
+}
+
+func infoMemory(d *dispatcher, b *strings.Builder) {
+	maxMemory, policy := int64(0), noEviction
+	if d.evictor != nil {
+		maxMemory, policy = d.evictor.maxMemory, d.evictor.policy
+	}
+	fmt.Fprintf(b, "used_memory:%d\r\n", usedMemory.Load())
+	fmt.Fprintf(b, "maxmemory:%d\r\n", maxMemory)
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", policy)
+}
+
+func infoPersistence(d *dispatcher, b *strings.Builder) {
+	b.WriteString("loading:0\r\n")
+	d.saveMu.Lock()
+	bgsaving := d.saving != nil && d.bgsaving
+	bgsaveStatus := "ok"
+	if d.lastBgsaveErr != nil {
+		bgsaveStatus = "err"
+	}
+	d.saveMu.Unlock()
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", d.dirty.Load())
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", bool2int(bgsaving))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", d.lastSave.Load())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", bgsaveStatus)
+	if d.Aof == nil {
+		b.WriteString("aof_enabled:0\r\n")
+		return
+	}
+	status := "ok"
+	if d.Aof.lastSyncErr() != nil {
+		status = "err"
+	}
+	rewriteStatus := "ok"
+	d.Aof.mu.Lock()
+	rewriting, size, baseSize := d.Aof.rewriting, d.Aof.size, d.Aof.baseSize
+	if d.Aof.lastRewriteErr != nil {
+		rewriteStatus = "err"
+	}
+	d.Aof.mu.Unlock()
+
+	b.WriteString("aof_enabled:1\r\n")
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", bool2int(rewriting))
+	fmt.Fprintf(b, "aof_last_bgrewrite_status:%s\r\n", rewriteStatus)
+	fmt.Fprintf(b, "aof_fsync:%s\r\n", d.Aof.fsync)
+	fmt.Fprintf(b, "aof_last_write_status:%s\r\n", status)
+	// how long the oldest append not yet on disk has been waiting
+	fmt.Fprintf(b, "aof_fsync_lag_ms:%d\r\n", d.Aof.FsyncLag().Milliseconds())
+	fmt.Fprintf(b, "aof_current_size:%d\r\n", size)
+	fmt.Fprintf(b, "aof_base_size:%d\r\n", baseSize)
+}
+
+func infoStats(d *dispatcher, b *strings.Builder) {
+	fmt.Fprintf(b, "total_connections_received:%d\r\n", d.connections.Load())
+	fmt.Fprintf(b, "total_commands_processed:%d\r\n", d.commands.Load())
+	fmt.Fprintf(b, "evicted_keys:%d\r\n", evictedKeys.Load())
+}
+
+func infoCommandStats(d *dispatcher, b *strings.Builder) {
+	for _, name := range d.commandNames() {
+		v, ok := d.cmdstats.Load(name)
+		if !ok {
+			continue
+		}
+		stats := v.(*commandStats)
+		calls, usec := stats.calls.Load(), stats.usec.Load()
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n",
+			strings.ToLower(name), calls, usec, float64(usec)/float64(calls))
+	}
+}
+
+// InfoHandler implements INFO [section ...].
+func InfoHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR INFO is not supported on this connection")
+		return ResultError
+	}
+
+	all := len(args) == 0
+	want := make(map[string]bool)
+	for _, arg := range args {
+		section := strings.ToLower(arg.String())
+		switch section {
+		case "all", "everything", "default":
+			all = true
+		}
+		want[section] = true
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !want[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		section.fn(c.srv, &b)
+	}
+	w.WriteVerbatim("txt", b.String())
+	return ResultOK
+}
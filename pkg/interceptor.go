@@ -0,0 +1,151 @@
+package pkg
+
+import "time"
+
+// CommandContext is a command on its way through the interceptors. Reply
+// and Latency are set once the handler has run.
+type CommandContext struct {
+	Client *Client
+	// Name is the upper-case command name.
+	Name string
+	// Args are the arguments after the command name, not checked against
+	// the arity yet. An interceptor may rewrite them before calling next.
+	Args []Value
+
+	Reply   Value
+	Latency time.Duration
+
+	ran bool // the handler was reached
+}
+
+// Reject replies with the error msg, for interceptors that stop a command
+// without calling next.
+func (ctx *CommandContext) Reject(msg string) Result {
+	ctx.Client.WriteError(msg)
+	return ResultError
+}
+
+// Interceptor wraps the execution of every command. It calls next to run
+// the rest of the chain and the handler, or returns without calling it
+// to short-circuit the command.
+type Interceptor func(ctx *CommandContext, next func() Result) Result
+
+// InterceptFunc appends f to the interceptor chain. Interceptors run in
+// the order they are added, around the built-in unknown command, NOAUTH,
+// arity and OOM checks, so they see the commands those reject too.
+func (d *dispatcher) InterceptFunc(f Interceptor) {
+	d.Lock()
+	defer d.Unlock()
+	d.interceptors = append(d.interceptors, f)
+}
+
+// run calls inner, which checks and runs the command, through the
+// interceptor chain.
+func (d *dispatcher) run(ctx *CommandContext, inner func() Result) Result {
+	d.RLock()
+	chain := d.interceptors
+	d.RUnlock()
+
+	if len(chain) == 0 {
+		return inner()
+	}
+
+	// record the reply while the interceptors run
+	rec := &replyRecorder{IWriter: ctx.Client.IWriter}
+	ctx.Client.IWriter = rec
+	defer func() { ctx.Client.IWriter = rec.IWriter }()
+
+	var next func(i int) Result
+	next = func(i int) Result {
+		if i == len(chain) {
+			res := inner()
+			ctx.Reply = rec.reply
+			return res
+		}
+		return chain[i](ctx, func() Result { return next(i + 1) })
+	}
+	return next(0)
+}
+
+func (ctx *CommandContext) call(handler *CommandHandler) Result {
+	start := time.Now()
+	res := handler.call(ctx.Client, ctx.Args)
+	ctx.Latency = time.Since(start)
+	ctx.ran = true
+	return res
+}
+
+// replyRecorder keeps a copy of the last reply written through it.
+type replyRecorder struct {
+	IWriter
+	reply Value
+}
+
+func (r *replyRecorder) WriteSimpleString(str string) error {
+	r.reply = SimpleString(str)
+	return r.IWriter.WriteSimpleString(str)
+}
+
+func (r *replyRecorder) WriteError(str string) error {
+	r.reply = Value{typ: ERROR, str: str}
+	return r.IWriter.WriteError(str)
+}
+
+func (r *replyRecorder) WriteInteger(i int) error {
+	r.reply = IntegerValue(i)
+	return r.IWriter.WriteInteger(i)
+}
+
+func (r *replyRecorder) WriteBulkString(str string) error {
+	r.reply = BulkString(str)
+	return r.IWriter.WriteBulkString(str)
+}
+
+func (r *replyRecorder) WriteNull() error {
+	r.reply = NullBulk()
+	return r.IWriter.WriteNull()
+}
+
+func (r *replyRecorder) WriteArray(value Value) error {
+	r.reply = value
+	r.reply.typ = ARRAY
+	return r.IWriter.WriteArray(value)
+}
+
+func (r *replyRecorder) WriteMap(value Value) error {
+	r.reply = value
+	r.reply.typ = MAP
+	return r.IWriter.WriteMap(value)
+}
+
+func (r *replyRecorder) WriteSet(value Value) error {
+	r.reply = value
+	r.reply.typ = SET
+	return r.IWriter.WriteSet(value)
+}
+
+func (r *replyRecorder) WritePush(value Value) error {
+	r.reply = value
+	r.reply.typ = PUSH
+	return r.IWriter.WritePush(value)
+}
+
+func (r *replyRecorder) WriteDouble(f float64) error {
+	r.reply = DoubleValue(f)
+	return r.IWriter.WriteDouble(f)
+}
+
+func (r *replyRecorder) WriteBoolean(b bool) error {
+	r.reply = Value{typ: BOOLEAN, boolean: b}
+	return r.IWriter.WriteBoolean(b)
+}
+
+func (r *replyRecorder) WriteBigNumber(str string) error {
+	r.reply = Value{typ: BIGNUMBER, str: str}
+	return r.IWriter.WriteBigNumber(str)
+}
+
+func (r *replyRecorder) WriteVerbatim(format, str string) error {
+	r.reply = Value{typ: VERBATIM, str: format + ":" + str}
+	return r.IWriter.WriteVerbatim(format, str)
+}
@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInterceptorReject(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	d.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+		if ctx.Name == "SET" && strings.HasPrefix(ctx.Args[0].String(), "other:") {
+			return ctx.Reject("ERR tenant denied")
+		}
+		return next()
+	})
+
+	buf := &bytes.Buffer{}
+	client := d.newClient(NewWriter(buf))
+	d.exec(client, []Value{BulkString("SET"), BulkString("other:k"), BulkString("v")})
+	if want := "-ERR tenant denied\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	d.exec(client, []Value{BulkString("EXISTS"), BulkString("other:k")})
+	if want := ":0\r\n"; buf.String() != want {
+		t.Fatalf("expected the rejected SET not to run, got %q", buf.String())
+	}
+	if _, ok := d.cmdstats.Load("SET"); ok {
+		t.Fatal("expected the rejected SET not to be counted")
+	}
+}
+
+func TestInterceptorSeesRejectedCommands(t *testing.T) {
+	d := mustDispatcher(t, &Config{RequirePass: "secret"})
+	var seen []*CommandContext
+	d.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+		res := next()
+		seen = append(seen, ctx)
+		return res
+	})
+
+	buf := &bytes.Buffer{}
+	client := d.newClient(NewWriter(buf))
+	d.exec(client, []Value{BulkString("GET"), BulkString("intercept:k")})
+	if want := "-NOAUTH Authentication required.\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+	if len(seen) != 1 || seen[0].Name != "GET" {
+		t.Fatalf("expected the interceptor to see the rejected GET, got %d commands", len(seen))
+	}
+	if seen[0].Reply.typ != ERROR || !strings.HasPrefix(seen[0].Reply.String(), "NOAUTH") {
+		t.Fatalf("expected the NOAUTH reply, got %v", seen[0].Reply)
+	}
+	if _, ok := d.cmdstats.Load("GET"); ok {
+		t.Fatal("expected the rejected GET not to be counted")
+	}
+}
+
+func TestInterceptorSeesReply(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	var seen []*CommandContext
+	d.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+		res := next()
+		seen = append(seen, ctx)
+		return res
+	})
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	d.exec(client, []Value{BulkString("set"), BulkString("intercept:k"), BulkString("v")})
+	d.exec(client, []Value{BulkString("GET"), BulkString("intercept:k")})
+
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(seen))
+	}
+	if seen[0].Name != "SET" || len(seen[0].Args) != 2 || seen[0].Args[0].String() != "intercept:k" {
+		t.Fatalf("unexpected command %s %v", seen[0].Name, seen[0].Args)
+	}
+	if seen[0].Reply.typ != STRING || seen[0].Reply.String() != "OK" {
+		t.Fatalf("expected +OK, got %v", seen[0].Reply)
+	}
+	if seen[1].Reply.typ != BULK || seen[1].Reply.String() != "v" {
+		t.Fatalf("expected $v, got %v", seen[1].Reply)
+	}
+	if seen[0].Latency < 0 {
+		t.Fatalf("negative latency %v", seen[0].Latency)
+	}
+	if _, ok := client.IWriter.(*replyRecorder); ok {
+		t.Fatal("expected the client writer to be restored")
+	}
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	var order []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		d.InterceptFunc(func(ctx *CommandContext, next func() Result) Result {
+			order = append(order, name+">")
+			res := next()
+			order = append(order, "<"+name)
+			return res
+		})
+	}
+
+	d.exec(d.newClient(NewWriter(&bytes.Buffer{})), []Value{BulkString("PING")})
+	if got := strings.Join(order, " "); got != "first> second> <second <first" {
+		t.Fatalf("unexpected order %q", got)
+	}
+}
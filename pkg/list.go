@@ -1,178 +1,168 @@
 package pkg
 
 import (
-	. "container/list"
 	"strconv"
-	"sync"
 )
 
-type list = *List
-
-func LPushHandler(w IWriter, args []Value) bool {
-	if len(args) < 2 {
-		w.WriteError("ERR wrong number of arguments for 'lpush' command")
-		return false
-	}
-
+func LPushHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	values := args[1:]
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	var n int
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if ok {
 		if e.typ != _List {
 			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
+			sh.Unlock()
+			return ResultError
 		}
 		e.Lock()
+		e.cow()
 		lst := e.value.(*qlist)
+		var delta int64
 		for _, v := range values {
 			lst.pushLeft(v.String())
+			delta += listElemSize(v.String())
 		}
+		e.grow(delta)
+		n = lst.len
 		e.Unlock()
 	} else {
 		l := &qlist{}
 		for _, v := range values {
 			l.pushLeft(v.String())
 		}
-		db[key] = &entry{_List, l, sync.RWMutex{}}
+		n = l.len
+		sh.add(key, newEntry(_List, l))
 	}
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, len(values))
 
-	w.WriteInteger(len(values))
-	return true
+	w.WriteInteger(n)
+	return ResultOK
 }
 
-func RPushHandler(w IWriter, args []Value) bool {
-	if len(args) < 2 {
-		w.WriteError("ERR wrong number of arguments for 'rpush' command")
-		return false
-	}
-
+func RPushHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	values := args[1:]
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	var n int
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if ok {
 		if e.typ != _List {
 			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
+			sh.Unlock()
+			return ResultError
 		}
 		e.Lock()
+		e.cow()
 		lst := e.value.(*qlist)
+		var delta int64
 		for _, v := range values {
 			lst.pushRight(v.String())
+			delta += listElemSize(v.String())
 		}
+		e.grow(delta)
+		n = lst.len
 		e.Unlock()
 	} else {
 		l := &qlist{}
 		for _, v := range values {
 			l.pushRight(v.String())
 		}
-		db[key] = &entry{_List, l, sync.RWMutex{}}
+		n = l.len
+		sh.add(key, newEntry(_List, l))
 	}
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, len(values))
 
-	w.WriteInteger(len(values))
-	return true
+	w.WriteInteger(n)
+	return ResultOK
 }
 
-func LPopHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'lpop' command")
-		return false
-	}
-
+func LPopHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if !ok {
 		w.WriteNull()
-		dbMu.Unlock()
-		return true
+		sh.Unlock()
+		return ResultOK
 	}
 	if e.typ != _List {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.Unlock()
-		return false
+		sh.Unlock()
+		return ResultError
 	}
 	e.Lock()
+	e.cow()
 	lst := e.value.(*qlist)
+	v := lst.popLeft()
+	e.grow(-listElemSize(v))
 	if lst.len == 0 {
-		delete(db, key)
-		w.WriteNull()
-		e.Unlock()
-		dbMu.Unlock()
-		return true
+		sh.remove(key)
 	}
-	v := lst.popLeft()
 	e.Unlock()
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, 1)
 
 	w.WriteBulkString(v)
-	return true
+	return ResultOK
 }
 
-func RPopHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'rpop' command")
-		return false
-	}
-
+func RPopHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if !ok {
 		w.WriteNull()
-		dbMu.Unlock()
-		return true
+		sh.Unlock()
+		return ResultOK
 	}
 	if e.typ != _List {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.Unlock()
-		return false
+		sh.Unlock()
+		return ResultError
 	}
 	e.Lock()
+	e.cow()
 	lst := e.value.(*qlist)
+	v := lst.popRight()
+	e.grow(-listElemSize(v))
 	if lst.len == 0 {
-		delete(db, key)
-		w.WriteNull()
-		e.Unlock()
-		dbMu.Unlock()
-		return true
+		sh.remove(key)
 	}
-	v := lst.popRight()
 	e.Unlock()
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, 1)
 
 	w.WriteBulkString(v)
-	return true
+	return ResultOK
 }
 
-func LLenHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'llen' command")
-		return false
-	}
-
+func LLenHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteInteger(0)
-		return true
+		return ResultOK
 	}
 	if e.typ != _List {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		return false
+		return ResultError
 	}
 
 	e.RLock()
@@ -181,38 +171,34 @@ func LLenHandler(w IWriter, args []Value) bool {
 	e.RUnlock()
 
 	w.WriteInteger(l)
-	return true
+	return ResultOK
 }
 
-func LRangeHandler(w IWriter, args []Value) bool {
-	if len(args) != 3 {
-		w.WriteError("ERR wrong number of arguments for 'lrange' command")
-		return false
-	}
-
+func LRangeHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	start, err := strconv.Atoi(args[1].String())
 	if err != nil {
 		w.WriteError("ERR value is not an integer or out of range")
-		return false
+		return ResultError
 	}
 	stop, err := strconv.Atoi(args[2].String())
 	if err != nil {
 		w.WriteError("ERR value is not an integer or out of range")
-		return false
+		return ResultError
 	}
 
-	dbMu.RLock()
-	e, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteArray(Value{typ: ARRAY, array: []Value{}})
-		return true
+		return ResultOK
 	}
 	if e.typ != _List {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		return false
+		return ResultError
 	}
 
 	e.RLock()
@@ -233,7 +219,7 @@ func LRangeHandler(w IWriter, args []Value) bool {
 	if start >= l {
 		e.RUnlock()
 		w.WriteArray(Value{typ: ARRAY, array: []Value{}})
-		return true
+		return ResultOK
 	}
 	if stop >= l {
 		stop = l - 1
@@ -257,43 +243,40 @@ func LRangeHandler(w IWriter, args []Value) bool {
 	}
 
 	w.WriteArray(Value{typ: ARRAY, array: values})
-	return true
+	return ResultOK
 }
 
-func LTrimHandler(w IWriter, args []Value) bool {
-	if len(args) != 3 {
-		w.WriteError("ERR wrong number of arguments for 'ltrim' command")
-		return false
-	}
-
+func LTrimHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	start, err := strconv.Atoi(args[1].String())
 	if err != nil {
 		w.WriteError("ERR value is not an integer or out of range")
-		return false
+		return ResultError
 	}
 	stop, err := strconv.Atoi(args[2].String())
 	if err != nil {
 		w.WriteError("ERR value is not an integer or out of range")
-		return false
+		return ResultError
 	}
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if !ok {
 		w.WriteSimpleString("OK")
-		dbMu.Unlock()
-		return true
+		sh.Unlock()
+		return ResultOK
 	}
 	if e.typ != _List {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.Unlock()
-		return false
+		sh.Unlock()
+		return ResultError
 	}
 
 	e.Lock()
-	lst := e.value.(list)
-	l := lst.Len()
+	e.cow()
+	lst := e.value.(*qlist)
+	l := lst.len
 	if start < 0 {
 		start = l + start
 	}
@@ -303,31 +286,28 @@ func LTrimHandler(w IWriter, args []Value) bool {
 	if start < 0 {
 		start = 0
 	}
-	if stop < 0 {
-		stop = 0
+	if stop >= l {
+		stop = l - 1
 	}
-	if start >= l {
-		lst.Init()
-		delete(db, key)
+	if start > stop {
+		sh.remove(key)
 		e.Unlock()
-		dbMu.Unlock()
+		sh.Unlock()
+		markDirty(w, l)
 		w.WriteSimpleString("OK")
-		return true
-	}
-	if stop >= l {
-		stop = l - 1
+		return ResultOK
 	}
 
-	i := 0
-	for e := lst.Front(); e != nil; e = e.Next() {
-		if i < start || i > stop {
-			lst.Remove(e)
-		}
-		i++
+	for i := 0; i < start; i++ {
+		e.grow(-listElemSize(lst.popLeft()))
+	}
+	for i := stop + 1; i < l; i++ {
+		e.grow(-listElemSize(lst.popRight()))
 	}
 	e.Unlock()
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, start+l-1-stop)
 
 	w.WriteSimpleString("OK")
-	return true
+	return ResultOK
 }
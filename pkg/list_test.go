@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestLTrim(t *testing.T) {
+	w := NewWriter(io.Discard)
+	RPushHandler(w, []Value{BulkString("ltrim:k"), BulkString("a"), BulkString("b"), BulkString("c"), BulkString("d")})
+
+	c := NewClient(w, "")
+	if res := LTrimHandler(c, []Value{BulkString("ltrim:k"), BulkString("1"), BulkString("-2")}); res != ResultOK {
+		t.Fatalf("expected ResultOK, got %d", res)
+	}
+	if c.dirty != 2 {
+		t.Fatalf("expected 2 changes, got %d", c.dirty)
+	}
+
+	buf := &bytes.Buffer{}
+	LRangeHandler(NewWriter(buf), []Value{BulkString("ltrim:k"), BulkString("0"), BulkString("-1")})
+	if want := "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	c.dirty = 0
+	LTrimHandler(c, []Value{BulkString("ltrim:k"), BulkString("0"), BulkString("-1")})
+	if c.dirty != 0 {
+		t.Fatalf("expected no changes for a trim that keeps everything, got %d", c.dirty)
+	}
+
+	LTrimHandler(w, []Value{BulkString("ltrim:k"), BulkString("5"), BulkString("10")})
+	buf.Reset()
+	ExistsHandler(NewWriter(buf), []Value{BulkString("ltrim:k")})
+	if want := ":0\r\n"; buf.String() != want {
+		t.Fatalf("expected the emptied list to be removed, got %q", buf.String())
+	}
+}
+
+func TestPopRemovesEmptyList(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	runCommand(t, d, 2, "RPUSH", "pop:l", "a", "b")
+	if got := runCommand(t, d, 2, "LPOP", "pop:l"); got != "$1\r\na\r\n" {
+		t.Fatalf("expected a, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "RPOP", "pop:l"); got != "$1\r\nb\r\n" {
+		t.Fatalf("expected b, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "EXISTS", "pop:l"); got != ":0\r\n" {
+		t.Fatalf("expected the emptied list to be removed, got %q", got)
+	}
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// aofFileType is the type of an AOF part as written in the manifest.
+type aofFileType byte
+
+const (
+	aofBase    aofFileType = 'b'
+	aofIncr    aofFileType = 'i'
+	aofHistory aofFileType = 'h'
+)
+
+// aofInfo is one line of the manifest.
+type aofInfo struct {
+	name string
+	seq  int64
+	typ  aofFileType
+}
+
+// aofManifest lists the parts of a multi part AOF like Redis 7 does: the
+// base file written by the last rewrite, the incremental files appended
+// to since, in order, and the history files the rewrite replaced, which
+// are waiting to be deleted.
+type aofManifest struct {
+	base    *aofInfo
+	incrs   []*aofInfo
+	history []*aofInfo
+	// baseSeq and incrSeq are the highest sequence numbers in use
+	baseSeq int64
+	incrSeq int64
+}
+
+// baseFileName names a base file like Redis does, .rdb when it is an RDB
+// preamble without commands after it.
+func baseFileName(name string, seq int64, rdb bool) string {
+	if rdb {
+		return fmt.Sprintf("%s.%d.base.rdb", name, seq)
+	}
+	return fmt.Sprintf("%s.%d.base.aof", name, seq)
+}
+
+func incrFileName(name string, seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", name, seq)
+}
+
+func manifestFileName(name string) string {
+	return name + ".manifest"
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := &aofManifest{baseSeq: m.baseSeq, incrSeq: m.incrSeq}
+	if m.base != nil {
+		base := *m.base
+		c.base = &base
+	}
+	for _, info := range m.incrs {
+		incr := *info
+		c.incrs = append(c.incrs, &incr)
+	}
+	for _, info := range m.history {
+		h := *info
+		c.history = append(c.history, &h)
+	}
+	return c
+}
+
+// nextBase adds a new base file and moves the old one to the history.
+func (m *aofManifest) nextBase(name string, rdb bool) *aofInfo {
+	if m.base != nil {
+		m.base.typ = aofHistory
+		m.history = append(m.history, m.base)
+	}
+	m.baseSeq++
+	m.base = &aofInfo{name: baseFileName(name, m.baseSeq, rdb), seq: m.baseSeq, typ: aofBase}
+	return m.base
+}
+
+// nextIncr adds a new incremental file, the one appended to from now on.
+func (m *aofManifest) nextIncr(name string) *aofInfo {
+	m.incrSeq++
+	info := &aofInfo{name: incrFileName(name, m.incrSeq), seq: m.incrSeq, typ: aofIncr}
+	m.incrs = append(m.incrs, info)
+	return info
+}
+
+// historyIncrs moves every incremental file to the history.
+func (m *aofManifest) historyIncrs() {
+	for _, info := range m.incrs {
+		info.typ = aofHistory
+		m.history = append(m.history, info)
+	}
+	m.incrs = nil
+}
+
+// parts returns the files to load, in order.
+func (m *aofManifest) parts() []*aofInfo {
+	var parts []*aofInfo
+	if m.base != nil {
+		parts = append(parts, m.base)
+	}
+	return append(parts, m.incrs...)
+}
+
+func (m *aofManifest) encode() []byte {
+	var b strings.Builder
+	for _, info := range append(m.parts(), m.history...) {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", info.name, info.seq, info.typ)
+	}
+	return []byte(b.String())
+}
+
+func parseAofManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		args, ok := splitArgs(line)
+		if !ok || len(args)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest line %d", i+1)
+		}
+		info := &aofInfo{}
+		for j := 0; j < len(args); j += 2 {
+			switch args[j] {
+			case "file":
+				info.name = args[j+1]
+			case "seq":
+				seq, err := strconv.ParseInt(args[j+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid aof manifest line %d", i+1)
+				}
+				info.seq = seq
+			case "type":
+				if len(args[j+1]) != 1 {
+					return nil, fmt.Errorf("invalid aof manifest line %d", i+1)
+				}
+				info.typ = aofFileType(args[j+1][0])
+			}
+		}
+		if info.name == "" || strings.ContainsAny(info.name, `/\`) {
+			return nil, fmt.Errorf("invalid aof manifest line %d", i+1)
+		}
+
+		switch info.typ {
+		case aofBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information in the aof manifest")
+			}
+			m.base = info
+			m.baseSeq = info.seq
+		case aofIncr:
+			if info.seq <= m.incrSeq {
+				return nil, errors.New("found a non-monotonic sequence number in the aof manifest")
+			}
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		case aofHistory:
+			m.history = append(m.history, info)
+		default:
+			return nil, fmt.Errorf("unknown aof file type on aof manifest line %d", i+1)
+		}
+	}
+	return m, nil
+}
+
+// loadAofManifest reads the manifest of name in dir. It returns nil and no
+// error when there is none yet.
+func loadAofManifest(dir, name string) (*aofManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAofManifest(data)
+}
+
+// persist atomically replaces the manifest of name in dir with m.
+func (m *aofManifest) persist(dir, name string) error {
+	tmp := filepath.Join(dir, "temp-"+manifestFileName(name))
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(m.encode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestFileName(name))); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// deleteHistory removes the history files and drops them from the
+// manifest.
+func (m *aofManifest) deleteHistory(dir, name string) error {
+	if len(m.history) == 0 {
+		return nil
+	}
+	for _, info := range m.history {
+		if err := os.Remove(filepath.Join(dir, info.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	m.history = nil
+	return m.persist(dir, name)
+}
+
+// syncDir fsyncs dir so renames in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAofManifestRoundTrip(t *testing.T) {
+	m := &aofManifest{}
+	m.nextBase("appendonly.aof", false)
+	m.nextIncr("appendonly.aof")
+	m.nextIncr("appendonly.aof")
+	m.nextBase("appendonly.aof", true)
+
+	want := "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n" +
+		"file appendonly.aof.1.base.aof seq 1 type h\n"
+	if got := string(m.encode()); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	parsed, err := parseAofManifest([]byte(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Fatalf("expected %+v, got %+v", m, parsed)
+	}
+}
+
+func TestAofManifestInvalid(t *testing.T) {
+	for _, data := range []string{
+		"file a.aof seq 1\n",
+		"file a.aof seq x type b\n",
+		"file a.aof seq 1 type x\n",
+		"file ../a.aof seq 1 type b\n",
+		"file a.aof seq 1 type b\nfile b.aof seq 2 type b\n",
+		"file a.aof seq 2 type i\nfile b.aof seq 1 type i\n",
+	} {
+		if _, err := parseAofManifest([]byte(data)); err == nil {
+			t.Fatalf("expected an error for %q", data)
+		}
+	}
+}
+
+func TestAofLoadsPartsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	set := func(v string) string {
+		b, _ := ArrayValue(BulkString("SET"), BulkString("manifest:k"), BulkString(v)).MarshalResp()
+		return string(b)
+	}
+	files := map[string]string{
+		"appendonly.aof.3.base.aof": set("base"),
+		"appendonly.aof.4.incr.aof": set("first"),
+		"appendonly.aof.5.incr.aof": set("second"),
+		"appendonly.aof.manifest": "file appendonly.aof.3.base.aof seq 3 type b\n" +
+			"file appendonly.aof.4.incr.aof seq 4 type i\n" +
+			"file appendonly.aof.5.incr.aof seq 5 type i\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	buf := &bytes.Buffer{}
+	d.exec(d.newClient(NewWriter(buf)), []Value{BulkString("GET"), BulkString("manifest:k")})
+	if want := "$6\r\nsecond\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestAofRewriteSwapsManifest(t *testing.T) {
+	dir := t.TempDir()
+	d := mustDispatcher(t, &Config{EnableAof: true, AofDir: dir})
+	defer d.Aof.Close()
+
+	client := d.newClient(NewWriter(&bytes.Buffer{}))
+	d.exec(client, []Value{BulkString("SET"), BulkString("manifest:swap"), BulkString("v")})
+
+	rw, err := d.bgRewriteAof()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-rw.done
+	if rw.err != nil {
+		t.Fatal(rw.err)
+	}
+	d.exec(client, []Value{BulkString("SET"), BulkString("manifest:after"), BulkString("v")})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	want := []string{"appendonly.aof.2.base.aof", "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+
+	incr, err := os.ReadFile(filepath.Join(dir, "appendonly.aof.2.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(incr, []byte("manifest:after")) || bytes.Contains(incr, []byte("manifest:swap")) {
+		t.Fatalf("expected only the write after the rewrite in the new incr file, got %q", incr)
+	}
+}
+
+func TestAofUpgradesSingleFile(t *testing.T) {
+	parent := t.TempDir()
+	legacy := "*3\r\n$3\r\nSET\r\n$13\r\nmanifest:old\r\n$1\r\nv\r\n"
+	if err := os.WriteFile(filepath.Join(parent, "appendonly.aof"), []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(parent, "appendonlydir")
+	aof, err := NewAof(dir, "", "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	if _, err := os.Stat(filepath.Join(parent, "appendonly.aof")); !os.IsNotExist(err) {
+		t.Fatal("expected the single file AOF to be moved into the directory")
+	}
+	data, err := readAof(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != legacy {
+		t.Fatalf("expected %q, got %q", legacy, data)
+	}
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// usedMemory is the approximate number of bytes held by the keyspace.
+var usedMemory atomic.Int64
+
+// Approximate sizes of the runtime structures behind each value, on a
+// 64-bit platform. They don't have to be exact, only stable enough for
+// maxmemory to behave predictably.
+const (
+	stringHeaderSize = 16
+	mapEntryOverhead = 48 // bucket slot, tophash and amortised growth
+	entryHeaderSize  = 96 // entry struct: lock, interface, clocks
+	qlistHeaderSize  = 24
+	qnodeHeaderSize  = 72
+	zsetHeaderSize   = 64
+	skipNodeSize     = 56
+	skipLevelSize    = 24 // *skipListLevel plus the level it points to
+)
+
+func stringSize(s string) int64 {
+	return stringHeaderSize + int64(len(s))
+}
+
+// keyOverhead is the cost of storing key in the keyspace, regardless of
+// its value.
+func keyOverhead(key string) int64 {
+	return mapEntryOverhead + stringSize(key) + entryHeaderSize
+}
+
+func hashFieldSize(field, value string) int64 {
+	return mapEntryOverhead + stringSize(field) + stringSize(value)
+}
+
+func listElemSize(v string) int64 {
+	return stringSize(v)
+}
+
+func setMemberSize(member string) int64 {
+	return mapEntryOverhead + int64(len(member))
+}
+
+func zsetMemberSize(member string, levels int) int64 {
+	// the dict and the skip list node share the member's bytes
+	return mapEntryOverhead + stringSize(member) + 8 + skipNodeSize + int64(levels)*skipLevelSize
+}
+
+// sizeOf computes the approximate memory used by value.
+func sizeOf(typ entryType, value interface{}) int64 {
+	return sampledSizeOf(typ, value, 0)
+}
+
+// sampledSizeOf estimates the memory used by value from at most samples
+// of its elements, scaled to the number of elements. samples <= 0
+// inspects every element.
+func sampledSizeOf(typ entryType, value interface{}, samples int) int64 {
+	var (
+		header int64 // fixed part of the representation
+		sum    int64 // size of the inspected elements
+		seen   int   // number of inspected elements
+		total  int   // number of elements
+		enough = func() bool { return samples > 0 && seen >= samples }
+	)
+
+	switch typ {
+	case _String:
+		return stringSize(value.(string))
+	case _List:
+		ql := value.(*qlist)
+		header = qlistHeaderSize
+		total = ql.len
+		for node := ql.head; node != nil; node = node.next {
+			header += qnodeHeaderSize + int64(cap(node.data)-len(node.data))*stringHeaderSize
+			for _, v := range node.data {
+				if enough() {
+					break
+				}
+				sum += listElemSize(v)
+				seen++
+			}
+		}
+	case _Hash:
+		h := value.(hash)
+		total = len(h)
+		for field, value := range h {
+			if enough() {
+				break
+			}
+			sum += hashFieldSize(field, value)
+			seen++
+		}
+	case _Set:
+		set := value.(*Set)
+		total = len(set.m)
+		for member := range set.m {
+			if enough() {
+				break
+			}
+			sum += setMemberSize(member)
+			seen++
+		}
+	case _ZSet:
+		zs := value.(*ZSet)
+		header = zsetHeaderSize
+		total = len(zs.dict)
+		for x := zs.zsl.first(); x != nil; x = x.forward() {
+			if enough() {
+				break
+			}
+			sum += zsetMemberSize(x.str, len(x.next))
+			seen++
+		}
+	}
+
+	if seen == 0 {
+		return header
+	}
+	return header + sum*int64(total)/int64(seen)
+}
+
+func nowMs() int64 {
+	return time.Now().UnixMilli()
+}
+
+func lruClock() int64 {
+	return time.Now().Unix()
+}
+
+// The LFU counter follows Redis: a logarithmic 8 bit counter that is
+// decremented once per lfuDecayTime minutes of idleness.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = 1
+)
+
+func lfuTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xFFFFFF
+}
+
+// lfuDecrAndReturn returns the counter packed in v after decaying it by
+// the number of periods elapsed since its last decrement.
+func lfuDecrAndReturn(v uint32) uint8 {
+	ldt := v >> 8
+	counter := uint8(v & 0xFF)
+
+	now := lfuTimeInMinutes()
+	var elapsed uint32
+	if now >= ldt {
+		elapsed = now - ldt
+	} else {
+		elapsed = 0xFFFFFF - ldt + now
+	}
+
+	periods := elapsed / lfuDecayTime
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// lfuLogIncr increments the counter with a probability that shrinks as
+// the counter grows.
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == math.MaxUint8 {
+		return counter
+	}
+	baseval := float64(counter) - lfuInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*lfuLogFactor + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// embstrSizeLimit is the length up to which Redis stores strings with the
+// embstr encoding.
+const embstrSizeLimit = 44
+
+// encodingOf names the representation of e the way OBJECT ENCODING does.
+func encodingOf(e *entry) string {
+	switch e.typ {
+	case _String:
+		s := e.value.(string)
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) <= 20 {
+			return "int"
+		}
+		if len(s) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case _List:
+		return "quicklist"
+	case _Hash, _Set:
+		return "hashtable"
+	case _ZSet:
+		return "skiplist"
+	}
+	return "unknown"
+}
+
+var objectHelp = []string{
+	"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"ENCODING <key>",
+	"    Return the kind of internal representation used in order to store the value",
+	"    associated with a <key>.",
+	"FREQ <key>",
+	"    Return the access frequency index of the <key>. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the <key>, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+	"REFCOUNT <key>",
+	"    Return the number of references of the value associated with the specified",
+	"    <key>.",
+	"HELP",
+	"    Print this help.",
+}
+
+func ObjectHandler(w IWriter, args []Value) Result {
+	sub := strings.ToUpper(args[0].String())
+	if sub == "HELP" && len(args) == 1 {
+		return writeHelp(w, objectHelp)
+	}
+
+	if len(args) != 2 {
+		w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + args[0].String() + "'. Try OBJECT HELP.")
+		return ResultError
+	}
+
+	key := args[1].String()
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.peek(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteNull()
+		return ResultOK
+	}
+
+	switch sub {
+	case "ENCODING":
+		w.WriteBulkString(encodingOf(e))
+	case "IDLETIME":
+		w.WriteInteger(int(lruClock() - e.lru.Load()))
+	case "FREQ":
+		w.WriteInteger(int(lfuDecrAndReturn(e.lfu.Load())))
+	case "REFCOUNT":
+		// values are never shared between keys
+		w.WriteInteger(1)
+	default:
+		w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + args[0].String() + "'. Try OBJECT HELP.")
+		return ResultError
+	}
+	return ResultOK
+}
+
+// defaultMemorySamples is the number of elements MEMORY USAGE inspects in
+// aggregate values when SAMPLES is not given.
+const defaultMemorySamples = 5
+
+var memoryHelp = []string{
+	"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"STATS",
+	"    Return information about the memory usage of the server.",
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return memory in bytes used by <key> and its value. Nested values are",
+	"    sampled up to <count> times (default: 5, 0 means sample all).",
+	"HELP",
+	"    Print this help.",
+}
+
+func MemoryHandler(w IWriter, args []Value) Result {
+	switch strings.ToUpper(args[0].String()) {
+	case "USAGE":
+		return memoryUsage(w, args[1:])
+	case "STATS":
+		if len(args) == 1 {
+			return memoryStats(w)
+		}
+	case "HELP":
+		if len(args) == 1 {
+			return writeHelp(w, memoryHelp)
+		}
+	}
+
+	w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + args[0].String() + "'. Try MEMORY HELP.")
+	return ResultError
+}
+
+func memoryUsage(w IWriter, args []Value) Result {
+	if len(args) != 1 && len(args) != 3 {
+		w.WriteError("ERR syntax error")
+		return ResultError
+	}
+
+	key := args[0].String()
+	samples := defaultMemorySamples
+	if len(args) == 3 {
+		if strings.ToUpper(args[1].String()) != "SAMPLES" {
+			w.WriteError("ERR syntax error")
+			return ResultError
+		}
+		n, err := strconv.Atoi(args[2].String())
+		if err != nil || n < 0 {
+			w.WriteError("ERR value is out of range, must be positive")
+			return ResultError
+		}
+		samples = n
+	}
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.peek(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteNull()
+		return ResultOK
+	}
+
+	e.RLock()
+	size := keyOverhead(key) + sampledSizeOf(e.typ, e.value, samples)
+	e.RUnlock()
+
+	w.WriteInteger(int(size))
+	return ResultOK
+}
+
+func memoryStats(w IWriter) Result {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	keys := db.size()
+	dataset := usedMemory.Load()
+	total := int64(ms.HeapAlloc)
+
+	overhead := total - dataset
+	if overhead < 0 {
+		overhead = 0
+	}
+
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = dataset / int64(keys)
+	}
+
+	percentage := 0.0
+	if total > 0 {
+		percentage = float64(dataset) * 100 / float64(total)
+	}
+
+	stats := []Value{
+		BulkString("total.allocated"), {typ: INTEGER, integer: int(total)},
+		BulkString("heap.system"), {typ: INTEGER, integer: int(ms.HeapSys)},
+		BulkString("overhead.total"), {typ: INTEGER, integer: int(overhead)},
+		BulkString("keys.count"), {typ: INTEGER, integer: keys},
+		BulkString("keys.bytes-per-key"), {typ: INTEGER, integer: int(bytesPerKey)},
+		BulkString("dataset.bytes"), {typ: INTEGER, integer: int(dataset)},
+		BulkString("dataset.percentage"), BulkString(strconv.FormatFloat(percentage, 'f', -1, 64)),
+		BulkString("evicted.keys"), {typ: INTEGER, integer: int(evictedKeys.Load())},
+		BulkString("gc.count"), {typ: INTEGER, integer: int(ms.NumGC)},
+	}
+
+	w.WriteMap(MapValue(stats...))
+	return ResultOK
+}
+
+func writeHelp(w IWriter, lines []string) Result {
+	values := make([]Value, 0, len(lines))
+	for _, line := range lines {
+		values = append(values, Value{typ: STRING, str: line})
+	}
+	w.WriteArray(Value{typ: ARRAY, array: values})
+	return ResultOK
+}
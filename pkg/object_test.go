@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObjectEncoding(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SetHandler(w, []Value{BulkString("object:int"), BulkString("12345")})
+	SetHandler(w, []Value{BulkString("object:embstr"), BulkString("hello")})
+	SetHandler(w, []Value{BulkString("object:raw"), BulkString(strings.Repeat("x", 64))})
+	RPushHandler(w, []Value{BulkString("object:list"), BulkString("a")})
+
+	cases := map[string]string{
+		"object:int":    "int",
+		"object:embstr": "embstr",
+		"object:raw":    "raw",
+		"object:list":   "quicklist",
+	}
+	for key, encoding := range cases {
+		buf := &bytes.Buffer{}
+		ObjectHandler(NewWriter(buf), []Value{BulkString("encoding"), BulkString(key)})
+		if got, want := buf.String(), "$"+strconv.Itoa(len(encoding))+"\r\n"+encoding+"\r\n"; got != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestMemoryUsageSamples(t *testing.T) {
+	w := NewWriter(io.Discard)
+	args := []Value{BulkString("memory:set")}
+	for i := 0; i < 100; i++ {
+		args = append(args, BulkString(strings.Repeat("m", 10)+strconv.Itoa(i)))
+	}
+	SAddHandler(w, args)
+
+	sh := db.shard("memory:set")
+	sh.RLock()
+	e, _ := sh.peek("memory:set")
+	sh.RUnlock()
+
+	exact := sampledSizeOf(e.typ, e.value, 0)
+	if exact != e.size.Load() {
+		t.Fatalf("expected accounted size %d to match computed size %d", e.size.Load(), exact)
+	}
+
+	sampled := sampledSizeOf(e.typ, e.value, 5)
+	if diff := sampled - exact; diff > exact/10 || diff < -exact/10 {
+		t.Fatalf("sampled size %d too far from exact size %d", sampled, exact)
+	}
+}
+
+func TestMemoryStatsReply(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	if got := runCommand(t, d, 2, "MEMORY", "STATS"); !strings.HasPrefix(got, "*18\r\n$15\r\ntotal.allocated\r\n") {
+		t.Fatalf("expected a flat array under RESP2, got %q", got)
+	}
+	if got := runCommand(t, d, 3, "MEMORY", "STATS"); !strings.HasPrefix(got, "%9\r\n$15\r\ntotal.allocated\r\n") {
+		t.Fatalf("expected a map under RESP3, got %q", got)
+	}
+}
@@ -38,14 +38,12 @@ func (ql *qlist) pushLeft(data string) {
 		h.prev = n
 		ql.len++
 		ql.head = n
-	}
-
-	if h.direction == Left {
-		h.data = append(h.data, data)
-		h.len++
-		ql.len++
 		return
 	}
+
+	h.data = append(h.data, data)
+	h.len++
+	ql.len++
 }
 
 func (ql *qlist) pushRight(data string) {
@@ -63,14 +61,12 @@ func (ql *qlist) pushRight(data string) {
 		t.next = n
 		ql.tail = n
 		ql.len++
-	}
-
-	if t.direction == Right {
-		t.data = append(t.data, data)
-		t.len++
-		ql.len++
 		return
 	}
+
+	t.data = append(t.data, data)
+	t.len++
+	ql.len++
 }
 
 func (ql *qlist) getLeft() string {
@@ -125,9 +121,9 @@ func (ql *qlist) getRange(start, stop int) []qrange {
 	}
 
 	for h.len <= start {
-		h = h.next
 		start -= h.len
 		stop -= h.len
+		h = h.next
 	}
 
 	res := make([]qrange, 0)
@@ -179,7 +175,7 @@ func (ql *qlist) popLeft() string {
 		h.len--
 		ql.len--
 		if h.len == 0 {
-			ql.head = h.next
+			ql.unlinkHead()
 		}
 	} else {
 		v = h.data[h.len-1]
@@ -187,7 +183,7 @@ func (ql *qlist) popLeft() string {
 		h.len--
 		ql.len--
 		if h.len == 0 {
-			ql.head = h.next
+			ql.unlinkHead()
 		}
 	}
 
@@ -212,7 +208,7 @@ func (ql *qlist) popRight() string {
 		t.len--
 		ql.len--
 		if t.len == 0 {
-			ql.tail = t.prev
+			ql.unlinkTail()
 		}
 	} else {
 		v = t.data[t.len-1]
@@ -220,9 +216,42 @@ func (ql *qlist) popRight() string {
 		t.len--
 		ql.len--
 		if t.len == 0 {
-			ql.tail = t.prev
+			ql.unlinkTail()
 		}
 	}
 
 	return v
 }
+
+func (ql *qlist) unlinkHead() {
+	ql.head = ql.head.next
+	if ql.head == nil {
+		ql.tail = nil
+	} else {
+		ql.head.prev = nil
+	}
+}
+
+func (ql *qlist) unlinkTail() {
+	ql.tail = ql.tail.prev
+	if ql.tail == nil {
+		ql.head = nil
+	} else {
+		ql.tail.next = nil
+	}
+}
+
+// each calls fn for every element from left to right.
+func (ql *qlist) each(fn func(string)) {
+	for n := ql.head; n != nil; n = n.next {
+		if n.direction == Left {
+			for i := n.len - 1; i >= 0; i-- {
+				fn(n.data[i])
+			}
+		} else {
+			for i := 0; i < n.len; i++ {
+				fn(n.data[i])
+			}
+		}
+	}
+}
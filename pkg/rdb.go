@@ -0,0 +1,868 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"strconv"
+)
+
+// RDB object types, as defined by Redis' rdb.h.
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeSetListpack     = 20
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+)
+
+// Length encodings.
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// rdbVersion is the version written in DUMP payloads and RDB files. Every
+// type we emit is understood by Redis since that version.
+const rdbVersion = 9
+
+// rdbMaxVersion is the newest version we accept when loading.
+const rdbMaxVersion = 12
+
+var errRdbBadFormat = errors.New("bad data format")
+
+// crc64Table is the Jones polynomial Redis uses, in reversed form.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update extends crc with p. Redis' CRC64 has neither an initial
+// value nor a final xor, unlike hash/crc64, hence the inversions.
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+// rdbEncoder serializes values in the RDB format into buf.
+type rdbEncoder struct {
+	buf []byte
+}
+
+func (enc *rdbEncoder) writeByte(b byte) {
+	enc.buf = append(enc.buf, b)
+}
+
+func (enc *rdbEncoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		enc.buf = append(enc.buf, byte(n))
+	case n < 1<<14:
+		enc.buf = append(enc.buf, byte(n>>8)|rdb14BitLen<<6, byte(n))
+	case n <= math.MaxUint32:
+		enc.buf = append(enc.buf, rdb32BitLen)
+		enc.buf = binary.BigEndian.AppendUint32(enc.buf, uint32(n))
+	default:
+		enc.buf = append(enc.buf, rdb64BitLen)
+		enc.buf = binary.BigEndian.AppendUint64(enc.buf, n)
+	}
+}
+
+func (enc *rdbEncoder) writeString(s string) {
+	// small integers are stored in their binary form, like Redis does
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				enc.buf = append(enc.buf, rdbEncVal<<6|rdbEncInt8, byte(n))
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				enc.buf = append(enc.buf, rdbEncVal<<6|rdbEncInt16)
+				enc.buf = binary.LittleEndian.AppendUint16(enc.buf, uint16(n))
+			default:
+				enc.buf = append(enc.buf, rdbEncVal<<6|rdbEncInt32)
+				enc.buf = binary.LittleEndian.AppendUint32(enc.buf, uint32(n))
+			}
+			return
+		}
+	}
+
+	enc.writeLength(uint64(len(s)))
+	enc.buf = append(enc.buf, s...)
+}
+
+func (enc *rdbEncoder) writeDouble(f float64) {
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, math.Float64bits(f))
+}
+
+// writeObject writes the type byte of value followed by its encoding.
+func (enc *rdbEncoder) writeObject(typ entryType, value interface{}) {
+	enc.writeByte(rdbObjectType(typ))
+	enc.writeValue(typ, value)
+}
+
+// rdbObjectType returns the RDB type writeValue encodes typ as.
+func rdbObjectType(typ entryType) byte {
+	switch typ {
+	case _List:
+		return rdbTypeList
+	case _Set:
+		return rdbTypeSet
+	case _Hash:
+		return rdbTypeHash
+	case _ZSet:
+		return rdbTypeZSet2
+	}
+	return rdbTypeString
+}
+
+// writeValue writes the encoding of value without its type byte, which
+// RDB files write before the key.
+func (enc *rdbEncoder) writeValue(typ entryType, value interface{}) {
+	switch typ {
+	case _String:
+		enc.writeString(value.(string))
+	case _List:
+		ql := value.(*qlist)
+		enc.writeLength(uint64(ql.len))
+		ql.each(enc.writeString)
+	case _Set:
+		set := value.(*Set)
+		enc.writeLength(uint64(len(set.m)))
+		for member := range set.m {
+			enc.writeString(member)
+		}
+	case _Hash:
+		h := value.(hash)
+		enc.writeLength(uint64(len(h)))
+		for field, value := range h {
+			enc.writeString(field)
+			enc.writeString(value)
+		}
+	case _ZSet:
+		zs := value.(*ZSet)
+		enc.writeLength(zs.zsl.length)
+		// highest score first, so the loader always inserts at the head
+		for x := zs.zsl.tail; x != nil; x = x.bwd {
+			enc.writeString(x.str)
+			enc.writeDouble(x.score)
+		}
+	}
+}
+
+// rdbReader is what rdbDecoder reads from: a *bufio.Reader for files, a
+// *bytes.Reader for DUMP payloads.
+type rdbReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// rdbDecoder parses values in the RDB format, including the compact
+// encodings (ziplist, listpack, intset, quicklist) written by Redis.
+type rdbDecoder struct {
+	r rdbReader
+}
+
+func (d *rdbDecoder) readByte() (byte, error) {
+	return d.r.ReadByte()
+}
+
+// rdbMaxString is the longest string Redis accepts, the bound on every
+// length read from untrusted input.
+const rdbMaxString = 512 << 20
+
+// rdbReadChunk is the most readFull allocates before it has seen the data,
+// so a bogus length in a truncated file can't allocate rdbMaxString.
+const rdbReadChunk = 1 << 20
+
+func (d *rdbDecoder) readFull(n uint64) ([]byte, error) {
+	if n > rdbMaxString {
+		return nil, errRdbBadFormat
+	}
+	// a DUMP payload knows how much of it is left
+	if r, ok := d.r.(interface{ Len() int }); ok && n > uint64(r.Len()) {
+		return nil, errRdbBadFormat
+	}
+	if n > rdbReadChunk {
+		buf, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+		if err == nil && uint64(len(buf)) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readLength returns a length, or an encoding type if encoded is set.
+func (d *rdbDecoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case rdb6BitLen:
+		return uint64(b & 0x3f), false, nil
+	case rdb14BitLen:
+		b2, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case rdbEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case rdb32BitLen:
+		buf, err := d.readFull(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case rdb64BitLen:
+		buf, err := d.readFull(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, errRdbBadFormat
+}
+
+func (d *rdbDecoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = errRdbBadFormat
+	}
+	return n, err
+}
+
+func (d *rdbDecoder) readString() (string, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	if !encoded {
+		buf, err := d.readFull(n)
+		return string(buf), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		buf, err := d.readFull(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := d.readFull(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return "", err
+		}
+		// a 3 byte back reference expands to at most 264 bytes
+		if clen > rdbMaxString || ulen > rdbMaxString || ulen > clen*88 {
+			return "", errRdbBadFormat
+		}
+		compressed, err := d.readFull(clen)
+		if err != nil {
+			return "", err
+		}
+		buf, err := lzfDecompress(compressed, int(ulen))
+		return string(buf), err
+	}
+	return "", errRdbBadFormat
+}
+
+// readStringDouble reads a score in the text form of the old ZSET type.
+func (d *rdbDecoder) readStringDouble() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := d.readFull(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+func (d *rdbDecoder) readDouble() (float64, error) {
+	buf, err := d.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readObject reads a value of the given RDB type.
+func (d *rdbDecoder) readObject(rdbType byte) (entryType, interface{}, error) {
+	switch rdbType {
+	case rdbTypeString:
+		s, err := d.readString()
+		return _String, s, err
+
+	case rdbTypeList, rdbTypeSet:
+		n, err := d.readLen()
+		if err != nil {
+			return 0, nil, err
+		}
+		items := make([]string, 0, min(n, 1024))
+		for i := uint64(0); i < n; i++ {
+			s, err := d.readString()
+			if err != nil {
+				return 0, nil, err
+			}
+			items = append(items, s)
+		}
+		if rdbType == rdbTypeList {
+			return _List, newQlistFrom(items), nil
+		}
+		return _Set, newSetFrom(items), nil
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := d.readLen()
+		if err != nil {
+			return 0, nil, err
+		}
+		zs := NewZSet()
+		for i := uint64(0); i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return 0, nil, err
+			}
+			var score float64
+			if rdbType == rdbTypeZSet {
+				score, err = d.readStringDouble()
+			} else {
+				score, err = d.readDouble()
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			zs.add(member, score)
+		}
+		return _ZSet, zs, nil
+
+	case rdbTypeHash:
+		n, err := d.readLen()
+		if err != nil {
+			return 0, nil, err
+		}
+		h := make(hash, n)
+		for i := uint64(0); i < n; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return 0, nil, err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return 0, nil, err
+			}
+			h[field] = value
+		}
+		return _Hash, h, nil
+
+	case rdbTypeHashZipmap:
+		blob, err := d.readString()
+		if err != nil {
+			return 0, nil, err
+		}
+		items, err := parseZipmap([]byte(blob))
+		if err != nil {
+			return 0, nil, err
+		}
+		return _Hash, newHashFrom(items), nil
+
+	case rdbTypeSetIntset:
+		blob, err := d.readString()
+		if err != nil {
+			return 0, nil, err
+		}
+		items, err := parseIntset([]byte(blob))
+		if err != nil {
+			return 0, nil, err
+		}
+		return _Set, newSetFrom(items), nil
+
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist,
+		rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		blob, err := d.readString()
+		if err != nil {
+			return 0, nil, err
+		}
+		var items []string
+		switch rdbType {
+		case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+			items, err = parseZiplist([]byte(blob))
+		default:
+			items, err = parseListpack([]byte(blob))
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		switch rdbType {
+		case rdbTypeListZiplist:
+			return _List, newQlistFrom(items), nil
+		case rdbTypeSetListpack:
+			return _Set, newSetFrom(items), nil
+		case rdbTypeHashZiplist, rdbTypeHashListpack:
+			if len(items)%2 != 0 {
+				return 0, nil, errRdbBadFormat
+			}
+			return _Hash, newHashFrom(items), nil
+		default:
+			if len(items)%2 != 0 {
+				return 0, nil, errRdbBadFormat
+			}
+			zs := NewZSet()
+			for i := 0; i < len(items); i += 2 {
+				score, err := strconv.ParseFloat(items[i+1], 64)
+				if err != nil {
+					return 0, nil, errRdbBadFormat
+				}
+				zs.add(items[i], score)
+			}
+			return _ZSet, zs, nil
+		}
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		n, err := d.readLen()
+		if err != nil {
+			return 0, nil, err
+		}
+		ql := &qlist{}
+		for i := uint64(0); i < n; i++ {
+			container := uint64(rdbQuicklistNodePacked)
+			if rdbType == rdbTypeListQuicklist2 {
+				if container, err = d.readLen(); err != nil {
+					return 0, nil, err
+				}
+			}
+			blob, err := d.readString()
+			if err != nil {
+				return 0, nil, err
+			}
+			if container == rdbQuicklistNodePlain {
+				ql.pushRight(blob)
+				continue
+			}
+			var items []string
+			if rdbType == rdbTypeListQuicklist {
+				items, err = parseZiplist([]byte(blob))
+			} else {
+				items, err = parseListpack([]byte(blob))
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			for _, item := range items {
+				ql.pushRight(item)
+			}
+		}
+		return _List, ql, nil
+	}
+
+	return 0, nil, fmt.Errorf("unsupported rdb object type %d", rdbType)
+}
+
+// valueLen returns the number of elements of an aggregate value, or 1 for
+// a string.
+func valueLen(typ entryType, value interface{}) int {
+	switch typ {
+	case _List:
+		return value.(*qlist).len
+	case _Hash:
+		return len(value.(hash))
+	case _Set:
+		return len(value.(*Set).m)
+	case _ZSet:
+		return len(value.(*ZSet).dict)
+	}
+	return 1
+}
+
+func newQlistFrom(items []string) *qlist {
+	ql := &qlist{}
+	for _, item := range items {
+		ql.pushRight(item)
+	}
+	return ql
+}
+
+func newSetFrom(items []string) *Set {
+	set := &Set{make(map[string]struct{}, len(items))}
+	for _, item := range items {
+		set.m[item] = struct{}{}
+	}
+	return set
+}
+
+// newHashFrom builds a hash from alternating fields and values.
+func newHashFrom(items []string) hash {
+	h := make(hash, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		h[items[i]] = items[i+1]
+	}
+	return h
+}
+
+// lzfDecompress inflates an LZF compressed string of outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			// literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, errRdbBadFormat
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errRdbBadFormat
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errRdbBadFormat
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+length+2 > outLen {
+			return nil, errRdbBadFormat
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errRdbBadFormat
+	}
+	return out, nil
+}
+
+// parseZiplist returns the entries of a ziplist as strings.
+func parseZiplist(zl []byte) ([]string, error) {
+	if len(zl) < 11 {
+		return nil, errRdbBadFormat
+	}
+	n := int(binary.LittleEndian.Uint16(zl[8:10]))
+	items := make([]string, 0, n)
+
+	p := zl[10:]
+	for len(p) > 0 && p[0] != 0xFF {
+		// skip prevlen
+		if p[0] < 254 {
+			p = p[1:]
+		} else if len(p) >= 5 {
+			p = p[5:]
+		} else {
+			return nil, errRdbBadFormat
+		}
+		if len(p) == 0 {
+			return nil, errRdbBadFormat
+		}
+
+		enc := p[0]
+		var (
+			item string
+			size int
+		)
+		switch {
+		case enc>>6 == 0:
+			l := int(enc & 0x3f)
+			size = 1 + l
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[1:size])
+		case enc>>6 == 1:
+			if len(p) < 2 {
+				return nil, errRdbBadFormat
+			}
+			l := int(enc&0x3f)<<8 | int(p[1])
+			size = 2 + l
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[2:size])
+		case enc == 0x80:
+			if len(p) < 5 {
+				return nil, errRdbBadFormat
+			}
+			l := int(binary.BigEndian.Uint32(p[1:5]))
+			size = 5 + l
+			if l < 0 || len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[5:size])
+		default:
+			var v int64
+			switch enc {
+			case 0xC0:
+				size = 3
+			case 0xD0:
+				size = 5
+			case 0xE0:
+				size = 9
+			case 0xF0:
+				size = 4
+			case 0xFE:
+				size = 2
+			default:
+				if enc < 0xF1 || enc > 0xFD {
+					return nil, errRdbBadFormat
+				}
+				size = 1
+				v = int64(enc&0x0f) - 1
+			}
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			switch enc {
+			case 0xC0:
+				v = int64(int16(binary.LittleEndian.Uint16(p[1:])))
+			case 0xD0:
+				v = int64(int32(binary.LittleEndian.Uint32(p[1:])))
+			case 0xE0:
+				v = int64(binary.LittleEndian.Uint64(p[1:]))
+			case 0xF0:
+				v = int64(int32(uint32(p[1])<<8|uint32(p[2])<<16|uint32(p[3])<<24) >> 8)
+			case 0xFE:
+				v = int64(int8(p[1]))
+			}
+			item = strconv.FormatInt(v, 10)
+		}
+
+		items = append(items, item)
+		p = p[size:]
+	}
+	return items, nil
+}
+
+// parseListpack returns the entries of a listpack as strings.
+func parseListpack(lp []byte) ([]string, error) {
+	if len(lp) < 7 {
+		return nil, errRdbBadFormat
+	}
+	items := make([]string, 0, int(binary.LittleEndian.Uint16(lp[4:6])))
+
+	p := lp[6:]
+	for len(p) > 0 && p[0] != 0xFF {
+		enc := p[0]
+		var (
+			item string
+			size int // encoding and data, without the backlen
+		)
+		switch {
+		case enc&0x80 == 0:
+			size = 1
+			item = strconv.Itoa(int(enc & 0x7f))
+		case enc&0xC0 == 0x80:
+			l := int(enc & 0x3f)
+			size = 1 + l
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[1:size])
+		case enc&0xE0 == 0xC0:
+			if len(p) < 2 {
+				return nil, errRdbBadFormat
+			}
+			v := int(enc&0x1f)<<8 | int(p[1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			size = 2
+			item = strconv.Itoa(v)
+		case enc&0xF0 == 0xE0:
+			if len(p) < 2 {
+				return nil, errRdbBadFormat
+			}
+			l := int(enc&0x0f)<<8 | int(p[1])
+			size = 2 + l
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[2:size])
+		case enc == 0xF0:
+			if len(p) < 5 {
+				return nil, errRdbBadFormat
+			}
+			l := int(binary.LittleEndian.Uint32(p[1:5]))
+			size = 5 + l
+			if l < 0 || len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			item = string(p[5:size])
+		case enc >= 0xF1 && enc <= 0xF4:
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[enc]
+			size = 1 + width
+			if len(p) < size {
+				return nil, errRdbBadFormat
+			}
+			var u uint64
+			for i := width; i >= 1; i-- {
+				u = u<<8 | uint64(p[i])
+			}
+			// sign extend
+			shift := 64 - 8*width
+			item = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+		default:
+			return nil, errRdbBadFormat
+		}
+
+		backlen := 1
+		switch {
+		case size >= 268435455:
+			backlen = 5
+		case size >= 2097151:
+			backlen = 4
+		case size >= 16383:
+			backlen = 3
+		case size > 127:
+			backlen = 2
+		}
+		if len(p) < size+backlen {
+			return nil, errRdbBadFormat
+		}
+
+		items = append(items, item)
+		p = p[size+backlen:]
+	}
+	return items, nil
+}
+
+// parseIntset returns the members of an intset as strings.
+func parseIntset(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errRdbBadFormat
+	}
+	width := int(binary.LittleEndian.Uint32(is[0:4]))
+	n := int(binary.LittleEndian.Uint32(is[4:8]))
+	if (width != 2 && width != 4 && width != 8) || n < 0 || len(is) < 8+n*width {
+		return nil, errRdbBadFormat
+	}
+
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		p := is[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		items = append(items, strconv.FormatInt(v, 10))
+	}
+	return items, nil
+}
+
+// parseZipmap returns the alternating fields and values of a zipmap, the
+// hash encoding of RDB files written before Redis 2.6.
+func parseZipmap(zm []byte) ([]string, error) {
+	if len(zm) < 1 {
+		return nil, errRdbBadFormat
+	}
+	p := zm[1:]
+
+	readLen := func() (int, error) {
+		if len(p) < 1 {
+			return 0, errRdbBadFormat
+		}
+		if p[0] < 254 {
+			l := int(p[0])
+			p = p[1:]
+			return l, nil
+		}
+		if p[0] == 254 && len(p) >= 5 {
+			l := int(binary.LittleEndian.Uint32(p[1:5]))
+			p = p[5:]
+			return l, nil
+		}
+		return 0, errRdbBadFormat
+	}
+
+	var items []string
+	for len(p) > 0 && p[0] != 0xFF {
+		l, err := readLen()
+		if err != nil || len(p) < l {
+			return nil, errRdbBadFormat
+		}
+		field := string(p[:l])
+		p = p[l:]
+
+		l, err = readLen()
+		if err != nil || len(p) < 1 {
+			return nil, errRdbBadFormat
+		}
+		free := int(p[0])
+		p = p[1:]
+		if len(p) < l+free {
+			return nil, errRdbBadFormat
+		}
+		items = append(items, field, string(p[:l]))
+		p = p[l+free:]
+	}
+	return items, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -15,6 +16,15 @@ const (
 	INTEGER = ':'
 	BULK    = '$'
 	ARRAY   = '*'
+
+	// RESP3
+	DOUBLE    = ','
+	BOOLEAN   = '#'
+	BIGNUMBER = '('
+	VERBATIM  = '='
+	MAP       = '%'
+	SET       = '~'
+	PUSH      = '>'
 )
 
 // Value
@@ -22,6 +32,8 @@ type Value struct {
 	typ     Type
 	str     string
 	integer int
+	double  float64
+	boolean bool
 	array   []Value
 	null    bool
 }
@@ -70,6 +82,14 @@ func (v Value) Integer() int {
 	return v.integer
 }
 
+func (v Value) Double() float64 {
+	return v.double
+}
+
+func (v Value) Boolean() bool {
+	return v.boolean
+}
+
 func (v Value) String() string {
 	return v.str
 }
@@ -81,6 +101,53 @@ func BulkString(str string) Value {
 	}
 }
 
+func DoubleValue(f float64) Value {
+	return Value{
+		typ:    DOUBLE,
+		double: f,
+	}
+}
+
+func SimpleString(str string) Value {
+	return Value{
+		typ: STRING,
+		str: str,
+	}
+}
+
+func IntegerValue(i int) Value {
+	return Value{
+		typ:     INTEGER,
+		integer: i,
+	}
+}
+
+func ArrayValue(values ...Value) Value {
+	return Value{
+		typ:   ARRAY,
+		array: values,
+	}
+}
+
+// MapValue builds a map from alternating keys and values.
+func MapValue(values ...Value) Value {
+	return Value{
+		typ:   MAP,
+		array: values,
+	}
+}
+
+// NullBulk is the nil reply of a missing key, NullArray the one of a
+// missing aggregate such as a timed out blocking pop. Both are written as
+// _ under RESP3.
+func NullBulk() Value {
+	return Value{typ: BULK, null: true}
+}
+
+func NullArray() Value {
+	return Value{typ: ARRAY, null: true}
+}
+
 // Resp
 type Resp struct {
 	reader *bufio.Reader
@@ -90,33 +157,106 @@ func NewResp(rd *bufio.Reader) *Resp {
 	return &Resp{reader: rd}
 }
 
-func (r *Resp) readLine() (line []byte, n int, err error) {
-	for {
-		b, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, 0, err
+// readLine returns the next line without its CRLF. The line points into
+// the bufio buffer and is only valid until the next read.
+func (r *Resp) readLine() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big line")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, protocolError("expected CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// ProtocolError reports a malformed request. The connection can't be
+// resynchronized after one, so it is answered and then closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolError(msg string) error {
+	return &ProtocolError{msg: msg}
+}
+
+const (
+	maxInlineSize  = 64 * 1024
+	maxArrayLength = 1024 * 1024
+	maxBulkLength  = 512 * 1024 * 1024
+)
+
+// parseInt parses a decimal integer without converting b to a string.
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+	neg := b[0] == '-'
+	if neg {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return 0, false
 		}
-		n++
-		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' && line[len(line)-1] == '\n' {
-			break
+		n = n*10 + d
+	}
+	if neg {
+		if n > -math.MinInt64 {
+			return 0, false
 		}
+		return -int64(n), true
 	}
-	return line[:len(line)-2], n, nil
+	if n > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(n), true
 }
 
-func (r *Resp) readInteger() (x int, n int, err error) {
-	line, n, err := r.readLine()
+func (r *Resp) readInteger() (int, error) {
+	line, err := r.readLine()
 	if err != nil {
-		return 0, 0, err
+		return 0, err
+	}
+	i, ok := parseInt(line)
+	if !ok {
+		return 0, protocolError("invalid integer")
 	}
-	i64, err := strconv.ParseInt(string(line), 10, 64)
+	return int(i), nil
+}
+
+// readLength reads the length line of an array or bulk string, -1 being
+// the null value.
+func (r *Resp) readLength(max int, what string) (int, error) {
+	line, err := r.readLine()
 	if err != nil {
-		return 0, n, err
+		return 0, err
 	}
-	return int(i64), n, nil
+	l, ok := parseInt(line)
+	if !ok || l < -1 || l > int64(max) {
+		return 0, protocolError("invalid " + what + " length")
+	}
+	return int(l), nil
 }
 
+// Read parses the next RESP2 value. Anything that doesn't start with a
+// RESP type byte is an inline command, split into an array of bulk
+// strings; blank inline lines yield a zero Value.
 func (r *Resp) Read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 	if err != nil {
@@ -127,23 +267,216 @@ func (r *Resp) Read() (Value, error) {
 		return r.readArray()
 	case BULK:
 		return r.readBulk()
-	case '\n':
-	case '\r':
+	case STRING, ERROR:
+		line, err := r.readLine()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: Type(_type), str: string(line)}, nil
+	case INTEGER:
+		i, err := r.readInteger()
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{typ: INTEGER, integer: i}, nil
+	}
+
+	if err := r.reader.UnreadByte(); err != nil {
+		return Value{}, err
 	}
-	return Value{}, fmt.Errorf("unknowntype: %v", string(_type))
+	return r.readInline()
+}
+
+// ReadRequest parses the next request: a multibulk of bulk strings, as
+// clients send them, or else an inline command. Unlike Read it accepts no
+// other type inside the multibulk, nested arrays included.
+func (r *Resp) ReadRequest() (Value, error) {
+	_type, err := r.reader.ReadByte()
+	if err != nil {
+		return Value{}, err
+	}
+	if _type != ARRAY {
+		if err := r.reader.UnreadByte(); err != nil {
+			return Value{}, err
+		}
+		return r.readInline()
+	}
+
+	n, err := r.readLength(maxArrayLength, "multibulk")
+	if err != nil {
+		return Value{}, err
+	}
+	if n == -1 {
+		return NullArray(), nil
+	}
+	array := make([]Value, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return Value{}, err
+		}
+		if _type != BULK {
+			return Value{}, protocolError(fmt.Sprintf("expected '$', got '%c'", _type))
+		}
+		v, err := r.readBulk()
+		if err != nil {
+			return Value{}, err
+		}
+		array = append(array, v)
+	}
+	return Value{typ: ARRAY, array: array}, nil
+}
+
+func (r *Resp) readInline() (Value, error) {
+	line, err := r.reader.ReadSlice('\n')
+	// a line longer than the buffer is gathered up to maxInlineSize
+	if err == bufio.ErrBufferFull {
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(long) <= maxInlineSize {
+			line, err = r.reader.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
+	if err == bufio.ErrBufferFull || len(line) > maxInlineSize {
+		return Value{}, protocolError("too big inline request")
+	}
+	if err != nil {
+		return Value{}, err
+	}
+
+	args, ok := splitArgs(string(line))
+	if !ok {
+		return Value{}, protocolError("unbalanced quotes in request")
+	}
+	if len(args) == 0 {
+		return Value{}, nil
+	}
+
+	array := make([]Value, 0, len(args))
+	for _, arg := range args {
+		array = append(array, BulkString(arg))
+	}
+	return Value{typ: ARRAY, array: array}, nil
+}
+
+// splitArgs splits an inline command line into arguments with the quoting
+// rules of redis-cli: "double quotes" support \n, \r, \t, \b, \a, \xHH
+// and backslash escapes, 'single quotes' only support \'. A closing quote
+// must be followed by a space or the end of the line.
+func splitArgs(line string) ([]string, bool) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+
+		var (
+			arg      []byte
+			inDouble bool
+			inSingle bool
+			done     bool
+		)
+		for !done {
+			if inDouble {
+				switch {
+				case i == len(line):
+					return nil, false
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, line[i])
+					}
+				case line[i] == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if inSingle {
+				switch {
+				case i == len(line):
+					return nil, false
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				switch {
+				case i == len(line) || isSpace(line[i]):
+					done = true
+				case line[i] == '"':
+					inDouble = true
+				case line[i] == '\'':
+					inSingle = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
 }
 
 func (r *Resp) readArray() (Value, error) {
 	// read the length of the array
-	len, _, err := r.readInteger()
+	n, err := r.readLength(maxArrayLength, "multibulk")
 	if err != nil {
 		return Value{}, err
 	}
-	if len > 1024*1024 {
-		return Value{}, fmt.Errorf("array too long: %d", len)
+	if n == -1 {
+		return NullArray(), nil
 	}
-	var array []Value
-	for i := 0; i < len; i++ {
+	array := make([]Value, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
 		v, err := r.Read()
 		if err != nil {
 			return Value{}, err
@@ -155,22 +488,38 @@ func (r *Resp) readArray() (Value, error) {
 
 func (r *Resp) readBulk() (Value, error) {
 	// read the length of the bulk string
-	len, _, err := r.readInteger()
+	n, err := r.readLength(maxBulkLength, "bulk")
 	if err != nil {
 		return Value{}, err
 	}
-	if len > 512*1024*1024 {
-		return Value{}, fmt.Errorf("bulk string too long: %d", len)
+	if n == -1 {
+		return NullBulk(), nil
 	}
 
-	buf := make([]byte, len)
-	_, err = r.reader.Read(buf)
-	if err != nil {
-		return Value{}, err
+	// payloads that fit the buffer are copied straight out of it, larger
+	// ones are read in full into their own slice
+	var str string
+	if n+2 <= r.reader.Size() {
+		buf, err := r.reader.Peek(n + 2)
+		if err != nil {
+			return Value{}, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return Value{}, protocolError("bulk string not terminated by CRLF")
+		}
+		str = string(buf[:n])
+		r.reader.Discard(n + 2)
+	} else {
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.reader, buf); err != nil {
+			return Value{}, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return Value{}, protocolError("bulk string not terminated by CRLF")
+		}
+		str = string(buf[:n])
 	}
-	// Read the trailing CRLF
-	r.readLine()
-	return Value{typ: BULK, str: string(buf)}, nil
+	return Value{typ: BULK, str: str}, nil
 }
 
 // Writer
@@ -181,86 +530,298 @@ type IWriter interface {
 	WriteBulkString(str string) error
 	WriteNull() error
 	WriteArray(value Value) error
+
+	// RESP3 types. Unless the connection negotiated protocol 3 with
+	// HELLO, they are written as their RESP2 equivalent.
+	WriteMap(value Value) error
+	WriteSet(value Value) error
+	WritePush(value Value) error
+	WriteDouble(f float64) error
+	WriteBoolean(b bool) error
+	WriteBigNumber(str string) error
+	WriteVerbatim(format, str string) error
+
+	Proto() int
+	SetProto(proto int)
 }
+
+// Writer encodes replies into a buffer. An unbuffered Writer writes each
+// reply out as soon as it is encoded; a buffered one holds replies until
+// Flush, so a pipeline batch goes out in a single write.
 type Writer struct {
-	w io.Writer
+	w        io.Writer
+	buf      []byte
+	buffered bool
+	proto    int
 }
 
 var _ IWriter = &Writer{}
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{w}
+	return &Writer{w: w, proto: 2}
 }
 
-func (w *Writer) WriteSimpleString(str string) error {
-	_, err := w.w.Write([]byte("+" + str + "\r\n"))
+// NewBufferedWriter returns a Writer whose replies are only written by
+// Flush.
+func NewBufferedWriter(w io.Writer) *Writer {
+	return &Writer{w: w, proto: 2, buffered: true}
+}
+
+func (w *Writer) Proto() int {
+	return w.proto
+}
+
+func (w *Writer) SetProto(proto int) {
+	w.proto = proto
+}
+
+const (
+	// replyFlushSize is how many bytes of replies a buffered Writer holds
+	// before writing them out without waiting for Flush, as Redis's
+	// PROTO_REPLY_CHUNK_BYTES.
+	replyFlushSize = 16 * 1024
+	// maxReplyBufferCap is the largest buffer a Writer keeps once its
+	// replies are written. One grown by a large reply is dropped, so it
+	// isn't held for the life of the connection.
+	maxReplyBufferCap = 64 * 1024
+)
+
+// Flush writes the pending replies.
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.buf)
+	if cap(w.buf) > maxReplyBufferCap {
+		w.buf = nil
+	} else {
+		w.buf = w.buf[:0]
+	}
 	return err
 }
 
+// done flushes the reply just encoded unless the Writer is buffered and
+// the pending replies are still under replyFlushSize.
+func (w *Writer) done() error {
+	if w.buffered && len(w.buf) < replyFlushSize {
+		return nil
+	}
+	return w.Flush()
+}
+
+func (w *Writer) WriteSimpleString(str string) error {
+	w.buf = appendSimple(w.buf, STRING, str)
+	return w.done()
+}
+
 func (w *Writer) WriteError(str string) error {
-	_, err := w.w.Write([]byte("-" + str + "\r\n"))
-	return err
+	w.buf = appendSimple(w.buf, ERROR, str)
+	return w.done()
 }
 
 func (w *Writer) WriteInteger(i int) error {
-	_, err := w.w.Write([]byte(":" + strconv.Itoa(i) + "\r\n"))
-	return err
+	w.buf = appendInteger(w.buf, i)
+	return w.done()
 }
 
 func (w *Writer) WriteBulkString(str string) error {
-	_, err := w.w.Write([]byte("$" + strconv.Itoa(len(str)) + "\r\n" + str + "\r\n"))
-	return err
+	w.buf = appendBulk(w.buf, str)
+	return w.done()
 }
 
 func (w *Writer) WriteNull() error {
-	_, err := w.w.Write([]byte("$-1\r\n"))
-	return err
+	w.buf = appendNull(w.buf, w.proto)
+	return w.done()
 }
 
 func (w *Writer) WriteArray(value Value) error {
-	_, err := w.w.Write([]byte("*" + strconv.Itoa(len(value.array)) + "\r\n"))
+	return w.writeAggregate(ARRAY, value)
+}
+
+func (w *Writer) WriteMap(value Value) error {
+	return w.writeAggregate(MAP, value)
+}
+
+func (w *Writer) WriteSet(value Value) error {
+	return w.writeAggregate(SET, value)
+}
 
+func (w *Writer) WritePush(value Value) error {
+	return w.writeAggregate(PUSH, value)
+}
+
+// writeAggregate encodes the whole aggregate, nested values included.
+func (w *Writer) writeAggregate(typ Type, value Value) error {
+	value.typ = typ
+	buf, err := appendResp(w.buf, value, w.proto)
 	if err != nil {
 		return err
 	}
+	w.buf = buf
+	return w.done()
+}
+
+func (w *Writer) WriteDouble(f float64) error {
+	w.buf = appendDouble(w.buf, w.proto, f)
+	return w.done()
+}
+
+func (w *Writer) WriteBoolean(b bool) error {
+	w.buf = appendBoolean(w.buf, w.proto, b)
+	return w.done()
+}
+
+func (w *Writer) WriteBigNumber(str string) error {
+	w.buf = appendBigNumber(w.buf, w.proto, str)
+	return w.done()
+}
+
+func (w *Writer) WriteVerbatim(format, str string) error {
+	w.buf = appendVerbatim(w.buf, w.proto, format, str)
+	return w.done()
+}
+
+func appendSimple(buf []byte, typ byte, str string) []byte {
+	buf = append(buf, typ)
+	buf = append(buf, str...)
+	return append(buf, '\r', '\n')
+}
 
-	for _, v := range value.array {
-		switch v.typ {
-		case STRING:
-			err = w.WriteSimpleString(v.str)
-		case ERROR:
-			err = w.WriteError(v.str)
-		case INTEGER:
-			err = w.WriteInteger(v.integer)
-		case BULK:
-			err = w.WriteBulkString(v.str)
+func appendInteger(buf []byte, i int) []byte {
+	buf = append(buf, INTEGER)
+	buf = strconv.AppendInt(buf, int64(i), 10)
+	return append(buf, '\r', '\n')
+}
+
+func appendBulk(buf []byte, str string) []byte {
+	buf = append(buf, BULK)
+	buf = strconv.AppendInt(buf, int64(len(str)), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, str...)
+	return append(buf, '\r', '\n')
+}
+
+func appendNull(buf []byte, proto int) []byte {
+	if proto >= 3 {
+		return append(buf, "_\r\n"...)
+	}
+	return append(buf, "$-1\r\n"...)
+}
+
+// appendAggregateHeader appends the header of a RESP3 aggregate of n
+// elements, or of the flat array replacing it under RESP2.
+func appendAggregateHeader(buf []byte, proto int, typ byte, n int) []byte {
+	if proto >= 3 {
+		if typ == MAP {
+			n /= 2
 		}
+		buf = append(buf, typ)
+	} else {
+		buf = append(buf, ARRAY)
 	}
-	return err
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
 }
 
+func appendDouble(buf []byte, proto int, f float64) []byte {
+	if proto >= 3 {
+		return appendSimple(buf, DOUBLE, formatDouble(f))
+	}
+	return appendBulk(buf, formatDouble(f))
+}
+
+func appendBoolean(buf []byte, proto int, b bool) []byte {
+	if proto >= 3 {
+		if b {
+			return append(buf, "#t\r\n"...)
+		}
+		return append(buf, "#f\r\n"...)
+	}
+	if b {
+		return append(buf, ":1\r\n"...)
+	}
+	return append(buf, ":0\r\n"...)
+}
+
+func appendBigNumber(buf []byte, proto int, str string) []byte {
+	if proto >= 3 {
+		return appendSimple(buf, BIGNUMBER, str)
+	}
+	return appendBulk(buf, str)
+}
+
+// appendVerbatim appends a verbatim string with a three letter format such
+// as "txt", which RESP2 clients never see.
+func appendVerbatim(buf []byte, proto int, format, str string) []byte {
+	if proto < 3 {
+		return appendBulk(buf, str)
+	}
+	buf = append(buf, VERBATIM)
+	buf = strconv.AppendInt(buf, int64(len(str)+4), 10)
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, format...)
+	buf = append(buf, ':')
+	buf = append(buf, str...)
+	return append(buf, '\r', '\n')
+}
+
+// MarshalResp encodes v with the RESP3 types it holds.
 func (v Value) MarshalResp() ([]byte, error) {
-	return marshalResp(v)
+	return marshalResp(v, 3)
+}
+
+// marshalResp encodes v for a connection speaking proto, replacing RESP3
+// types by their RESP2 equivalent when proto is 2.
+func marshalResp(v Value, proto int) ([]byte, error) {
+	return appendResp(nil, v, proto)
 }
 
-func marshalResp(v Value) ([]byte, error) {
+func appendResp(buf []byte, v Value, proto int) ([]byte, error) {
+	if v.null {
+		if v.typ == BULK || proto >= 3 {
+			return appendNull(buf, proto), nil
+		}
+		return append(buf, "*-1\r\n"...), nil
+	}
+
 	switch v.typ {
-	case STRING:
-		return []byte("+" + v.str + "\r\n"), nil
-	case ERROR:
-		return []byte("-" + v.str + "\r\n"), nil
+	case STRING, ERROR:
+		return appendSimple(buf, byte(v.typ), v.str), nil
 	case INTEGER:
-		return []byte(":" + strconv.Itoa(v.integer) + "\r\n"), nil
+		return appendInteger(buf, v.integer), nil
 	case BULK:
-		return []byte("$" + strconv.Itoa(len(v.str)) + "\r\n" + v.str + "\r\n"), nil
-	case ARRAY:
-		buf := []byte("*" + strconv.Itoa(len(v.array)) + "\r\n")
+		return appendBulk(buf, v.str), nil
+	case DOUBLE:
+		return appendDouble(buf, proto, v.double), nil
+	case BOOLEAN:
+		return appendBoolean(buf, proto, v.boolean), nil
+	case BIGNUMBER:
+		return appendBigNumber(buf, proto, v.str), nil
+	case VERBATIM:
+		// str holds "fmt:payload"
+		if len(v.str) < 4 {
+			return nil, fmt.Errorf("invalid verbatim string: %q", v.str)
+		}
+		return appendVerbatim(buf, proto, v.str[:3], v.str[4:]), nil
+	case ARRAY, MAP, SET, PUSH:
+		buf = appendAggregateHeader(buf, proto, byte(v.typ), len(v.array))
 		for _, value := range v.array {
-			m, err := marshalResp(value)
-			if err != nil {
+			var err error
+			if buf, err = appendResp(buf, value, proto); err != nil {
 				return nil, err
 			}
-			buf = append(buf, m...)
 		}
 		return buf, nil
 	}
@@ -273,8 +834,12 @@ type Reader struct {
 	resp *Resp
 }
 
+// readBufferSize is the size of the connection read buffer, as Redis's
+// PROTO_IOBUF_LEN. Bulk strings that fit are parsed without an extra copy.
+const readBufferSize = 16 * 1024
+
 func NewReader(r io.Reader) *Reader {
-	rd := bufio.NewReader(r)
+	rd := bufio.NewReaderSize(r, readBufferSize)
 	return &Reader{
 		r:    rd,
 		resp: NewResp(rd),
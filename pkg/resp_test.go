@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 )
@@ -41,6 +42,282 @@ func TestWrite(t *testing.T) {
 	t.Logf("buf: %v", buf.String())
 }
 
+func readValue(t *testing.T, input string) (Value, error) {
+	t.Helper()
+	return NewResp(bufio.NewReader(strings.NewReader(input))).Read()
+}
+
+func TestReadInline(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"set  foo bar\n", []string{"set", "foo", "bar"}},
+		{"set k \"a b\\x41\\n\"\r\n", []string{"set", "k", "a bA\n"}},
+		{"set k ''\r\n", []string{"set", "k", ""}},
+	}
+	for _, c := range cases {
+		value, err := readValue(t, c.input)
+		if err != nil {
+			t.Fatalf("%q: %v", c.input, err)
+		}
+		if !value.IsArray() || len(value.Array()) != len(c.want) {
+			t.Fatalf("%q: expected %q, got %v", c.input, c.want, value)
+		}
+		for i, arg := range value.Array() {
+			if arg.String() != c.want[i] {
+				t.Fatalf("%q: expected %q, got %q", c.input, c.want[i], arg.String())
+			}
+		}
+	}
+}
+
+func TestReadInlineUnbalancedQuotes(t *testing.T) {
+	_, err := readValue(t, "set k \"abc\r\n")
+	if _, ok := err.(*ProtocolError); !ok {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
+
+func TestReadNulls(t *testing.T) {
+	value, err := readValue(t, "$-1\r\n")
+	if err != nil || value.typ != BULK || !value.IsNull() {
+		t.Fatalf("expected a null bulk string, got %v, %v", value, err)
+	}
+
+	value, err = readValue(t, "*-1\r\n")
+	if err != nil || value.typ != ARRAY || !value.IsNull() {
+		t.Fatalf("expected a null array, got %v, %v", value, err)
+	}
+
+	value, err = readValue(t, "*2\r\n$-1\r\n$1\r\na\r\n")
+	if err != nil || len(value.Array()) != 2 || !value.Array()[0].IsNull() {
+		t.Fatalf("expected a null element, got %v, %v", value, err)
+	}
+}
+
+func TestReadSimpleTypes(t *testing.T) {
+	value, err := readValue(t, "+OK\r\n")
+	if err != nil || value.typ != STRING || value.str != "OK" {
+		t.Fatalf("expected +OK, got %v, %v", value, err)
+	}
+
+	value, err = readValue(t, "-ERR bad\r\n")
+	if err != nil || value.typ != ERROR || value.str != "ERR bad" {
+		t.Fatalf("expected -ERR bad, got %v, %v", value, err)
+	}
+
+	value, err = readValue(t, ":-42\r\n")
+	if err != nil || value.typ != INTEGER || value.integer != -42 {
+		t.Fatalf("expected :-42, got %v, %v", value, err)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	for _, input := range []string{
+		"*abc\r\n",
+		"*-2\r\n",
+		"$-5\r\n",
+		"$999999999999\r\n",
+		":12a\r\n",
+		"$3\r\nfoobar\r\n",
+	} {
+		_, err := readValue(t, input)
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Fatalf("%q: expected a protocol error, got %v", input, err)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	for _, c := range []struct {
+		input, err string
+	}{
+		{"*2\r\n$3\r\nGET\r\n*1\r\n$1\r\nx\r\n", "Protocol error: expected '$', got '*'"},
+		{"*1\r\n:1\r\n", "Protocol error: expected '$', got ':'"},
+		{"*1\r\nPING\r\n", "Protocol error: expected '$', got 'P'"},
+		{"GET " + strings.Repeat("x", maxInlineSize) + "\r\n", "Protocol error: too big inline request"},
+	} {
+		_, err := NewReader(strings.NewReader(c.input)).resp.ReadRequest()
+		if err == nil || err.Error() != c.err {
+			t.Fatalf("%.20q: expected %q, got %v", c.input, c.err, err)
+		}
+	}
+
+	// inline commands longer than the read buffer are fine up to
+	// maxInlineSize
+	arg := strings.Repeat("x", readBufferSize*2)
+	value, err := NewReader(strings.NewReader("GET " + arg + "\r\n")).resp.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := value.Array(); len(args) != 2 || args[1].String() != arg {
+		t.Fatalf("expected GET and a %d byte key, got %d arguments", len(arg), len(args))
+	}
+}
+
+func TestWriteNestedArray(t *testing.T) {
+	value := ArrayValue(
+		BulkString("a"),
+		NullBulk(),
+		NullArray(),
+		ArrayValue(IntegerValue(1), ArrayValue(DoubleValue(2.5))),
+	)
+
+	buf := &bytes.Buffer{}
+	NewWriter(buf).WriteArray(value)
+	want := "*4\r\n$1\r\na\r\n$-1\r\n*-1\r\n*2\r\n:1\r\n*1\r\n$3\r\n2.5\r\n"
+	if buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	w := NewWriter(buf)
+	w.SetProto(3)
+	w.WriteArray(value)
+	want = "*4\r\n$1\r\na\r\n_\r\n_\r\n*2\r\n:1\r\n*1\r\n,2.5\r\n"
+	if buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestWriteArrayRoundTrip(t *testing.T) {
+	value := ArrayValue(BulkString("x"), ArrayValue(BulkString("y"), NullBulk()), NullArray())
+
+	buf := &bytes.Buffer{}
+	NewWriter(buf).WriteArray(value)
+	got, err := readValue(t, buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested := got.Array()[1].Array()
+	if len(got.Array()) != 3 || nested[0].String() != "y" || !nested[1].IsNull() || !got.Array()[2].IsNull() {
+		t.Fatalf("unexpected value %v", got)
+	}
+}
+
+func TestReadBulkLargerThanBuffer(t *testing.T) {
+	payload := strings.Repeat("x", readBufferSize*3)
+	input := "*2\r\n$3\r\nSET\r\n$" + fmt.Sprint(len(payload)) + "\r\n" + payload + "\r\n"
+
+	// iotest-style reader handing out a few bytes per call, so a single
+	// Read would come back short
+	value, err := NewReader(&slowReader{r: strings.NewReader(input)}).resp.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := value.Array()[1].String(); got != payload {
+		t.Fatalf("expected a %d byte payload, got %d bytes", len(payload), len(got))
+	}
+}
+
+type slowReader struct {
+	r io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return s.r.Read(p)
+}
+
+func TestBufferedWriterFlush(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf)
+	w.WriteSimpleString("OK")
+	w.WriteInteger(1)
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written before Flush, got %q", buf.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "+OK\r\n:1\r\n"; buf.String() != want {
+		t.Fatalf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestBufferedWriterLimits(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf)
+	big := strings.Repeat("x", 1<<20)
+
+	// replies past replyFlushSize go out without waiting for Flush
+	w.WriteBulkString(big)
+	if buf.Len() == 0 {
+		t.Fatal("expected the large reply written before Flush")
+	}
+	if w.buf != nil {
+		t.Fatalf("expected the large buffer dropped, kept %d bytes", cap(w.buf))
+	}
+
+	w.WriteSimpleString("OK")
+	w.Flush()
+	if cap(w.buf) == 0 || cap(w.buf) > maxReplyBufferCap {
+		t.Fatalf("expected a small buffer kept, got %d bytes", cap(w.buf))
+	}
+	if want := "$1048576\r\n" + big + "\r\n+OK\r\n"; buf.String() != want {
+		t.Fatal("expected the replies in order")
+	}
+}
+
+// repeatReader yields the same bytes forever.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func BenchmarkReadCommand(b *testing.B) {
+	cmd := []byte("*3\r\n$3\r\nSET\r\n$7\r\nkey:123\r\n$16\r\nvalue:0123456789\r\n")
+	rd := NewReader(&repeatReader{data: cmd})
+	b.SetBytes(int64(len(cmd)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rd.resp.ReadRequest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadInline(b *testing.B) {
+	rd := NewReader(&repeatReader{data: []byte("SET key:123 value\r\n")})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := rd.resp.ReadRequest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteReplies(b *testing.B) {
+	w := NewBufferedWriter(io.Discard)
+	array := ArrayValue(BulkString("a"), BulkString("b"), IntegerValue(3))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.WriteSimpleString("OK")
+		w.WriteBulkString("value:0123456789")
+		w.WriteInteger(i)
+		w.WriteArray(array)
+		// one flush per pipeline of 16 commands
+		if i%16 == 15 {
+			w.Flush()
+		}
+	}
+}
+
 func BenchmarkSprintf(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = []byte(fmt.Sprintf("%s %s", "foo", "bar"))
@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rewriteItemsPerCmd caps the elements written per command when a list,
+// set or sorted set is rewritten, like AOF_REWRITE_ITEMS_PER_CMD.
+const rewriteItemsPerCmd = 64
+
+var errRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// aofRewrite is a BGREWRITEAOF in progress. The keyspace is dumped one
+// shard at a time while holding the dispatcher's gate, and dumped records
+// which shards are in the new file already. A write touching a dumped
+// shard is copied to the rewrite buffer; a write touching only shards not
+// dumped yet reaches the new file through the dump itself. A DEL over keys
+// of both kinds is buffered for its dumped keys only: the others reach the
+// new file through the dump, and deleting them on replay would undo any
+// later write the dump saw. Writes whose result depends on keys they read,
+// like SORT STORE, must propagate what they wrote instead, or the buffered
+// command would replay against the later state the dump holds. dumped and
+// the dispatcher's rewrite pointer are guarded by the gate.
+type aofRewrite struct {
+	dumped [shardCount]bool
+	done   chan struct{}
+	err    error
+}
+
+// buffered returns what of the write argv must go to the rewrite buffer,
+// or nil when the dump covers it.
+func (rw *aofRewrite) buffered(h *CommandHandler, argv []Value) []Value {
+	pos := h.keyPositions(argv)
+	if len(pos) == 0 {
+		return argv
+	}
+	var dumped []int
+	for _, i := range pos {
+		if rw.dumped[shardIndex(argv[i].String())] {
+			dumped = append(dumped, i)
+		}
+	}
+	if len(dumped) == 0 {
+		return nil
+	}
+	if len(dumped) == len(pos) || !strings.EqualFold(argv[0].String(), "DEL") {
+		return argv
+	}
+	del := []Value{argv[0]}
+	for _, i := range dumped {
+		del = append(del, argv[i])
+	}
+	return del
+}
+
+// bgRewriteAof starts rewriting the AOF in the background and returns the
+// running rewrite.
+func (d *dispatcher) bgRewriteAof() (*aofRewrite, error) {
+	if d.Aof == nil {
+		return nil, errors.New("ERR The append only file is not enabled")
+	}
+
+	d.gate.Lock()
+	if d.rewrite != nil {
+		d.gate.Unlock()
+		return nil, errRewriteInProgress
+	}
+	rw := &aofRewrite{done: make(chan struct{})}
+	d.rewrite = rw
+	d.Aof.startRewrite()
+	d.gate.Unlock()
+
+	go func() {
+		rw.err = d.rewriteAof(rw)
+
+		d.gate.Lock()
+		d.rewrite = nil
+		d.gate.Unlock()
+		close(rw.done)
+	}()
+	return rw, nil
+}
+
+// autoRewriteAof starts a rewrite once the AOF has grown by
+// AutoAofRewritePercentage since the last one and is at least
+// AutoAofRewriteMinSize bytes.
+func (d *dispatcher) autoRewriteAof() {
+	pct := d.config.AutoAofRewritePercentage
+	if pct <= 0 || !d.Aof.grown(pct, d.config.AutoAofRewriteMinSize) {
+		return
+	}
+	d.bgRewriteAof()
+}
+
+func (d *dispatcher) rewriteAof(rw *aofRewrite) error {
+	a := d.Aof
+	tmp, err := os.CreateTemp(a.dir, "temp-rewriteaof-*.aof")
+	if err != nil {
+		a.abortRewrite(nil, err)
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if a.rdbPreamble {
+		err = d.rewriteRdbPreamble(rw, w)
+	} else {
+		err = d.rewriteCommands(rw, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		a.abortRewrite(tmp, err)
+		return err
+	}
+	return a.finishRewrite(tmp)
+}
+
+// rewriteCommands writes the commands recreating the keyspace to w, one
+// shard at a time.
+func (d *dispatcher) rewriteCommands(rw *aofRewrite, w io.Writer) error {
+	var buf []byte
+	if d.Aof.timestamps {
+		// the base file starts at the time of the rewrite
+		buf = timestampAnnotation(buf, time.Now().Unix())
+	}
+	for i, sh := range db.shards {
+		d.gate.Lock()
+		buf = rewriteShard(buf, sh)
+		rw.dumped[i] = true
+		d.gate.Unlock()
+
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		buf = buf[:0]
+	}
+	return nil
+}
+
+// rewriteRdbPreamble writes a snapshot of the keyspace to w as an RDB
+// file. The snapshot is taken holding the gate, and every shard counts as
+// dumped from then on, so the rewrite buffer gets exactly the writes the
+// snapshot misses.
+func (d *dispatcher) rewriteRdbPreamble(rw *aofRewrite, w io.Writer) error {
+	// wait for a running BGSAVE before taking the gate, not while holding
+	// it and the writers behind it
+	db.snapMu.Lock()
+	d.gate.Lock()
+	snap := db.takeSnapshot()
+	for i := range rw.dumped {
+		rw.dumped[i] = true
+	}
+	d.gate.Unlock()
+
+	defer snap.release()
+	return snap.writeRdb(w)
+}
+
+// rewriteShard appends the commands recreating the keys of sh to buf.
+func rewriteShard(buf []byte, sh *shard) []byte {
+	now := nowMs()
+	sh.RLock()
+	defer sh.RUnlock()
+	for key, e := range sh.m {
+		if e.expired(now) {
+			continue
+		}
+		buf = rewriteEntry(buf, key, e)
+	}
+	return buf
+}
+
+// rewriteEntry appends the commands recreating e at key to buf.
+func rewriteEntry(buf []byte, key string, e *entry) []byte {
+	// items collects the arguments after the key until flush writes
+	// them out as one command
+	var items []Value
+	flush := func(cmd string) {
+		if len(items) == 0 {
+			return
+		}
+		argv := append([]Value{BulkString(cmd), BulkString(key)}, items...)
+		buf, _ = appendResp(buf, ArrayValue(argv...), 2)
+		items = items[:0]
+	}
+
+	e.RLock()
+	switch e.typ {
+	case _String:
+		items = append(items, BulkString(e.value.(string)))
+		flush("SET")
+	case _Hash:
+		// HSET takes a single field
+		for field, value := range e.value.(hash) {
+			items = append(items, BulkString(field), BulkString(value))
+			flush("HSET")
+		}
+	case _List:
+		e.value.(*qlist).each(func(v string) {
+			items = append(items, BulkString(v))
+			if len(items) == rewriteItemsPerCmd {
+				flush("RPUSH")
+			}
+		})
+		flush("RPUSH")
+	case _Set:
+		for member := range e.value.(*Set).m {
+			items = append(items, BulkString(member))
+			if len(items) == rewriteItemsPerCmd {
+				flush("SADD")
+			}
+		}
+		flush("SADD")
+	case _ZSet:
+		for x := e.value.(*ZSet).zsl.first(); x != nil; x = x.forward() {
+			items = append(items, BulkString(strconv.FormatFloat(x.score, 'g', -1, 64)), BulkString(x.str))
+			if len(items) == 2*rewriteItemsPerCmd {
+				flush("ZADD")
+			}
+		}
+		flush("ZADD")
+	}
+	e.RUnlock()
+
+	if at := e.expireAt.Load(); at > 0 {
+		items = append(items, BulkString(strconv.FormatInt(at, 10)))
+		flush("PEXPIREAT")
+	}
+	return buf
+}
+
+// BgRewriteAofHandler implements BGREWRITEAOF.
+func BgRewriteAofHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR BGREWRITEAOF is not supported on this connection")
+		return ResultError
+	}
+	if _, err := c.srv.bgRewriteAof(); err != nil {
+		w.WriteError(err.Error())
+		return ResultError
+	}
+	w.WriteSimpleString("Background append only file rewriting started")
+	return ResultOK
+}
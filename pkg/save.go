@@ -0,0 +1,521 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RDB opcodes, as defined by Redis' rdb.h.
+const (
+	rdbOpcodeSlotInfo      = 244
+	rdbOpcodeFunction2     = 245
+	rdbOpcodeFunctionPreGA = 246
+	rdbOpcodeModuleAux     = 247
+	rdbOpcodeIdle          = 248
+	rdbOpcodeFreq          = 249
+	rdbOpcodeAux           = 250
+	rdbOpcodeResizeDB      = 251
+	rdbOpcodeExpireTimeMs  = 252
+	rdbOpcodeExpireTime    = 253
+	rdbOpcodeSelectDB      = 254
+	rdbOpcodeEOF           = 255
+)
+
+// defaultRdbFile is where snapshots go when Config.RdbFile is not set.
+const defaultRdbFile = "dump.rdb"
+
+// bgsaveRetryDelay is how long the save points wait after a failed BGSAVE
+// before trying again, like CONFIG_BGSAVE_RETRY_DELAY.
+const bgsaveRetryDelay = 5 * time.Second
+
+var errBgsaveInProgress = errors.New("ERR Background save already in progress")
+
+// SavePoint is a save rule: a BGSAVE starts once Changes writes happened
+// and Seconds seconds passed since the last successful save.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSavePoints parses save points written like the save directive of
+// redis.conf, "3600 1 300 100" for two of them. An empty string disables
+// snapshotting.
+func ParseSavePoints(s string) ([]SavePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save points %q", s)
+	}
+	var points []SavePoint
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, fmt.Errorf("invalid save points %q", s)
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points, nil
+}
+
+// writeRdb writes a snapshot of the keyspace to w as an RDB file. Writers
+// keep going meanwhile, see snapshot.go.
+func writeRdb(w io.Writer) error {
+	snap := db.snapshot()
+	defer snap.release()
+	return snap.writeRdb(w)
+}
+
+// writeRdb writes the snapshot to w as an RDB file.
+func (snap *snapshot) writeRdb(w io.Writer) error {
+	enc := &rdbEncoder{}
+	var crc uint64
+	flush := func() error {
+		crc = crc64Update(crc, enc.buf)
+		_, err := w.Write(enc.buf)
+		enc.buf = enc.buf[:0]
+		return err
+	}
+
+	enc.buf = fmt.Appendf(enc.buf, "REDIS%04d", rdbVersion)
+	enc.writeAux("redis-ver", redisVersion)
+	enc.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	enc.writeAux("ctime", strconv.FormatInt(snap.now/1000, 10))
+	enc.writeAux("used-mem", strconv.FormatInt(usedMemory.Load(), 10))
+	enc.writeByte(rdbOpcodeSelectDB)
+	enc.writeLength(0)
+	enc.writeByte(rdbOpcodeResizeDB)
+	enc.writeLength(uint64(snap.keys))
+	enc.writeLength(uint64(snap.expires))
+
+	for i := range snap.ks.shards {
+		snap.dumpShard(i, func(key string, typ entryType, value interface{}, expireAt int64) {
+			if expireAt > 0 {
+				enc.writeByte(rdbOpcodeExpireTimeMs)
+				enc.buf = binary.LittleEndian.AppendUint64(enc.buf, uint64(expireAt))
+			}
+			enc.writeByte(rdbObjectType(typ))
+			enc.writeString(key)
+			enc.writeValue(typ, value)
+		})
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	enc.writeByte(rdbOpcodeEOF)
+	crc = crc64Update(crc, enc.buf)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, crc)
+	_, err := w.Write(enc.buf)
+	return err
+}
+
+func (enc *rdbEncoder) writeAux(key, value string) {
+	enc.writeByte(rdbOpcodeAux)
+	enc.writeString(key)
+	enc.writeString(value)
+}
+
+// saveRdb atomically replaces the RDB file at path with a snapshot of the
+// keyspace.
+func saveRdb(path string) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = writeRdb(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// crcReader computes the CRC64 of everything read through it, which the
+// checksum at the end of an RDB file is checked against.
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = crc64Update(cr.crc, p[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc = crc64Update(cr.crc, []byte{b})
+	}
+	return b, err
+}
+
+// rdbKey is a key read from an RDB file. idle and freq are -1 when the
+// file has none.
+type rdbKey struct {
+	key        string
+	typ        entryType
+	value      interface{}
+	expireAt   int64
+	idle, freq int64
+}
+
+// readRdb reads the RDB file in r up to its checksum, calls fn, if not
+// nil, with each key and returns their number. Keys already expired are
+// skipped, and so are the keys of databases other than 0 since we only
+// have the one. r is left just past the file, for the AOF that may follow
+// an RDB preamble.
+func readRdb(r *bufio.Reader, fn func(k *rdbKey)) (int, error) {
+	cr := &crcReader{r: r}
+	d := &rdbDecoder{cr}
+
+	header, err := d.readFull(9)
+	if err != nil {
+		return 0, err
+	}
+	if string(header[:5]) != "REDIS" {
+		return 0, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return 0, fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	var (
+		loaded, skipped int
+		dbid            uint64
+		expireAt        int64
+		idle, freq      int64 = -1, -1
+	)
+	now := nowMs()
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return loaded, err
+		}
+
+		switch op {
+		case rdbOpcodeExpireTimeMs:
+			buf, err := d.readFull(8)
+			if err != nil {
+				return loaded, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+			continue
+		case rdbOpcodeExpireTime:
+			buf, err := d.readFull(4)
+			if err != nil {
+				return loaded, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+			continue
+		case rdbOpcodeFreq:
+			b, err := d.readByte()
+			if err != nil {
+				return loaded, err
+			}
+			freq = int64(b)
+			continue
+		case rdbOpcodeIdle:
+			n, err := d.readLen()
+			if err != nil {
+				return loaded, err
+			}
+			idle = int64(n)
+			continue
+		case rdbOpcodeEOF:
+			if version >= 5 {
+				want := cr.crc
+				buf, err := d.readFull(8)
+				if err != nil {
+					return loaded, err
+				}
+				// a zero checksum means it was disabled when saving
+				if got := binary.LittleEndian.Uint64(buf); got != 0 && got != want {
+					return loaded, errors.New("wrong RDB checksum")
+				}
+			}
+			if skipped > 0 {
+				log.Printf("RDB: skipped %d keys of databases other than 0", skipped)
+			}
+			return loaded, nil
+		case rdbOpcodeSelectDB:
+			if dbid, err = d.readLen(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpcodeResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return loaded, err
+			}
+			if _, err := d.readLen(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpcodeSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLen(); err != nil {
+					return loaded, err
+				}
+			}
+			continue
+		case rdbOpcodeAux:
+			if _, err := d.readString(); err != nil {
+				return loaded, err
+			}
+			if _, err := d.readString(); err != nil {
+				return loaded, err
+			}
+			continue
+		case rdbOpcodeFunction2:
+			// we have no functions to restore the library into
+			if _, err := d.readString(); err != nil {
+				return loaded, err
+			}
+			log.Printf("RDB: skipped a function library")
+			continue
+		case rdbOpcodeFunctionPreGA, rdbOpcodeModuleAux:
+			return loaded, fmt.Errorf("unsupported RDB opcode %d", op)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return loaded, err
+		}
+		typ, value, err := d.readObject(op)
+		if err != nil {
+			return loaded, fmt.Errorf("key %q: %w", key, err)
+		}
+
+		switch {
+		case dbid != 0:
+			skipped++
+		case expireAt > 0 && expireAt <= now:
+		case valueLen(typ, value) == 0:
+			log.Printf("RDB: skipped the empty key %q", key)
+		default:
+			if fn != nil {
+				fn(&rdbKey{key: key, typ: typ, value: value, expireAt: expireAt, idle: idle, freq: freq})
+			}
+			loaded++
+		}
+		expireAt, idle, freq = 0, -1, -1
+	}
+}
+
+// loadRdb loads the RDB file in r into the keyspace and returns the number
+// of keys loaded.
+func loadRdb(r *bufio.Reader) (int, error) {
+	return readRdb(r, addRdbKey)
+}
+
+func addRdbKey(k *rdbKey) {
+	e := newEntry(k.typ, k.value)
+	if k.idle >= 0 {
+		e.lru.Store(lruClock() - k.idle)
+	}
+	if k.freq >= 0 {
+		e.lfu.Store(lfuTimeInMinutes()<<8 | uint32(k.freq))
+	}
+	sh := db.shard(k.key)
+	sh.Lock()
+	sh.add(k.key, e)
+	if k.expireAt > 0 {
+		sh.setExpire(k.key, e, k.expireAt)
+	}
+	sh.Unlock()
+}
+
+// loadRdbFile loads the RDB file at path, if there is one.
+func loadRdbFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	n, err := loadRdb(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", path, err)
+	}
+	log.Printf("DB loaded from disk: %d keys in %.3f seconds", n, time.Since(start).Seconds())
+	return nil
+}
+
+func (d *dispatcher) rdbPath() string {
+	if d.config == nil || d.config.RdbFile == "" {
+		return defaultRdbFile
+	}
+	return d.config.RdbFile
+}
+
+// startSave marks a save as running and returns the channel to close once
+// it is done.
+func (d *dispatcher) startSave(bg bool) (chan struct{}, error) {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	if d.saving != nil {
+		return nil, errBgsaveInProgress
+	}
+	d.saving = make(chan struct{})
+	d.bgsaving = bg
+	return d.saving, nil
+}
+
+// finishSave records the outcome of a save that started when there were
+// dirty writes not on disk.
+func (d *dispatcher) finishSave(bg bool, dirty int64, err error) {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	now := time.Now()
+	if err == nil {
+		// writes made while saving are not covered
+		d.dirty.Add(-dirty)
+		d.lastSave.Store(now.Unix())
+	}
+	if bg {
+		d.lastBgsaveErr = err
+		d.lastBgsaveTry = now
+	}
+	close(d.saving)
+	d.saving = nil
+}
+
+// save writes a snapshot in the foreground.
+func (d *dispatcher) save() error {
+	if _, err := d.startSave(false); err != nil {
+		return err
+	}
+	dirty := d.dirty.Load()
+	err := saveRdb(d.rdbPath())
+	d.finishSave(false, dirty, err)
+	return err
+}
+
+// bgSave writes a snapshot in the background and returns a channel closed
+// once it is done.
+func (d *dispatcher) bgSave() (<-chan struct{}, error) {
+	done, err := d.startSave(true)
+	if err != nil {
+		return nil, err
+	}
+	dirty := d.dirty.Load()
+	go func() {
+		start := time.Now()
+		err := saveRdb(d.rdbPath())
+		if err != nil {
+			log.Printf("Background saving error: %v", err)
+		} else {
+			log.Printf("Background saving terminated with success in %.3f seconds", time.Since(start).Seconds())
+		}
+		d.finishSave(true, dirty, err)
+	}()
+	return done, nil
+}
+
+// saveCron starts a BGSAVE whenever a save point is reached, until stop
+// is closed.
+func (d *dispatcher) saveCron(stop <-chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		d.saveMu.Lock()
+		retry := d.lastBgsaveErr == nil || time.Since(d.lastBgsaveTry) >= bgsaveRetryDelay
+		d.saveMu.Unlock()
+		if !retry {
+			continue
+		}
+
+		dirty, elapsed := d.dirty.Load(), time.Now().Unix()-d.lastSave.Load()
+		for _, sp := range d.config.Save {
+			if dirty >= sp.Changes && dirty > 0 && elapsed >= sp.Seconds {
+				log.Printf("%d changes in %d seconds. Saving...", sp.Changes, sp.Seconds)
+				d.bgSave()
+				break
+			}
+		}
+	}
+}
+
+// SaveHandler implements SAVE.
+func SaveHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR SAVE is not supported on this connection")
+		return ResultError
+	}
+	if err := c.srv.save(); err != nil {
+		if err != errBgsaveInProgress {
+			err = fmt.Errorf("ERR %v", err)
+		}
+		w.WriteError(err.Error())
+		return ResultError
+	}
+	w.WriteSimpleString("OK")
+	return ResultOK
+}
+
+// BgSaveHandler implements BGSAVE [SCHEDULE]. A BGSAVE can run alongside
+// an AOF rewrite, so SCHEDULE starts it right away too.
+func BgSaveHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR BGSAVE is not supported on this connection")
+		return ResultError
+	}
+	if len(args) > 1 || len(args) == 1 && !strings.EqualFold(args[0].String(), "SCHEDULE") {
+		w.WriteError("ERR syntax error")
+		return ResultError
+	}
+	if _, err := c.srv.bgSave(); err != nil {
+		w.WriteError(err.Error())
+		return ResultError
+	}
+	w.WriteSimpleString("Background saving started")
+	return ResultOK
+}
+
+// LastSaveHandler implements LASTSAVE.
+func LastSaveHandler(w IWriter, args []Value) Result {
+	c, ok := w.(*Client)
+	if !ok || c.srv == nil {
+		w.WriteError("ERR LASTSAVE is not supported on this connection")
+		return ResultError
+	}
+	w.WriteInteger(int(c.srv.lastSave.Load()))
+	return ResultOK
+}
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSavePoints(t *testing.T) {
+	points, err := ParseSavePoints("3600 1 300 100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []SavePoint{{3600, 1}, {300, 100}}; !reflect.DeepEqual(points, want) {
+		t.Fatalf("expected %v, got %v", want, points)
+	}
+	if points, err := ParseSavePoints(""); err != nil || points != nil {
+		t.Fatalf("expected no save points, got %v, %v", points, err)
+	}
+	for _, bad := range []string{"3600", "0 1", "x 1", "60 -1"} {
+		if _, err := ParseSavePoints(bad); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRdbSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	d := mustDispatcher(t, &Config{RdbFile: path})
+
+	keys := []string{"rdb:s", "rdb:h", "rdb:l", "rdb:set", "rdb:z", "rdb:int"}
+	removeKeys := func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}
+	defer removeKeys()
+
+	runCommand(t, d, 2, "SET", "rdb:s", "hello")
+	runCommand(t, d, 2, "PEXPIRE", "rdb:s", "100000")
+	runCommand(t, d, 2, "SET", "rdb:int", "-12345")
+	runCommand(t, d, 2, "HSET", "rdb:h", "f", "v")
+	runCommand(t, d, 2, "RPUSH", "rdb:l", "a", "b", "c")
+	runCommand(t, d, 2, "SADD", "rdb:set", "x")
+	runCommand(t, d, 2, "ZADD", "rdb:z", "1.5", "m", "-inf", "n")
+
+	if got := runCommand(t, d, 2, "SAVE"); got != "+OK\r\n" {
+		t.Fatalf("expected +OK, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "INFO", "persistence"); !strings.Contains(got, "rdb_changes_since_last_save:0\r\n") {
+		t.Fatalf("expected no changes since the save, got %q", got)
+	}
+	removeKeys()
+
+	d = mustDispatcher(t, &Config{RdbFile: path})
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "rdb:s"}, "$5\r\nhello\r\n"},
+		{[]string{"GET", "rdb:int"}, "$6\r\n-12345\r\n"},
+		{[]string{"HGET", "rdb:h", "f"}, "$1\r\nv\r\n"},
+		{[]string{"LRANGE", "rdb:l", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"SMEMBERS", "rdb:set"}, "*1\r\n$1\r\nx\r\n"},
+		{[]string{"ZRANGE", "rdb:z", "0", "-1", "WITHSCORES"}, "*4\r\n$1\r\nn\r\n$4\r\n-inf\r\n$1\r\nm\r\n$3\r\n1.5\r\n"},
+	} {
+		if got := runCommand(t, d, 2, c.args...); got != c.want {
+			t.Fatalf("%v: expected %q, got %q", c.args, c.want, got)
+		}
+	}
+	if got := runCommand(t, d, 2, "PTTL", "rdb:s"); got == ":-1\r\n" || got == ":-2\r\n" {
+		t.Fatalf("expected the TTL to be loaded, got %q", got)
+	}
+}
+
+func TestRdbLoadRedisFile(t *testing.T) {
+	// the opcodes Redis 7 writes around the keys, a listpack hash and
+	// keys that must be skipped
+	lp := []byte{12, 0, 0, 0, 2, 0, 0x81, 'a', 0x02, 0x01, 0x01, 0xFF}
+	enc := &rdbEncoder{}
+	enc.buf = append(enc.buf, "REDIS0011"...)
+	enc.writeAux("redis-ver", "7.2.4")
+	enc.writeByte(rdbOpcodeFunction2)
+	enc.writeString("#!lua name=lib\nredis.register_function('f', function() return 1 end)")
+	enc.writeByte(rdbOpcodeSelectDB)
+	enc.writeLength(0)
+	enc.writeByte(rdbOpcodeResizeDB)
+	enc.writeLength(3)
+	enc.writeLength(1)
+	enc.writeByte(rdbOpcodeFreq)
+	enc.writeByte(10)
+	enc.writeByte(rdbTypeHashListpack)
+	enc.writeString("rdbredis:h")
+	enc.writeLength(uint64(len(lp)))
+	enc.buf = append(enc.buf, lp...)
+	enc.writeByte(rdbOpcodeExpireTime)
+	enc.buf = binary.LittleEndian.AppendUint32(enc.buf, 1)
+	enc.writeByte(rdbTypeString)
+	enc.writeString("rdbredis:expired")
+	enc.writeString("v")
+	enc.writeByte(rdbOpcodeSelectDB)
+	enc.writeLength(1)
+	enc.writeByte(rdbTypeString)
+	enc.writeString("rdbredis:db1")
+	enc.writeString("v")
+	enc.writeByte(rdbOpcodeEOF)
+	enc.buf = binary.LittleEndian.AppendUint64(enc.buf, crc64Update(0, enc.buf))
+
+	keys := []string{"rdbredis:h", "rdbredis:expired", "rdbredis:db1"}
+	defer func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}()
+
+	n, err := loadRdb(bufio.NewReader(bytes.NewReader(enc.buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 key loaded, got %d", n)
+	}
+	d := mustDispatcher(t, nil)
+	if got := runCommand(t, d, 2, "HGET", "rdbredis:h", "a"); got != "$1\r\n1\r\n" {
+		t.Fatalf("expected 1, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "OBJECT", "FREQ", "rdbredis:h"); got != ":10\r\n" {
+		t.Fatalf("expected a frequency of 10, got %q", got)
+	}
+	for _, key := range keys[1:] {
+		if got := runCommand(t, d, 2, "EXISTS", key); got != ":0\r\n" {
+			t.Fatalf("expected %s to be skipped, got %q", key, got)
+		}
+	}
+
+	enc.buf[len(enc.buf)-1] ^= 0xff
+	if _, err := loadRdb(bufio.NewReader(bytes.NewReader(enc.buf))); err == nil || err.Error() != "wrong RDB checksum" {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+}
+
+func TestBgSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	d := mustDispatcher(t, &Config{RdbFile: path})
+	d.lastSave.Store(0)
+
+	runCommand(t, d, 2, "SET", "bgsave:k", "v")
+	defer runCommand(t, d, 2, "DEL", "bgsave:k")
+
+	if _, err := d.startSave(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := runCommand(t, d, 2, "BGSAVE"); got != "-ERR Background save already in progress\r\n" {
+		t.Fatalf("expected the save in progress to be reported, got %q", got)
+	}
+	d.finishSave(false, 0, nil)
+
+	if got := runCommand(t, d, 2, "BGSAVE"); got != "+Background saving started\r\n" {
+		t.Fatalf("expected the save to start, got %q", got)
+	}
+	d.Close()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := runCommand(t, d, 2, "LASTSAVE"); got == ":0\r\n" {
+		t.Fatalf("expected LASTSAVE to move, got %q", got)
+	}
+	info := runCommand(t, d, 2, "INFO", "persistence")
+	for _, want := range []string{"rdb_changes_since_last_save:0\r\n", "rdb_bgsave_in_progress:0\r\n", "rdb_last_bgsave_status:ok\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("expected %q in %q", want, info)
+		}
+	}
+}
+
+func TestSavePoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	d := mustDispatcher(t, &Config{RdbFile: path, Save: []SavePoint{{Seconds: 1, Changes: 2}}})
+	defer d.Close()
+	d.lastSave.Store(0)
+
+	runCommand(t, d, 2, "SET", "savepoint:k", "1")
+	defer runCommand(t, d, 2, "DEL", "savepoint:k")
+	time.Sleep(300 * time.Millisecond)
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("expected no snapshot after a single change")
+	}
+
+	runCommand(t, d, 2, "SET", "savepoint:k", "2")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the save point to write a snapshot")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
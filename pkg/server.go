@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strings"
-	"sync"
 )
 
 type Conn struct {
@@ -18,7 +16,7 @@ type Conn struct {
 func NewConn(conn net.Conn) *Conn {
 	return &Conn{
 		Conn:       conn,
-		Writer:     NewWriter(conn),
+		Writer:     NewBufferedWriter(conn),
 		Reader:     NewReader(conn),
 		remoteAddr: conn.RemoteAddr().String(),
 	}
@@ -26,99 +24,110 @@ func NewConn(conn net.Conn) *Conn {
 
 type Config struct {
 	EnableAof bool
-	AofFile   string
+	// AofDir is the directory of the multi part AOF, appendonlydir by
+	// default, and AofFile the name its files start with,
+	// appendonly.aof by default. An AofFile given as a path, as before the
+	// multi part layout, names the files by its base, puts AofDir next to
+	// it by default and has the single file AOF there migrated.
+	AofDir  string
+	AofFile string
+	// AofLoadTruncated loads an AOF whose last command was cut short by
+	// a crash, dropping that command, instead of refusing to start.
+	AofLoadTruncated bool
+	// AofTimestampEnabled writes a #TS:<unix seconds> annotation before
+	// the first command of each second. AofTruncateToTimestamp, when set,
+	// cuts the AOF at the first annotation later than it before loading,
+	// so the keyspace is recovered as it was at that time.
+	AofTimestampEnabled    bool
+	AofTruncateToTimestamp int64
+	// AppendFsync is when the AOF is fsynced: always, everysec (the
+	// default) or no.
+	AppendFsync string
+	// AutoAofRewritePercentage starts a BGREWRITEAOF once the AOF has
+	// grown by this many percent since the last rewrite, 0 to disable.
+	// AutoAofRewriteMinSize is the size in bytes below which it doesn't.
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int64
+	// AofUseRdbPreamble writes the base file of a rewrite as an RDB
+	// snapshot, which loads much faster than the commands.
+	AofUseRdbPreamble bool
+
+	// RdbFile is the path of the RDB snapshot, dump.rdb by default. It
+	// is loaded at startup unless EnableAof is set, and written by SAVE,
+	// BGSAVE and the Save points.
+	RdbFile string
+	Save    []SavePoint
+
+	// RequirePass is the password of the default user, clients must
+	// authenticate with AUTH or HELLO when it is set.
+	RequirePass string
+
+	// MaxMemory is the limit in bytes of the approximate memory used by
+	// the keyspace, 0 for no limit.
+	MaxMemory int64
+	// MaxMemoryPolicy is one of noeviction (the default), allkeys-lru,
+	// allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu,
+	// volatile-random and volatile-ttl.
+	MaxMemoryPolicy string
+	// MaxMemorySamples is the number of keys sampled per eviction.
+	MaxMemorySamples int
 }
 
 type Server struct {
-	sync.RWMutex
-	handlers map[string]CommandHandler
-	accpet   func(conn net.Conn) bool
-	config   *Config
-	Aof      *Aof
+	*dispatcher
 }
 
-func NewServer(config *Config) *Server {
-	handlers := make(map[string]CommandHandler)
-
-	for cmd, handler := range defaultHandlers {
-		handlers[cmd] = handler
-	}
-
-	s := &Server{
-		handlers: handlers,
-		config:   config,
-	}
-
-	if s.config != nil && s.config.EnableAof {
-		bootstrapAof(s)
+func NewServer(config *Config) (*Server, error) {
+	d, err := newDispatcher(config)
+	if err != nil {
+		return nil, err
 	}
-
-	return s
-}
-
-func (s *Server) HandlerFunc(cmd string, handler CommandHandler) {
-	s.Lock()
-	defer s.Unlock()
-	s.handlers[strings.ToUpper(cmd)] = handler
-}
-
-func (s *Server) AccpetFunc(f func(conn net.Conn) bool) {
-	s.Lock()
-	defer s.Unlock()
-	s.accpet = f
+	return &Server{dispatcher: d}, nil
 }
 
 func (s *Server) handleConn(conn net.Conn) error {
 	c := NewConn(conn)
+	client := s.newClient(c.Writer)
 	// tcpconn := conn.(*net.TCPConn)
 	// tcpconn.SetNoDelay(false)
 
 	defer conn.Close()
-	s.Lock()
-	accpet := s.accpet
-	s.Unlock()
-	if accpet != nil && !accpet(conn) {
+	defer c.Writer.Flush()
+	if !s.accept(conn) {
 		return nil
 	}
 
 	for {
-		value, err := c.Reader.resp.Read()
-		if err != nil {
-			return err
+		// replies to a pipeline are flushed together once every command
+		// read so far has run
+		if c.Reader.r.Buffered() == 0 {
+			if err := c.Writer.Flush(); err != nil {
+				return err
+			}
 		}
 
-		if value.typ == 0 {
-			continue
+		value, err := c.Reader.resp.ReadRequest()
+		if err != nil {
+			if perr, ok := err.(*ProtocolError); ok {
+				c.Writer.WriteError("ERR " + perr.Error())
+			}
+			return err
 		}
 
-		if !value.IsArray() {
+		if !value.IsArray() || value.IsNull() {
 			continue
 		}
 
 		req := value.Array()
-
-		cmd := strings.ToUpper(req[0].String())
-
-		s.RLock()
-		handler, ok := s.handlers[cmd]
-		s.RUnlock()
-
-		if !ok {
-			if err := c.Writer.WriteError("ERR unknown command '" + cmd + "'"); err != nil {
-				return err
-			}
-
+		if len(req) == 0 {
 			continue
 		}
 
-		if !handler.call(c.Writer, req[1:]) {
-			return nil
-		}
-
-		if s.Aof != nil && handler.should_persist() {
-			if err := s.Aof.Append(value); err != nil {
-				return err
+		if err := s.exec(client, req); err != nil {
+			if err == errCloseConn {
+				return nil
 			}
+			return err
 		}
 	}
 }
@@ -150,32 +159,3 @@ func (s *Server) ListenAndServe(addr string) error {
 		}()
 	}
 }
-
-func bootstrapAof(s *Server) {
-	aof, err := NewAof(s.config.AofFile)
-	if err != nil {
-		panic(err)
-	}
-
-	s.Aof = aof
-
-	aof.ReadValues(func(value Value) bool {
-		cmds := value.Array()
-
-		cmd := strings.ToUpper(cmds[0].String())
-
-		s.RLock()
-		handler, ok := s.handlers[cmd]
-		s.RUnlock()
-
-		if !ok {
-			return true
-		}
-
-		// create fake writer
-
-		handler.call(NewWriter(io.Discard), cmds[1:])
-
-		return true
-	})
-}
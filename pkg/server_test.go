@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestPipelineRepliesFlushedTogether(t *testing.T) {
+	server, client := net.Pipe()
+	conn := &countingConn{Conn: server}
+	srv, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.handleConn(conn)
+	defer client.Close()
+
+	go client.Write([]byte("PING\r\nPING\r\n*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n"))
+
+	rd := bufio.NewReader(client)
+	for _, want := range []string{"+PONG\r\n", "+PONG\r\n", "+hi\r\n"} {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Fatalf("expected %q, got %q", want, line)
+		}
+	}
+	if n := conn.writes.Load(); n != 1 {
+		t.Fatalf("expected the pipeline to be answered in 1 write, got %d", n)
+	}
+}
@@ -2,105 +2,102 @@ package pkg
 
 import (
 	"strconv"
-	"sync"
 )
 
 type Set struct {
 	m map[string]struct{}
 }
 
-func SAddHandler(w IWriter, args []Value) bool {
-	if len(args) < 2 {
-		w.WriteError("ERR wrong number of arguments for 'sadd' command")
-		return false
-	}
-
+func SAddHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	values := args[1:]
 
-	dbMu.Lock()
-	e, ok := db[key]
+	added := 0
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if ok {
 		if e.typ != _Set {
 			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
+			sh.Unlock()
+			return ResultError
 		}
 		e.Lock()
+		e.cow()
 		set := e.value.(*Set)
+		var delta int64
 		for _, v := range values {
-			set.m[v.String()] = struct{}{}
+			if _, ok := set.m[v.String()]; !ok {
+				set.m[v.String()] = struct{}{}
+				delta += setMemberSize(v.String())
+				added++
+			}
 		}
+		e.grow(delta)
 		e.Unlock()
 	} else {
 		s := &Set{make(map[string]struct{})}
 		for _, v := range values {
 			s.m[v.String()] = struct{}{}
 		}
-		db[key] = &entry{_Set, s, sync.RWMutex{}}
+		sh.add(key, newEntry(_Set, s))
+		added = len(s.m)
 	}
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, added)
 
 	w.WriteInteger(len(values))
-	return true
+	return ResultOK
 }
 
-func SCardHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'scard' command")
-		return false
-	}
-
+func SCardHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
 	if !ok {
 		w.WriteInteger(0)
-		dbMu.RUnlock()
-		return true
+		sh.RUnlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.RUnlock()
-		return false
+		sh.RUnlock()
+		return ResultError
 	}
 	e.RLock()
 	set := e.value.(*Set)
 	w.WriteInteger(len(set.m))
 	e.RUnlock()
-	dbMu.RUnlock()
-	return true
+	sh.RUnlock()
+	return ResultOK
 }
 
-func SIsMemberHandler(w IWriter, args []Value) bool {
-	if len(args) != 2 {
-		w.WriteError("ERR wrong number of arguments for 'sismember' command")
-		return false
-	}
-
+func SIsMemberHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	member := args[1].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
 	if !ok {
 		w.WriteInteger(0)
-		dbMu.RUnlock()
-		return true
+		sh.RUnlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.RUnlock()
-		return false
+		sh.RUnlock()
+		return ResultError
 	}
 	e.RLock()
 	set := e.value.(*Set)
 	_, ok = set.m[member]
 	w.WriteInteger(bool2int(ok))
 	e.RUnlock()
-	dbMu.RUnlock()
-	return true
+	sh.RUnlock()
+	return ResultOK
 }
 
 func bool2int(b bool) int {
@@ -110,25 +107,21 @@ func bool2int(b bool) int {
 	return 0
 }
 
-func SMembersHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'smembers' command")
-		return false
-	}
-
+func SMembersHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
 	if !ok {
-		w.WriteArray(Value{typ: ARRAY, array: []Value{}})
-		dbMu.RUnlock()
-		return true
+		w.WriteSet(Value{typ: SET, array: []Value{}})
+		sh.RUnlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.RUnlock()
-		return false
+		sh.RUnlock()
+		return ResultError
 	}
 	e.RLock()
 	set := e.value.(*Set)
@@ -137,15 +130,15 @@ func SMembersHandler(w IWriter, args []Value) bool {
 		values = append(values, BulkString(v))
 	}
 	e.RUnlock()
-	dbMu.RUnlock()
-	w.WriteArray(Value{typ: ARRAY, array: values})
-	return true
+	sh.RUnlock()
+	w.WriteSet(Value{typ: SET, array: values})
+	return ResultOK
 }
 
-func SRandMemberHandler(w IWriter, args []Value) bool {
+func SRandMemberHandler(w IWriter, args []Value) Result {
 	if len(args) < 1 || len(args) > 2 {
 		w.WriteError("ERR wrong number of arguments for 'srandmember' command")
-		return false
+		return ResultError
 	}
 
 	key := args[0].String()
@@ -155,21 +148,22 @@ func SRandMemberHandler(w IWriter, args []Value) bool {
 		count, err = strconv.Atoi(args[1].String())
 		if err != nil {
 			w.WriteError("ERR value is not an integer or out of range")
-			return false
+			return ResultError
 		}
 	}
 
-	dbMu.RLock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
 	if !ok {
 		w.WriteArray(Value{typ: ARRAY, array: []Value{}})
-		dbMu.RUnlock()
-		return true
+		sh.RUnlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.RUnlock()
-		return false
+		sh.RUnlock()
+		return ResultError
 	}
 	e.RLock()
 	set := e.value.(*Set)
@@ -183,81 +177,84 @@ func SRandMemberHandler(w IWriter, args []Value) bool {
 		}
 	}
 	e.RUnlock()
-	dbMu.RUnlock()
+	sh.RUnlock()
 	w.WriteArray(Value{typ: ARRAY, array: values})
-	return true
+	return ResultOK
 }
 
-func SPopHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'spop' command")
-		return false
-	}
-
+func SPopHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if !ok {
 		w.WriteNull()
-		dbMu.Unlock()
-		return true
+		sh.Unlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.Unlock()
-		return false
+		sh.Unlock()
+		return ResultError
 	}
 	e.Lock()
+	e.cow()
 	set := e.value.(*Set)
+	if len(set.m) == 0 {
+		w.WriteNull()
+	}
 	for v := range set.m {
 		delete(set.m, v)
+		e.grow(-setMemberSize(v))
 		w.WriteBulkString(v)
+		// the member is chosen at random, log which one
+		propagate(w, "SREM", key, v)
+		markDirty(w, 1)
 		break
 	}
 	if len(set.m) == 0 {
-		delete(db, key)
+		sh.remove(key)
 	}
 	e.Unlock()
-	dbMu.Unlock()
-	return true
+	sh.Unlock()
+	return ResultOK
 }
 
-func SRemHandler(w IWriter, args []Value) bool {
-	if len(args) < 2 {
-		w.WriteError("ERR wrong number of arguments for 'srem' command")
-		return false
-	}
-
+func SRemHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	members := args[1:]
 
-	dbMu.Lock()
-	e, ok := db[key]
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
 	if !ok {
 		w.WriteInteger(0)
-		dbMu.Unlock()
-		return true
+		sh.Unlock()
+		return ResultOK
 	}
 	if e.typ != _Set {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		dbMu.Unlock()
-		return false
+		sh.Unlock()
+		return ResultError
 	}
 	e.Lock()
+	e.cow()
 	set := e.value.(*Set)
 	count := 0
 	for _, v := range members {
 		if _, ok := set.m[v.String()]; ok {
 			delete(set.m, v.String())
+			e.grow(-setMemberSize(v.String()))
 			count++
 		}
 	}
 	if len(set.m) == 0 {
-		delete(db, key)
+		sh.remove(key)
 	}
 	e.Unlock()
-	dbMu.Unlock()
+	sh.Unlock()
+	markDirty(w, count)
 	w.WriteInteger(count)
-	return true
+	return ResultOK
 }
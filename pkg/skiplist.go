@@ -2,6 +2,8 @@ package pkg
 
 import "math/rand"
 
+const skipListMaxLevel = 32
+
 type skipList struct {
 	header *skipListNode
 	tail   *skipListNode
@@ -10,13 +12,16 @@ type skipList struct {
 }
 
 func newSkipList() *skipList {
+	header := &skipListNode{
+		next: make([]*skipListLevel, skipListMaxLevel),
+	}
+	for i := range header.next {
+		header.next[i] = &skipListLevel{}
+	}
 	return &skipList{
-		header: &skipListNode{
-			next: make([]*skipListLevel, 32),
-		},
-		level: 1,
+		header: header,
+		level:  1,
 	}
-
 }
 
 type skipListNode struct {
@@ -43,7 +48,7 @@ func compareSkipListNodes(a, b *skipListNode) bool {
 // generate a random level for skip list via coin flip.
 func randomLevel() int {
 	level := 1
-	for (rand.Int31()&0xFFFF)%2 == 0 {
+	for level < skipListMaxLevel && (rand.Int31()&0xFFFF)%2 == 0 {
 		level++
 	}
 	return level
@@ -56,16 +61,18 @@ func (sl *skipList) Insert(score float64, str string) *skipListNode {
 		score: score,
 	}
 
-	// find the insert position
-	update := make([]*skipListNode, 32)
-	rank := make([]int, 32)
+	// find the insert position, rank[i] is the rank of update[i]
+	update := make([]*skipListNode, skipListMaxLevel)
+	rank := make([]int, skipListMaxLevel)
 	x := sl.header
-	for i := sl.level - 1; i >= 1; i-- {
-		rank[i] = rank[i-1]
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
 
-		for x.next[i-1] != nil && compareSkipListNodes(x.next[i-1].forward, node) {
-			rank[i] += x.next[i-1].span
-			x = x.next[i-1].forward
+		for x.next[i].forward != nil && compareSkipListNodes(x.next[i].forward, node) {
+			rank[i] += x.next[i].span
+			x = x.next[i].forward
 		}
 		update[i] = x
 	}
@@ -75,6 +82,7 @@ func (sl *skipList) Insert(score float64, str string) *skipListNode {
 	if level > sl.level {
 		for i := sl.level; i < level; i++ {
 			update[i] = sl.header
+			update[i].next[i].span = int(sl.length)
 			rank[i] = 0
 		}
 		sl.level = level
@@ -82,17 +90,25 @@ func (sl *skipList) Insert(score float64, str string) *skipListNode {
 
 	// insert the new node
 	node.next = make([]*skipListLevel, level)
-	for i := 1; i <= level; i++ {
-		node.next[i-1].forward = update[i].next[i-1].forward
-		update[i].next[i-1].forward = node
-		if i == 1 {
-			node.bwd = update[i]
-		}
-		if node.next[i-1].forward != nil {
-			node.next[i-1].forward.bwd = node
-		}
-		node.next[i-1].span = update[i].next[i-1].span - (rank[1] - rank[i])
-		update[i].next[i-1].span = (rank[1] - rank[i]) + 1
+	for i := 0; i < level; i++ {
+		node.next[i] = &skipListLevel{forward: update[i].next[i].forward}
+		update[i].next[i].forward = node
+		node.next[i].span = update[i].next[i].span - (rank[0] - rank[i])
+		update[i].next[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// levels above the new node skip over one more element
+	for i := level; i < sl.level; i++ {
+		update[i].next[i].span++
+	}
+
+	if update[0] != sl.header {
+		node.bwd = update[0]
+	}
+	if node.next[0].forward != nil {
+		node.next[0].forward.bwd = node
+	} else {
+		sl.tail = node
 	}
 
 	sl.length++
@@ -101,11 +117,12 @@ func (sl *skipList) Insert(score float64, str string) *skipListNode {
 
 func (sl *skipList) Delete(score float64, str string) bool {
 	// find the node
-	update := make([]*skipListNode, 32)
+	target := &skipListNode{str: str, score: score}
+	update := make([]*skipListNode, skipListMaxLevel)
 	x := sl.header
-	for i := sl.level - 1; i >= 1; i-- {
-		for x.next[i-1] != nil && compareSkipListNodes(x.next[i-1].forward, &skipListNode{str: str, score: score}) {
-			x = x.next[i-1].forward
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i].forward != nil && compareSkipListNodes(x.next[i].forward, target) {
+			x = x.next[i].forward
 		}
 		update[i] = x
 	}
@@ -116,23 +133,51 @@ func (sl *skipList) Delete(score float64, str string) bool {
 	}
 
 	// delete the node
-	for i := 1; i <= sl.level; i++ {
-		if update[i].next[i-1].forward == x {
-			update[i].next[i-1].forward = x.next[i-1].forward
-			update[i].next[i-1].span += x.next[i-1].span - 1
+	for i := 0; i < sl.level; i++ {
+		if update[i].next[i].forward == x {
+			update[i].next[i].span += x.next[i].span - 1
+			update[i].next[i].forward = x.next[i].forward
 		} else {
-			update[i].next[i-1].span--
+			update[i].next[i].span--
 		}
 	}
 
 	if x.next[0].forward != nil {
 		x.next[0].forward.bwd = x.bwd
+	} else {
+		sl.tail = x.bwd
 	}
 
-	for sl.level > 1 && sl.header.next[sl.level-1] == nil {
+	for sl.level > 1 && sl.header.next[sl.level-1].forward == nil {
 		sl.level--
 	}
 
 	sl.length--
 	return true
 }
+
+// first returns the node with the lowest score, nil if the list is empty.
+func (sl *skipList) first() *skipListNode {
+	return sl.header.next[0].forward
+}
+
+// forward returns the node following n, nil at the end of the list.
+func (n *skipListNode) forward() *skipListNode {
+	return n.next[0].forward
+}
+
+// nodeByRank returns the node at the 1-based rank, nil if out of range.
+func (sl *skipList) nodeByRank(rank int) *skipListNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i].forward != nil && traversed+x.next[i].span <= rank {
+			traversed += x.next[i].span
+			x = x.next[i].forward
+		}
+		if traversed == rank && x != sl.header {
+			return x
+		}
+	}
+	return nil
+}
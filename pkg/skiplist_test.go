@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkipListInsertDelete(t *testing.T) {
+	sl := newSkipList()
+	scores := make(map[string]float64)
+	for i := 0; i < 1000; i++ {
+		member := strconv.Itoa(i)
+		scores[member] = float64(rand.Intn(100))
+		sl.Insert(scores[member], member)
+	}
+	for i := 0; i < 1000; i += 3 {
+		member := strconv.Itoa(i)
+		if !sl.Delete(scores[member], member) {
+			t.Fatalf("failed to delete %s", member)
+		}
+		delete(scores, member)
+	}
+
+	if int(sl.length) != len(scores) {
+		t.Fatalf("expected length %d, got %d", len(scores), sl.length)
+	}
+
+	var got []string
+	for x := sl.first(); x != nil; x = x.forward() {
+		got = append(got, x.str)
+	}
+	want := make([]string, 0, len(scores))
+	for member := range scores {
+		want = append(want, member)
+	}
+	sort.Slice(want, func(i, j int) bool {
+		a, b := want[i], want[j]
+		if scores[a] != scores[b] {
+			return scores[a] < scores[b]
+		}
+		return a < b
+	})
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("position %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+	if sl.tail == nil || sl.tail.str != want[len(want)-1] {
+		t.Fatal("tail does not point at the last node")
+	}
+}
@@ -0,0 +1,188 @@
+package pkg
+
+// Snapshots give BGSAVE a point-in-time view of the keyspace without
+// stopping writers, the way fork's copy-on-write does for Redis.
+//
+// Taking a snapshot locks every shard for a moment to bump the keyspace
+// epoch and set cowEpoch, so each entry existing at that point has a
+// version older than the snapshot. A writer about to mutate such an
+// entry in place calls cow first, which copies the value to frozen and
+// moves the version to the snapshot's epoch; entries added afterwards get
+// that epoch in add. Entries removed or replaced before the snapshot
+// reached their shard are kept in the shard's ghosts. The snapshot then
+// dumps one shard at a time: an entry is seen through frozen if it has
+// one for this epoch, as is if its version is older, and not at all
+// otherwise. Dumping an entry moves its version too, so writers only pay
+// for a copy until the snapshot is past their key.
+
+// frozenValue is the value and expiry of an entry when a snapshot was
+// taken.
+type frozenValue struct {
+	epoch    uint64
+	value    interface{}
+	expireAt int64
+}
+
+// cow preserves the value of e for the running snapshot, if it has not
+// dumped e yet, before e is mutated. The caller must hold e's write lock.
+func (e *entry) cow() {
+	epoch := db.cowEpoch.Load()
+	if epoch == 0 || e.version.Load() >= epoch {
+		return
+	}
+	e.frozen = &frozenValue{epoch: epoch, value: cloneValue(e.typ, e.value), expireAt: e.expireAt.Load()}
+	e.version.Store(epoch)
+}
+
+// keepGhost keeps e, removed from key, for the running snapshot. Only the
+// first entry removed matters: an entry that existed when the snapshot was
+// taken is always removed before any entry added later at the same key.
+// The caller must hold sh's write lock.
+func (sh *shard) keepGhost(key string, e *entry) {
+	if sh.ghosts == nil {
+		return
+	}
+	if _, ok := sh.ghosts[key]; !ok {
+		sh.ghosts[key] = e
+	}
+}
+
+// cloneValue returns a deep copy of value.
+func cloneValue(typ entryType, value interface{}) interface{} {
+	switch typ {
+	case _List:
+		items := make([]string, 0, value.(*qlist).len)
+		value.(*qlist).each(func(v string) {
+			items = append(items, v)
+		})
+		return newQlistFrom(items)
+	case _Hash:
+		h := value.(hash)
+		c := make(hash, len(h))
+		for field, v := range h {
+			c[field] = v
+		}
+		return c
+	case _Set:
+		set := value.(*Set)
+		c := &Set{m: make(map[string]struct{}, len(set.m))}
+		for member := range set.m {
+			c.m[member] = struct{}{}
+		}
+		return c
+	case _ZSet:
+		zs := NewZSet()
+		for x := value.(*ZSet).zsl.first(); x != nil; x = x.forward() {
+			zs.add(x.str, x.score)
+		}
+		return zs
+	}
+	return value
+}
+
+// snapshot is a point-in-time view of a keyspace. Only one can run at a
+// time, and it must be released.
+type snapshot struct {
+	ks    *keyspace
+	epoch uint64
+	// now is when the snapshot was taken, keys expired by then are left
+	// out
+	now int64
+	// keys and expires are the number of keys, and of those with an
+	// expiry, when the snapshot was taken
+	keys, expires int
+	dumped        [shardCount]bool
+}
+
+// snapshot takes a snapshot of ks, waiting for a running one to be
+// released first.
+func (ks *keyspace) snapshot() *snapshot {
+	ks.snapMu.Lock()
+	return ks.takeSnapshot()
+}
+
+// takeSnapshot is snapshot for callers already holding snapMu.
+func (ks *keyspace) takeSnapshot() *snapshot {
+	for _, sh := range ks.shards {
+		sh.Lock()
+	}
+	s := &snapshot{ks: ks, epoch: ks.epoch.Add(1), now: nowMs()}
+	ks.cowEpoch.Store(s.epoch)
+	for _, sh := range ks.shards {
+		s.keys += len(sh.m)
+		s.expires += len(sh.volatile)
+		sh.ghosts = make(map[string]*entry)
+	}
+	for i := len(ks.shards) - 1; i >= 0; i-- {
+		ks.shards[i].Unlock()
+	}
+	return s
+}
+
+// dumpShard calls fn with every key of the i-th shard as it was when the
+// snapshot was taken. fn runs under the entry's lock and must not retain
+// value.
+func (s *snapshot) dumpShard(i int, fn func(key string, typ entryType, value interface{}, expireAt int64)) {
+	sh := s.ks.shards[i]
+	sh.RLock()
+	for key, e := range sh.m {
+		s.visit(key, e, fn)
+	}
+	for key, e := range sh.ghosts {
+		s.visit(key, e, fn)
+	}
+	sh.RUnlock()
+
+	sh.Lock()
+	sh.ghosts = nil
+	sh.Unlock()
+	s.dumped[i] = true
+}
+
+func (s *snapshot) visit(key string, e *entry, fn func(key string, typ entryType, value interface{}, expireAt int64)) {
+	e.Lock()
+	defer e.Unlock()
+
+	var value interface{}
+	var at int64
+	switch {
+	case e.frozen != nil && e.frozen.epoch == s.epoch:
+		value, at = e.frozen.value, e.frozen.expireAt
+	case e.version.Load() < s.epoch:
+		value, at = e.value, e.expireAt.Load()
+	default:
+		// added after the snapshot was taken
+		return
+	}
+	e.frozen = nil
+	e.version.Store(s.epoch)
+
+	if at > 0 && at <= s.now {
+		return
+	}
+	fn(key, e.typ, value, at)
+}
+
+// release ends the snapshot, dropping what was preserved for the shards it
+// did not dump.
+func (s *snapshot) release() {
+	s.ks.cowEpoch.Store(0)
+	for i, sh := range s.ks.shards {
+		if s.dumped[i] {
+			continue
+		}
+		sh.Lock()
+		for _, m := range []map[string]*entry{sh.m, sh.ghosts} {
+			for _, e := range m {
+				e.Lock()
+				if e.frozen != nil && e.frozen.epoch == s.epoch {
+					e.frozen = nil
+				}
+				e.Unlock()
+			}
+		}
+		sh.ghosts = nil
+		sh.Unlock()
+	}
+	s.ks.snapMu.Unlock()
+}
@@ -0,0 +1,212 @@
+package pkg
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshotValues collects every key of snap whose name starts with prefix.
+func snapshotValues(snap *snapshot, prefix string) map[string]interface{} {
+	values := make(map[string]interface{})
+	for i := range db.shards {
+		snap.dumpShard(i, func(key string, typ entryType, value interface{}, expireAt int64) {
+			if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+				values[key] = cloneValue(typ, value)
+			}
+		})
+	}
+	return values
+}
+
+func TestSnapshotPointInTime(t *testing.T) {
+	d := mustDispatcher(t, nil)
+	keys := []string{"snap:s", "snap:h", "snap:l", "snap:set", "snap:z", "snap:del", "snap:new"}
+	defer func() {
+		unlock := db.lockKeys(keys...)
+		for _, key := range keys {
+			db.shard(key).remove(key)
+		}
+		unlock()
+	}()
+
+	runCommand(t, d, 2, "SET", "snap:s", "old")
+	runCommand(t, d, 2, "HSET", "snap:h", "f", "old")
+	runCommand(t, d, 2, "RPUSH", "snap:l", "a")
+	runCommand(t, d, 2, "SADD", "snap:set", "x")
+	runCommand(t, d, 2, "ZADD", "snap:z", "1", "m")
+	runCommand(t, d, 2, "SET", "snap:del", "v")
+
+	snap := db.snapshot()
+	runCommand(t, d, 2, "SET", "snap:s", "new")
+	runCommand(t, d, 2, "HSET", "snap:h", "f", "new")
+	runCommand(t, d, 2, "RPUSH", "snap:l", "b")
+	runCommand(t, d, 2, "SADD", "snap:set", "y")
+	runCommand(t, d, 2, "ZADD", "snap:z", "2", "m")
+	runCommand(t, d, 2, "PEXPIRE", "snap:z", "1")
+	runCommand(t, d, 2, "DEL", "snap:del")
+	runCommand(t, d, 2, "SET", "snap:new", "v")
+	values := snapshotValues(snap, "snap:")
+	snap.release()
+
+	if len(values) != 6 {
+		t.Fatalf("expected the 6 keys there were, got %v", values)
+	}
+	if values["snap:s"] != "old" || values["snap:del"] != "v" {
+		t.Fatalf("expected the old strings, got %v", values)
+	}
+	if h := values["snap:h"].(hash); h["f"] != "old" {
+		t.Fatalf("expected the old hash, got %v", h)
+	}
+	if l := values["snap:l"].(*qlist); l.len != 1 {
+		t.Fatalf("expected the old list, got %d elements", l.len)
+	}
+	if s := values["snap:set"].(*Set); len(s.m) != 1 {
+		t.Fatalf("expected the old set, got %v", s.m)
+	}
+	if zs := values["snap:z"].(*ZSet); zs.dict["m"] != 1 {
+		t.Fatalf("expected the old score, got %v", zs.dict)
+	}
+
+	// the live keyspace moved on and kept nothing for the snapshot
+	if got := runCommand(t, d, 2, "HGET", "snap:h", "f"); got != "$3\r\nnew\r\n" {
+		t.Fatalf("expected the new value, got %q", got)
+	}
+	for _, sh := range db.shards {
+		sh.RLock()
+		ghosts := sh.ghosts
+		for _, e := range sh.m {
+			if e.frozen != nil {
+				t.Fatal("expected no frozen value left")
+			}
+		}
+		sh.RUnlock()
+		if ghosts != nil {
+			t.Fatal("expected no ghosts left")
+		}
+	}
+}
+
+func TestSnapshotConsistentAcrossShards(t *testing.T) {
+	// a and b land in different shards, and b is always set right after
+	// a, so any point in time has b equal to a or one behind
+	a, b := "snapcons:a", "snapcons:b"
+	if shardIndex(a) == shardIndex(b) {
+		t.Fatal("expected the keys in different shards")
+	}
+	defer func() {
+		unlock := db.lockKeys(a, b)
+		db.shard(a).remove(a)
+		db.shard(b).remove(b)
+		unlock()
+	}()
+
+	w := NewWriter(io.Discard)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			SetHandler(w, []Value{BulkString(a), BulkString(strconv.Itoa(i))})
+			SetHandler(w, []Value{BulkString(b), BulkString(strconv.Itoa(i))})
+		}
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for n := 0; n < 50; n++ {
+		snap := db.snapshot()
+		values := snapshotValues(snap, "snapcons:")
+		snap.release()
+
+		if values[a] == nil || values[b] == nil {
+			continue
+		}
+		va, _ := strconv.Atoi(values[a].(string))
+		vb, _ := strconv.Atoi(values[b].(string))
+		if vb != va && vb != va-1 {
+			t.Fatalf("expected a point in time view, got a=%d b=%d", va, vb)
+		}
+	}
+}
+
+// BenchmarkSetDuringSnapshot is BenchmarkSetParallel with snapshots of
+// 100k keys running back to back. It reports the 99th percentile and the
+// worst SET latency, to compare with snapshot=false.
+func BenchmarkSetDuringSnapshot(b *testing.B) {
+	for _, snapshots := range []bool{false, true} {
+		b.Run("snapshot="+strconv.FormatBool(snapshots), func(b *testing.B) {
+			benchmarkSetDuringSnapshot(b, snapshots)
+		})
+	}
+}
+
+func benchmarkSetDuringSnapshot(b *testing.B, snapshots bool) {
+	keys := make([]Value, 100000)
+	for i := range keys {
+		keys[i] = BulkString("snapbench:" + strconv.Itoa(i))
+	}
+	value := BulkString("xxx")
+	w := NewWriter(io.Discard)
+	for _, key := range keys {
+		SetHandler(w, []Value{key, value})
+	}
+	defer func() {
+		for _, key := range keys {
+			DelHandler(w, []Value{key})
+		}
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if snapshots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				writeRdb(io.Discard)
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := NewWriter(io.Discard)
+		var local []time.Duration
+		i := 0
+		for pb.Next() {
+			start := time.Now()
+			SetHandler(w, []Value{keys[i%len(keys)], value})
+			local = append(local, time.Since(start))
+			i++
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	b.ReportMetric(float64(latencies[len(latencies)-1].Nanoseconds()), "max-ns")
+}
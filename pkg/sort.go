@@ -0,0 +1,334 @@
+package pkg
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type sortOptions struct {
+	by       string
+	dontsort bool
+	gets     []string
+	offset   int
+	count    int
+	desc     bool
+	alpha    bool
+	store    string
+}
+
+func parseSortOptions(args []Value, readonly bool) (*sortOptions, string) {
+	opts := &sortOptions{count: -1}
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToUpper(args[i].String()) {
+		case "ASC":
+			opts.desc = false
+		case "DESC":
+			opts.desc = true
+		case "ALPHA":
+			opts.alpha = true
+		case "LIMIT":
+			if left < 2 {
+				return nil, "ERR syntax error"
+			}
+			offset, err1 := strconv.Atoi(args[i+1].String())
+			count, err2 := strconv.Atoi(args[i+2].String())
+			if err1 != nil || err2 != nil {
+				return nil, "ERR value is not an integer or out of range"
+			}
+			opts.offset, opts.count = offset, count
+			i += 2
+		case "STORE":
+			if left < 1 || readonly {
+				return nil, "ERR syntax error"
+			}
+			opts.store = args[i+1].String()
+			i++
+		case "BY":
+			if left < 1 {
+				return nil, "ERR syntax error"
+			}
+			opts.by = args[i+1].String()
+			// a pattern without '*' can't vary with the element, so the
+			// result is left unsorted
+			if !strings.Contains(opts.by, "*") {
+				opts.dontsort = true
+			}
+			i++
+		case "GET":
+			if left < 1 {
+				return nil, "ERR syntax error"
+			}
+			opts.gets = append(opts.gets, args[i+1].String())
+			i++
+		default:
+			return nil, "ERR syntax error"
+		}
+	}
+	return opts, ""
+}
+
+// lookupKeyByPattern substitutes subst for the first '*' of pattern and
+// returns the string stored at the resulting key. With "key->field" the
+// field of the hash stored at key is returned instead. "#" returns subst.
+// locked is set when the caller holds every shard already.
+func lookupKeyByPattern(pattern, subst string, locked bool) (string, bool) {
+	if pattern == "#" {
+		return subst, true
+	}
+
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", false
+	}
+
+	keyPattern, field := pattern, ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		keyPattern = pattern[:star+1+arrow]
+		field = pattern[star+1+arrow+2:]
+	}
+	key := keyPattern[:star] + subst + keyPattern[star+1:]
+
+	sh := db.shard(key)
+	if !locked {
+		sh.RLock()
+	}
+	e, ok := sh.lookup(key)
+	if !locked {
+		sh.RUnlock()
+	}
+	if !ok {
+		return "", false
+	}
+
+	e.RLock()
+	defer e.RUnlock()
+
+	if field != "" {
+		if e.typ != _Hash {
+			return "", false
+		}
+		v, ok := e.value.(hash)[field]
+		return v, ok
+	}
+
+	if e.typ != _String {
+		return "", false
+	}
+	return e.value.(string), true
+}
+
+type sortItem struct {
+	value  string
+	score  float64
+	weight string
+	null   bool // the BY key was missing, with ALPHA
+}
+
+func sortGeneric(w IWriter, args []Value, readonly bool) Result {
+	key := args[0].String()
+	opts, errMsg := parseSortOptions(args[1:], readonly)
+	if opts == nil {
+		w.WriteError(errMsg)
+		return ResultError
+	}
+
+	// STORE writes the destination under the same locks it read the
+	// source with. Patterns may read any key, so they take every shard
+	// rather than locking theirs out of order.
+	locked := false
+	if opts.store != "" {
+		if opts.by != "" || len(opts.gets) > 0 {
+			defer db.lockAll()()
+			locked = true
+		} else {
+			defer db.lockKeys(key, opts.store)()
+		}
+	}
+
+	sh := db.shard(key)
+	if opts.store == "" {
+		sh.RLock()
+	}
+	e, ok := sh.lookup(key)
+	if opts.store == "" {
+		sh.RUnlock()
+	}
+
+	var items []sortItem
+	if ok {
+		e.RLock()
+		switch e.typ {
+		case _List:
+			e.value.(*qlist).each(func(v string) {
+				items = append(items, sortItem{value: v})
+			})
+		case _Set:
+			for v := range e.value.(*Set).m {
+				items = append(items, sortItem{value: v})
+			}
+		case _ZSet:
+			zs := e.value.(*ZSet)
+			for x := zs.zsl.first(); x != nil; x = x.forward() {
+				items = append(items, sortItem{value: x.str})
+			}
+		default:
+			e.RUnlock()
+			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return ResultError
+		}
+		typ := e.typ
+		e.RUnlock()
+
+		// sets have no order of their own, sort them anyway so the
+		// reply is deterministic
+		if opts.dontsort && typ == _Set {
+			opts.dontsort = false
+			opts.alpha = true
+			opts.by = ""
+		}
+	}
+
+	if !opts.dontsort {
+		for i := range items {
+			weight := items[i].value
+			if opts.by != "" {
+				v, ok := lookupKeyByPattern(opts.by, items[i].value, locked)
+				if !ok {
+					// a missing weight counts as 0, or sorts first
+					// with ALPHA
+					items[i].null = opts.alpha
+					continue
+				}
+				weight = v
+			}
+
+			if opts.alpha {
+				items[i].weight = weight
+				continue
+			}
+			score, err := strconv.ParseFloat(weight, 64)
+			if err != nil || math.IsNaN(score) {
+				w.WriteError("ERR One or more scores can't be converted into double")
+				return ResultError
+			}
+			items[i].score = score
+		}
+
+		sort.SliceStable(items, func(i, j int) bool {
+			a, b := items[i], items[j]
+			var cmp int
+			switch {
+			case a.null && b.null:
+				cmp = 0
+			case a.null:
+				cmp = -1
+			case b.null:
+				cmp = 1
+			case opts.alpha:
+				cmp = strings.Compare(a.weight, b.weight)
+			case a.score < b.score:
+				cmp = -1
+			case a.score > b.score:
+				cmp = 1
+			}
+			// ties are broken by the element itself
+			if cmp == 0 {
+				cmp = strings.Compare(a.value, b.value)
+			}
+			if opts.desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+
+	// LIMIT
+	start, end := opts.offset, len(items)
+	if start < 0 {
+		start = 0
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	if opts.count >= 0 && start+opts.count < end {
+		end = start + opts.count
+	}
+	items = items[start:end]
+
+	values := make([]Value, 0, len(items)*max(len(opts.gets), 1))
+	for _, item := range items {
+		if len(opts.gets) == 0 {
+			values = append(values, BulkString(item.value))
+			continue
+		}
+		for _, pattern := range opts.gets {
+			v, ok := lookupKeyByPattern(pattern, item.value, locked)
+			if !ok {
+				values = append(values, NullBulk())
+				continue
+			}
+			values = append(values, BulkString(v))
+		}
+	}
+
+	if opts.store == "" {
+		// nothing was written
+		w.WriteArray(Value{typ: ARRAY, array: values})
+		return ResultOK
+	}
+
+	elems := make([]string, 0, len(values))
+	for _, v := range values {
+		elems = append(elems, v.String())
+	}
+
+	// log the stored list rather than the command, whose result depends
+	// on keys an AOF rewrite may have dumped at a later state
+	dsh := db.shard(opts.store)
+	if len(elems) > 0 {
+		dsh.add(opts.store, newEntry(_List, newQlistFrom(elems)))
+		propagate(w, "DEL", opts.store)
+		propagate(w, append([]string{"RPUSH", opts.store}, elems...)...)
+		markDirty(w, len(elems))
+	} else if _, ok := dsh.lookupWrite(opts.store); ok {
+		dsh.remove(opts.store)
+		propagate(w, "DEL", opts.store)
+		markDirty(w, 1)
+	}
+
+	w.WriteInteger(len(elems))
+	return ResultOK
+}
+
+// sortGetKeys returns the sorted key and, with STORE, the destination.
+func sortGetKeys(argv []Value) []int {
+	keys := []int{1}
+	for i := 2; i < len(argv); i++ {
+		switch strings.ToUpper(argv[i].String()) {
+		case "LIMIT":
+			i += 2
+		case "BY", "GET":
+			i++
+		case "STORE":
+			if i+1 < len(argv) {
+				keys = append(keys, i+1)
+			}
+			i++
+		}
+	}
+	return keys
+}
+
+// SortHandler implements SORT key [BY pattern] [LIMIT offset count]
+// [GET pattern ...] [ASC|DESC] [ALPHA] [STORE destination].
+func SortHandler(w IWriter, args []Value) Result {
+	return sortGeneric(w, args, false)
+}
+
+// SortROHandler is SORT without STORE.
+func SortROHandler(w IWriter, args []Value) Result {
+	return sortGeneric(w, args, true)
+}
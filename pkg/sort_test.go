@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func sortReply(t *testing.T, args ...string) string {
+	t.Helper()
+	values := make([]Value, 0, len(args))
+	for _, arg := range args {
+		values = append(values, BulkString(arg))
+	}
+	buf := &bytes.Buffer{}
+	SortHandler(NewWriter(buf), values)
+	return buf.String()
+}
+
+func TestSort(t *testing.T) {
+	w := NewWriter(io.Discard)
+	RPushHandler(w, []Value{BulkString("sort:list"), BulkString("3"), BulkString("1"), BulkString("2")})
+	HSetHandler(w, []Value{BulkString("sort:w_1"), BulkString("weight"), BulkString("30")})
+	HSetHandler(w, []Value{BulkString("sort:w_2"), BulkString("weight"), BulkString("10")})
+	HSetHandler(w, []Value{BulkString("sort:w_3"), BulkString("weight"), BulkString("20")})
+	SetHandler(w, []Value{BulkString("sort:name_1"), BulkString("one")})
+	SetHandler(w, []Value{BulkString("sort:name_3"), BulkString("three")})
+	SetHandler(w, []Value{BulkString("sort:v_1"), BulkString("5")})
+	SetHandler(w, []Value{BulkString("sort:v_2"), BulkString("-1")})
+	SetHandler(w, []Value{BulkString("sort:sp_1"), BulkString(" 1 ")})
+
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"sort:list"}, "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n"},
+		{[]string{"sort:list", "DESC", "LIMIT", "0", "2"}, "*2\r\n$1\r\n3\r\n$1\r\n2\r\n"},
+		{[]string{"sort:list", "BY", "sort:w_*->weight"}, "*3\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n1\r\n"},
+		{[]string{"sort:list", "BY", "nosort"}, "*3\r\n$1\r\n3\r\n$1\r\n1\r\n$1\r\n2\r\n"},
+		// the missing sort:v_3 weighs 0
+		{[]string{"sort:list", "BY", "sort:v_*"}, "*3\r\n$1\r\n2\r\n$1\r\n3\r\n$1\r\n1\r\n"},
+		{[]string{"sort:list", "BY", "sort:sp_*"}, "-ERR One or more scores can't be converted into double\r\n"},
+		{[]string{"sort:list", "GET", "#", "GET", "sort:w_*->weight", "LIMIT", "0", "1"}, "*2\r\n$1\r\n1\r\n$2\r\n30\r\n"},
+		{[]string{"sort:list", "STORE", "sort:dst"}, ":3\r\n"},
+		{[]string{"sort:list", "BY", "sort:w_*->weight", "GET", "sort:name_*", "STORE", "sort:dst2"}, ":3\r\n"},
+	}
+	for _, c := range cases {
+		if got := sortReply(t, c.args...); got != c.want {
+			t.Errorf("SORT %v: expected %q, got %q", c.args, c.want, got)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	LRangeHandler(NewWriter(buf), []Value{BulkString("sort:dst"), BulkString("0"), BulkString("-1")})
+	if want := "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$1\r\n3\r\n"; buf.String() != want {
+		t.Errorf("expected stored list %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	SortROHandler(NewWriter(buf), []Value{BulkString("sort:list"), BulkString("STORE"), BulkString("sort:dst")})
+	if want := "-ERR syntax error\r\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestSortAlpha(t *testing.T) {
+	w := NewWriter(io.Discard)
+	SAddHandler(w, []Value{BulkString("sort:set"), BulkString("banana"), BulkString("apple"), BulkString("cherry")})
+
+	if got, want := sortReply(t, "sort:set", "ALPHA"), "*3\r\n$5\r\napple\r\n$6\r\nbanana\r\n$6\r\ncherry\r\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := sortReply(t, "sort:set"), "-ERR One or more scores can't be converted into double\r\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -9,94 +9,80 @@ var (
 	strMu sync.RWMutex
 )
 
-func SetHandler(w IWriter, args []Value) bool {
-	if len(args) != 2 {
-		w.WriteError("ERR wrong number of arguments for 'set' command")
-		return false
-	}
-
+func SetHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 	value := args[1].String()
 
-	dbMu.Lock()
-	if _, ok := db[key]; ok {
-		if db[key].typ != _String {
-			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
-		}
-	}
-	db[key] = &entry{_String, value, sync.RWMutex{}}
-	dbMu.Unlock()
+	// like Redis, SET replaces a value of any type
+	sh := db.shard(key)
+	sh.Lock()
+	sh.add(key, newEntry(_String, value))
+	sh.Unlock()
+	markDirty(w, 1)
 
 	w.WriteSimpleString("OK")
-	return true
+	return ResultOK
 }
 
-func GetHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'get' command")
-		return false
-	}
-
+func GetHandler(w IWriter, args []Value) Result {
 	key := args[0].String()
 
-	dbMu.RLock()
-	e, ok := db[key]
-	dbMu.RUnlock()
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
 
 	if !ok {
 		w.WriteNull()
-		return true
+		return ResultOK
 	}
 
 	if e.typ != _String {
 		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		return false
+		return ResultError
 	}
 
 	w.WriteBulkString(e.value.(string))
-	return true
+	return ResultOK
 }
 
-func DelHandler(w IWriter, args []Value) bool {
-	if len(args) != 1 {
-		w.WriteError("ERR wrong number of arguments for 'del' command")
-		return false
+func DelHandler(w IWriter, args []Value) Result {
+	keys := make([]string, 0, len(args))
+	for _, arg := range args {
+		keys = append(keys, arg.String())
 	}
 
-	key := args[0].String()
-
-	dbMu.Lock()
-	if _, ok := db[key]; !ok {
-		w.WriteInteger(0)
-		dbMu.Unlock()
-		return true
+	unlock := db.lockKeys(keys...)
+	deleted := 0
+	for _, key := range keys {
+		sh := db.shard(key)
+		if _, ok := sh.lookupWrite(key); ok {
+			sh.remove(key)
+			deleted++
+		}
 	}
-	delete(db, key)
-	dbMu.Unlock()
-	w.WriteInteger(1)
-	return true
+	unlock()
+	markDirty(w, deleted)
+
+	w.WriteInteger(deleted)
+	return ResultOK
 }
 
-func ExistsHandler(w IWriter, args []Value) bool {
-	if len(args) < 1 {
-		w.WriteError("ERR wrong number of arguments for 'exist' command")
-		return false
+func ExistsHandler(w IWriter, args []Value) Result {
+	keys := make([]string, 0, len(args))
+	for _, arg := range args {
+		keys = append(keys, arg.String())
 	}
 
 	result := 0
 
-	for _, arg := range args {
-		key := arg.String()
-
-		dbMu.RLock()
-		_, ok := db[key]
-		dbMu.RUnlock()
-		if ok {
+	unlock := db.rlockKeys(keys...)
+	for _, key := range keys {
+		if _, ok := db.shard(key).lookup(key); ok {
 			result++
 		}
 	}
+	unlock()
 	w.WriteInteger(result)
-	return true
+	return ResultOK
 }
@@ -1,8 +1,9 @@
 package pkg
 
 import (
+	"math"
 	"strconv"
-	"sync"
+	"strings"
 )
 
 type ZSet struct {
@@ -17,56 +18,198 @@ func NewZSet() *ZSet {
 	}
 }
 
-func ZAddHandler(w IWriter, args []Value) bool {
-	if len(args) < 3 {
-		w.WriteError("ERR wrong number of arguments for 'zadd' command")
-		return false
+// add sets the score of member and reports whether member is new.
+func (zs *ZSet) add(member string, score float64) (*skipListNode, bool) {
+	old, exists := zs.dict[member]
+	if exists {
+		zs.zsl.Delete(old, member)
+	}
+	zs.dict[member] = score
+	return zs.zsl.Insert(score, member), !exists
+}
+
+func ZAddHandler(w IWriter, args []Value) Result {
+	if len(args)%2 == 0 {
+		w.WriteError("ERR syntax error")
+		return ResultError
 	}
 
 	key := args[0].String()
-	dbMu.Lock()
-	e, ok := db[key]
-	if ok {
-		if e.typ != _ZSet {
-			w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
-			dbMu.Unlock()
-			return false
+	scores := make([]float64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i].String(), 64)
+		if err != nil || math.IsNaN(score) {
+			w.WriteError("ERR value is not a valid float")
+			return ResultError
 		}
-		e.Lock()
-		zset := e.value.(*ZSet)
-		for i := 1; i < len(args); i += 2 {
-			score, err := strconv.ParseFloat(args[i].String(), 64)
-			if err != nil {
-				w.WriteError("ERR value is not a valid float")
-				e.Unlock()
-				dbMu.Unlock()
-				return false
-			}
-			member := args[i+1].String()
-			if _, ok := zset.dict[member]; ok {
-				zset.zsl.Delete(zset.dict[member], member)
-			}
-			zset.dict[member] = score
-			zset.zsl.Insert(score, member)
+		scores = append(scores, score)
+	}
+
+	sh := db.shard(key)
+	sh.Lock()
+	e, ok := sh.lookupWrite(key)
+	if ok && e.typ != _ZSet {
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		sh.Unlock()
+		return ResultError
+	}
+	if !ok {
+		e = newEntry(_ZSet, NewZSet())
+		sh.add(key, e)
+	}
+
+	e.Lock()
+	e.cow()
+	zset := e.value.(*ZSet)
+	added, changed := 0, 0
+	for i, score := range scores {
+		member := args[2*i+2].String()
+		if old, ok := zset.dict[member]; ok && old == score {
+			continue
+		}
+		if node, isNew := zset.add(member, score); isNew {
+			e.grow(zsetMemberSize(member, len(node.next)))
+			added++
+		}
+		changed++
+	}
+	e.Unlock()
+	sh.Unlock()
+	markDirty(w, changed)
+
+	w.WriteInteger(added)
+	return ResultOK
+}
+
+func ZRangeHandler(w IWriter, args []Value) Result {
+	if len(args) != 3 && len(args) != 4 {
+		w.WriteError("ERR wrong number of arguments for 'zrange' command")
+		return ResultError
+	}
+
+	key := args[0].String()
+	start, err := strconv.Atoi(args[1].String())
+	if err != nil {
+		w.WriteError("ERR value is not an integer or out of range")
+		return ResultError
+	}
+	stop, err := strconv.Atoi(args[2].String())
+	if err != nil {
+		w.WriteError("ERR value is not an integer or out of range")
+		return ResultError
+	}
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3].String()) != "WITHSCORES" {
+			w.WriteError("ERR syntax error")
+			return ResultError
 		}
-		e.Unlock()
-	} else {
-		zset := NewZSet()
-		for i := 1; i < len(args); i += 2 {
-			score, err := strconv.ParseFloat(args[i].String(), 64)
-			if err != nil {
-				w.WriteError("ERR value is not a valid float")
-				dbMu.Unlock()
-				return false
+		withScores = true
+	}
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteArray(Value{typ: ARRAY, array: []Value{}})
+		return ResultOK
+	}
+	if e.typ != _ZSet {
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
+
+	e.RLock()
+	zset := e.value.(*ZSet)
+	l := int(zset.zsl.length)
+	if start < 0 {
+		start = l + start
+	}
+	if stop < 0 {
+		stop = l + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= l {
+		stop = l - 1
+	}
+
+	values := []Value{}
+	if start <= stop {
+		x := zset.zsl.nodeByRank(start + 1)
+		for i := start; i <= stop && x != nil; i++ {
+			switch {
+			case withScores && w.Proto() >= 3:
+				// RESP3 clients get [member, score] pairs
+				values = append(values, ArrayValue(BulkString(x.str), DoubleValue(x.score)))
+			case withScores:
+				values = append(values, BulkString(x.str), DoubleValue(x.score))
+			default:
+				values = append(values, BulkString(x.str))
 			}
-			member := args[i+1].String()
-			zset.dict[member] = score
-			zset.zsl.Insert(score, member)
+			x = x.forward()
 		}
-		db[key] = &entry{_ZSet, zset, sync.RWMutex{}}
 	}
-	dbMu.Unlock()
+	e.RUnlock()
+
+	w.WriteArray(Value{typ: ARRAY, array: values})
+	return ResultOK
+}
+
+func ZScoreHandler(w IWriter, args []Value) Result {
+	key := args[0].String()
+	member := args[1].String()
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteNull()
+		return ResultOK
+	}
+	if e.typ != _ZSet {
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
+
+	e.RLock()
+	score, ok := e.value.(*ZSet).dict[member]
+	e.RUnlock()
+
+	if !ok {
+		w.WriteNull()
+		return ResultOK
+	}
+	w.WriteDouble(score)
+	return ResultOK
+}
+
+func ZCardHandler(w IWriter, args []Value) Result {
+	key := args[0].String()
+
+	sh := db.shard(key)
+	sh.RLock()
+	e, ok := sh.lookup(key)
+	sh.RUnlock()
+
+	if !ok {
+		w.WriteInteger(0)
+		return ResultOK
+	}
+	if e.typ != _ZSet {
+		w.WriteError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return ResultError
+	}
+
+	e.RLock()
+	n := len(e.value.(*ZSet).dict)
+	e.RUnlock()
 
-	w.WriteInteger(len(args) / 2)
-	return true
+	w.WriteInteger(n)
+	return ResultOK
 }
@@ -0,0 +1,20 @@
+package pkg
+
+import "testing"
+
+func TestZAddRejectsNaN(t *testing.T) {
+	d := mustDispatcher(t, nil)
+
+	for _, score := range []string{"nan", "NaN", "-nan"} {
+		if got := runCommand(t, d, 2, "ZADD", "znan:z", score, "m"); got != "-ERR value is not a valid float\r\n" {
+			t.Fatalf("ZADD %s: expected an invalid float error, got %q", score, got)
+		}
+	}
+	if got := runCommand(t, d, 2, "EXISTS", "znan:z"); got != ":0\r\n" {
+		t.Fatalf("expected no sorted set to be created, got %q", got)
+	}
+	if got := runCommand(t, d, 2, "ZADD", "znan:z", "inf", "m"); got != ":1\r\n" {
+		t.Fatalf("expected inf to be accepted, got %q", got)
+	}
+	runCommand(t, d, 2, "DEL", "znan:z")
+}